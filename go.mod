@@ -13,7 +13,9 @@ require (
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/jmoiron/sqlx v1.2.1-0.20190826204134-d7d95172beb5
 	github.com/kr/pretty v0.1.0 // indirect
+	github.com/lib/pq v1.3.0
 	github.com/mattn/go-colorable v0.1.1 // indirect
+	github.com/mattn/go-sqlite3 v1.11.0
 	github.com/mitchellh/mapstructure v1.1.2 // indirect
 	github.com/mr-tron/base58 v0.0.0-20181030092856-c8897612421d
 	github.com/olivere/elastic v6.2.27+incompatible
@@ -0,0 +1,162 @@
+package indexer
+
+import (
+	"context"
+	"time"
+
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+)
+
+// backfillChunkSize is the number of consecutive blocks one worker fetches before picking up a new range
+const backfillChunkSize = 100
+
+// backfillSegmentSize is the number of blocks after which the progress of a backfill is recorded in the checkpoint,
+// for databases that don't commit every chunk in a transaction
+const backfillSegmentSize = 10000
+
+// blockDocuments contains all documents derived from one block
+type blockDocuments struct {
+	block          doc.DocType
+	txs            []doc.DocType
+	names          []doc.DocType
+	tokens         []doc.DocType
+	tokenTransfers []doc.DocType
+	// err is set if the documents are incomplete, because a receipt or events could not be fetched. The block has been recorded as failed
+	err error
+}
+
+// sendTxs pushes the documents derived from the block's transactions to the respective channels
+func (docs *blockDocuments) sendTxs(txChannel, nameChannel, tokenChannel, tokenTxChannel chan doc.DocType) {
+	for _, d := range docs.names {
+		nameChannel <- d
+	}
+	for _, d := range docs.tokens {
+		tokenChannel <- d
+	}
+	for _, d := range docs.tokenTransfers {
+		tokenTxChannel <- d
+	}
+	for _, d := range docs.txs {
+		txChannel <- d
+	}
+}
+
+// backfillJob is a range of block heights [from, to] fetched by one worker
+type backfillJob struct {
+	from   uint64
+	to     uint64
+	result chan []*blockDocuments
+}
+
+// fetchBlocksInRange fetches and converts the blocks in [fromBlockHeight, toBlockHeight] using ns.workers parallel workers.
+// Each worker fetches a disjoint range of heights; handle is called for every block strictly in order of height.
+func (ns *Indexer) fetchBlocksInRange(ctx context.Context, fromBlockHeight uint64, toBlockHeight uint64, handle func(*blockDocuments) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := ns.workers
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan backfillJob)
+	// Results are queued in the order the jobs were dispatched. The capacity limits how far workers can run ahead.
+	results := make(chan chan []*blockDocuments, 2*workers)
+
+	// Dispatch disjoint height ranges
+	go func() {
+		defer close(jobs)
+		defer close(results)
+		for from := fromBlockHeight; from <= toBlockHeight; from += backfillChunkSize {
+			to := toBlockHeight
+			if toBlockHeight-from >= backfillChunkSize {
+				to = from + backfillChunkSize - 1
+			}
+			job := backfillJob{from: from, to: to, result: make(chan []*blockDocuments, 1)}
+			select {
+			case results <- job.result:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				return
+			}
+			if to == toBlockHeight {
+				return
+			}
+		}
+	}()
+
+	// Fetch blocks. Each worker reports its own throughput, based on the time it spent fetching
+	for i := 0; i < workers; i++ {
+		go func(worker int) {
+			var blocks int
+			var busy time.Duration
+			for job := range jobs {
+				begin := time.Now()
+				chunk := ns.fetchBlockDocuments(ctx, job.from, job.to)
+				busy += time.Since(begin)
+				blocks += len(chunk)
+				job.result <- chunk
+			}
+			if blocks > 0 {
+				ns.log.Info().Int("worker", worker).Int("blocks", blocks).Int64("perSecond", int64(float64(blocks)/busy.Seconds())).Msg("Done fetching blocks")
+			}
+		}(i)
+	}
+
+	// Hand over results in order
+	for result := range results {
+		var chunk []*blockDocuments
+		select {
+		case chunk = <-result:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		for _, docs := range chunk {
+			if err := handle(docs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fetchChunksInRange is like fetchBlocksInRange, but calls handle for chunks of up to backfillChunkSize blocks.
+// The blocks fetched before an error or cancellation are still handed over.
+func (ns *Indexer) fetchChunksInRange(ctx context.Context, fromBlockHeight uint64, toBlockHeight uint64, handle func([]*blockDocuments) error) error {
+	var chunk []*blockDocuments
+	err := ns.fetchBlocksInRange(ctx, fromBlockHeight, toBlockHeight, func(docs *blockDocuments) error {
+		chunk = append(chunk, docs)
+		if len(chunk) < backfillChunkSize {
+			return nil
+		}
+		full := chunk
+		chunk = nil
+		return handle(full)
+	})
+	if len(chunk) > 0 {
+		if handleErr := handle(chunk); err == nil {
+			err = handleErr
+		}
+	}
+	return err
+}
+
+// fetchBlockDocuments fetches and converts the blocks in [fromBlockHeight, toBlockHeight] one after another
+func (ns *Indexer) fetchBlockDocuments(ctx context.Context, fromBlockHeight uint64, toBlockHeight uint64) []*blockDocuments {
+	chunk := make([]*blockDocuments, 0, 1+toBlockHeight-fromBlockHeight)
+	for blockHeight := fromBlockHeight; blockHeight <= toBlockHeight && ctx.Err() == nil; blockHeight++ {
+		block, err := ns.getBlock(ctx, blockHeight)
+		if err != nil {
+			ns.log.Warn().Uint64("blockHeight", blockHeight).Err(err).Msg("Failed to get block")
+			if ctx.Err() == nil {
+				ns.recordFailedBlock(blockHeight, err)
+			}
+			continue
+		}
+		chunk = append(chunk, ns.convBlockDocuments(block))
+	}
+	return chunk
+}
@@ -12,8 +12,16 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+// deadLetterIndexName returns the name of the index holding documents that could not be written in bulk
+func (ns *Indexer) deadLetterIndexName() string {
+	return ns.aliasNamePrefix + "dead_letter"
+}
+
 // BulkIndexer is a utility function that uses a generator function to create ES documents and inserts them in chunks
-func BulkIndexer(ctx context.Context, logger *log.Logger, dbController db.DbController, channel chan doc.DocType, generator func() error, indexName string, typeName string, chunkSize int, upsert bool) {
+// Documents that cannot be written are moved to deadLetterIndex, if the database supports it
+// workers is the number of parallel workers feeding the generator and is reported along with the throughput
+// It returns the error of the generator or the database, which has been logged already
+func BulkIndexer(ctx context.Context, logger *log.Logger, dbController db.DbController, channel chan doc.DocType, generator func() error, indexName string, typeName string, chunkSize int, upsert bool, deadLetterIndex string, workers int) error {
 	// Setup a group of goroutines
 	g, ctx := errgroup.WithContext(ctx)
 
@@ -25,7 +33,7 @@ func BulkIndexer(ctx context.Context, logger *log.Logger, dbController db.DbCont
 
 	// Second goroutine consumes the documents sent from the first and bulk insert into ES
 	g.Go(func() error {
-		_total, err := dbController.InsertBulk(channel, db.UpdateParams{IndexName: indexName, TypeName: typeName, Size: chunkSize, Upsert: upsert})
+		_total, err := dbController.InsertBulk(ctx, channel, db.UpdateParams{IndexName: indexName, TypeName: typeName, Size: chunkSize, Upsert: upsert, DeadLetterIndex: deadLetterIndex})
 		if err != nil {
 			return err
 		}
@@ -34,12 +42,18 @@ func BulkIndexer(ctx context.Context, logger *log.Logger, dbController db.DbCont
 	})
 
 	// Wait until all goroutines are finished
-	if err := g.Wait(); err != nil {
+	err := g.Wait()
+	if err != nil {
 		logger.Warn().Err(err).Msg(fmt.Sprintf("Error bulk indexing %ss", typeName))
 	}
 
 	// Final results
 	dur := time.Since(begin).Seconds()
 	pps := int64(float64(total) / dur)
+	if workers > 1 {
+		logger.Info().Uint64("total", total).Int64("perSecond", pps).Int("workers", workers).Msg(fmt.Sprintf("Done bulk indexing %ss", typeName))
+		return err
+	}
 	logger.Info().Uint64("total", total).Int64("perSecond", pps).Msg(fmt.Sprintf("Done bulk indexing %ss", typeName))
+	return err
 }
@@ -0,0 +1,293 @@
+package indexer
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aergoio/aergo-indexer/indexer/db"
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+)
+
+// checkpointIndexName returns the name of the index holding the sync checkpoint.
+// It is not versioned like the other indices, so it survives reindexing.
+func (ns *Indexer) checkpointIndexName() string {
+	return ns.aliasNamePrefix + "checkpoint"
+}
+
+// LoadCheckpoint reads the sync checkpoint of this alias prefix, creating its index if necessary
+// It returns nil if no checkpoint has been written yet
+func (ns *Indexer) LoadCheckpoint() (*doc.EsCheckpoint, error) {
+	return ns.loadCheckpointFrom(ns.db)
+}
+
+// loadCheckpointFrom reads the sync checkpoint of this alias prefix from dbController, creating its index if necessary.
+// As the index is not versioned, it is migrated in place.
+func (ns *Indexer) loadCheckpointFrom(dbController db.DbController) (*doc.EsCheckpoint, error) {
+	checkpoint, err := dbController.SelectOne(ns.writeCtx, db.QueryParams{
+		IndexName: ns.checkpointIndexName(),
+		SortField: "ts",
+		SortAsc:   false,
+	}, func() doc.DocType {
+		checkpoint := new(doc.EsCheckpoint)
+		checkpoint.BaseEsType = new(doc.BaseEsType)
+		return checkpoint
+	})
+	if db.IsNotFound(err) {
+		if createErr := dbController.CreateIndex(ns.writeCtx, ns.checkpointIndexName(), "checkpoint"); createErr != nil {
+			return nil, createErr
+		}
+		ns.log.Info().Str("indexName", ns.checkpointIndexName()).Msg("Created index")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := dbController.MigrateIndex(ns.writeCtx, ns.checkpointIndexName(), "checkpoint"); err != nil {
+		return nil, err
+	}
+	if checkpoint == nil {
+		return nil, nil
+	}
+	return checkpoint.(*doc.EsCheckpoint), nil
+}
+
+// WriteCheckpoint persists the current sync position.
+// The checkpoint is a single document per alias prefix that is replaced as a whole.
+func (ns *Indexer) WriteCheckpoint() {
+	ns.checkpointMutex.Lock()
+	defer ns.checkpointMutex.Unlock()
+
+	checkpoint := ns.checkpointDocument(ns.getLastBlock())
+	err := ns.withDbRetry(ns.writeCtx, func() error {
+		_, err := ns.db.Insert(ns.writeCtx, checkpoint, db.UpdateParams{IndexName: ns.checkpointIndexName(), TypeName: "checkpoint", Upsert: true})
+		return err
+	})
+	if err != nil {
+		ns.log.Warn().Err(err).Uint64("blockNo", checkpoint.BlockNo).Msg("Failed to write checkpoint")
+	}
+}
+
+// checkpointDocument returns the checkpoint document for the sync position of blockHeight.
+// It does not advance past pending backfills; the committed blocks above them are recorded as completed ranges.
+func (ns *Indexer) checkpointDocument(blockHeight uint64, blockHash string) doc.EsCheckpoint {
+	contiguous, completed := ns.getSyncedRanges(blockHeight)
+	blockNo, hash := ns.getBlockHashAt(contiguous, blockHeight, blockHash)
+	return doc.EsCheckpoint{
+		BaseEsType:    &doc.BaseEsType{ns.aliasNamePrefix},
+		Timestamp:     time.Now().UTC(),
+		BlockNo:       blockNo,
+		BlockHash:     hash,
+		IndexPrefix:   ns.indexNamePrefix,
+		Reindexing:    ns.reindexing,
+		ReindexTarget: ns.reindexTarget,
+		Confirmed:     atomic.LoadUint64(&ns.confirmedHeight),
+		Completed:     formatBlockRanges(completed),
+	}
+}
+
+// RestorePosition sets the last synced block from the checkpoint, or from the best block in the db if there is no usable checkpoint.
+// Blocks that were indexed after the checkpoint was written are rolled back, as they may be incomplete, except for
+// the completed ranges recorded in the checkpoint. The gaps between them are rolled back and indexed again in the background.
+func (ns *Indexer) RestorePosition() {
+	checkpoint, err := ns.LoadCheckpoint()
+	if err != nil {
+		ns.log.Warn().Err(err).Msg("Failed to load checkpoint")
+	}
+	if checkpoint == nil || checkpoint.IndexPrefix != ns.indexNamePrefix {
+		ns.UpdateLastBlockHeightFromDb()
+		return
+	}
+	completed, err := parseBlockRanges(checkpoint.Completed)
+	if err != nil {
+		ns.log.Warn().Err(err).Str("completed", checkpoint.Completed).Msg("Ignoring invalid completed ranges of checkpoint")
+		completed = nil
+	}
+	blockHeight, blockHash := checkpoint.BlockNo, checkpoint.BlockHash
+	gaps := make([]blockRange, 0)
+	for _, completedRange := range completed {
+		if completedRange.from <= blockHeight {
+			continue
+		}
+		gapFrom := blockHeight + 1
+		if blockHeight == 0 {
+			// Like on initial sync, a checkpoint at 0 does not imply that the genesis block is committed
+			gapFrom = 0
+		}
+		if completedRange.from > gapFrom {
+			gaps = append(gaps, blockRange{from: gapFrom, to: completedRange.from - 1})
+		}
+		blockHeight = completedRange.to
+	}
+	if blockHeight != checkpoint.BlockNo {
+		if blockHash, err = ns.GetBlockHashFromDb(blockHeight); err != nil {
+			ns.log.Warn().Err(err).Uint64("blockNo", blockHeight).Msg("Failed to get hash of last completed block")
+		}
+	}
+
+	bestBlock, err := ns.GetBestBlockFromDb()
+	if err == nil && bestBlock.BlockNo > blockHeight {
+		ns.log.Info().Uint64("checkpoint", blockHeight).Uint64("bestBlock", bestBlock.BlockNo).Msg("Rolling back blocks indexed after checkpoint")
+		ns.DeleteBlocksInRange(blockHeight+1, bestBlock.BlockNo)
+	}
+	for _, gap := range gaps {
+		ns.log.Info().Uint64("from", gap.from).Uint64("to", gap.to).Msg("Rolling back incomplete blocks")
+		ns.DeleteBlocksInRange(gap.from, gap.to)
+	}
+	ns.setLastBlock(blockHeight, blockHash)
+	atomic.StoreUint64(&ns.confirmedHeight, checkpoint.Confirmed)
+	for _, gap := range gaps {
+		ns.backfillAsync(gap.from, gap.to)
+	}
+}
+
+// backfill is a range of blocks [from, to] that is indexed in the background. All blocks below next are committed
+type backfill struct {
+	from uint64
+	to   uint64
+	next uint64
+}
+
+// backfillAsync indexes blocks in the range of [fromBlockHeight, toBlockHeight] in the background.
+// The range is registered as pending first, so the checkpoint does not advance past the part that is not committed yet.
+func (ns *Indexer) backfillAsync(fromBlockHeight uint64, toBlockHeight uint64) {
+	pending := &backfill{from: fromBlockHeight, to: toBlockHeight, next: fromBlockHeight}
+	ns.lastBlockMutex.Lock()
+	ns.pendingBackfills[pending] = true
+	ns.lastBlockMutex.Unlock()
+
+	ns.backfills.Add(1)
+	go func() {
+		defer ns.backfills.Done()
+		ns.indexBlocksInRange(fromBlockHeight, toBlockHeight, func(blockHeight uint64) {
+			ns.lastBlockMutex.Lock()
+			pending.next = blockHeight + 1
+			ns.lastBlockMutex.Unlock()
+		})
+		if ns.ctx.Err() != nil {
+			// Interrupted by shutdown, keep the rest of the range pending so the checkpoint stays below it
+			return
+		}
+
+		ns.lastBlockMutex.Lock()
+		delete(ns.pendingBackfills, pending)
+		caughtUp := len(ns.pendingBackfills) == 0
+		ns.lastBlockMutex.Unlock()
+		ns.WriteCheckpoint()
+		// The range is cleared first, so a checkpoint written on completion covers it
+		if caughtUp {
+			ns.OnSyncComplete()
+		}
+	}()
+}
+
+// getContiguousBlock returns the height and hash of the last block up to which no blocks are pending
+func (ns *Indexer) getContiguousBlock() (uint64, string) {
+	blockHeight, blockHash := ns.getLastBlock()
+	return ns.getContiguousBlockFrom(blockHeight, blockHash)
+}
+
+// getContiguousBlockFrom returns the height and hash of the last block up to blockHeight for which no blocks are pending
+func (ns *Indexer) getContiguousBlockFrom(blockHeight uint64, blockHash string) (uint64, string) {
+	contiguous, _ := ns.getSyncedRanges(blockHeight)
+	return ns.getBlockHashAt(contiguous, blockHeight, blockHash)
+}
+
+// getBlockHashAt returns contiguous with the hash of its block, which is blockHash if it is blockHeight
+func (ns *Indexer) getBlockHashAt(contiguous uint64, blockHeight uint64, blockHash string) (uint64, string) {
+	if contiguous == blockHeight {
+		return blockHeight, blockHash
+	}
+	if contiguous == 0 {
+		return 0, ""
+	}
+	hash, err := ns.GetBlockHashFromDb(contiguous)
+	if err != nil {
+		ns.log.Warn().Err(err).Uint64("blockNo", contiguous).Msg("Failed to get block hash for checkpoint")
+	}
+	return contiguous, hash
+}
+
+// getSyncedRanges returns the last block up to blockHeight below which no blocks are pending,
+// and the ranges of committed blocks between it and blockHeight
+func (ns *Indexer) getSyncedRanges(blockHeight uint64) (uint64, []blockRange) {
+	ns.lastBlockMutex.RLock()
+	remaining := make([]blockRange, 0, len(ns.pendingBackfills))
+	for pending := range ns.pendingBackfills {
+		if pending.next <= pending.to {
+			remaining = append(remaining, blockRange{from: pending.next, to: pending.to})
+		}
+	}
+	ns.lastBlockMutex.RUnlock()
+	sort.Slice(remaining, func(i, j int) bool { return remaining[i].from < remaining[j].from })
+
+	contiguous := blockHeight
+	if len(remaining) > 0 && remaining[0].from <= blockHeight {
+		contiguous = 0
+		if remaining[0].from > 0 {
+			contiguous = remaining[0].from - 1
+		}
+	}
+	completed := make([]blockRange, 0)
+	next := contiguous + 1
+	for _, pending := range remaining {
+		if pending.from > blockHeight {
+			break
+		}
+		if pending.from > next {
+			completed = append(completed, blockRange{from: next, to: pending.from - 1})
+		}
+		if pending.to+1 > next {
+			next = pending.to + 1
+		}
+	}
+	if next <= blockHeight {
+		completed = append(completed, blockRange{from: next, to: blockHeight})
+	}
+	return contiguous, completed
+}
+
+// blockRange is a range of blocks [from, to]
+type blockRange struct {
+	from uint64
+	to   uint64
+}
+
+// formatBlockRanges encodes ranges like 120-150,200-230
+func formatBlockRanges(ranges []blockRange) string {
+	encoded := make([]string, len(ranges))
+	for i, r := range ranges {
+		encoded[i] = fmt.Sprintf("%d-%d", r.from, r.to)
+	}
+	return strings.Join(encoded, ",")
+}
+
+// parseBlockRanges decodes ranges encoded by formatBlockRanges
+func parseBlockRanges(encoded string) ([]blockRange, error) {
+	ranges := make([]blockRange, 0)
+	if encoded == "" {
+		return ranges, nil
+	}
+	for _, part := range strings.Split(encoded, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid block range %s", part)
+		}
+		from, err := strconv.ParseUint(bounds[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		to, err := strconv.ParseUint(bounds[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if to < from {
+			return nil, fmt.Errorf("invalid block range %s", part)
+		}
+		ranges = append(ranges, blockRange{from: from, to: to})
+	}
+	return ranges, nil
+}
@@ -14,21 +14,22 @@ type esBlockNo struct {
 
 // CheckConsistency gets all block numbers from 0 to ns.lastBlockHeight in order and checks for "holes"
 func (ns *Indexer) CheckConsistency() {
-	count, err := ns.db.Count(db.QueryParams{IndexName: ns.indexNamePrefix + "block"})
+	lastBlockHeight, _ := ns.getLastBlock()
+	count, err := ns.db.Count(ns.ctx, db.QueryParams{IndexName: ns.indexNamePrefix + "block"})
 	if err != nil {
 		ns.log.Warn().Err(err).Msg("Failed to query block count")
 		return
 	}
-	if uint64(count) >= ns.lastBlockHeight+1 {
-		ns.log.Info().Int64("total indexed", count).Uint64("expected", ns.lastBlockHeight+1).Msg("Skipping consistency check")
+	if uint64(count) >= lastBlockHeight+1 {
+		ns.log.Info().Int64("total indexed", count).Uint64("expected", lastBlockHeight+1).Msg("Skipping consistency check")
 		return
 	}
-	ns.log.Info().Int64("total indexed", count).Uint64("expected", ns.lastBlockHeight+1).Msg("Checking consistency")
+	ns.log.Info().Int64("total indexed", count).Uint64("expected", lastBlockHeight+1).Msg("Checking consistency")
 
 	prevBlockNo := uint64(0)
 	missingBlocks := uint64(0)
 
-	scroll := ns.db.Scroll(db.QueryParams{
+	scroll := ns.db.Scroll(ns.ctx, db.QueryParams{
 		IndexName:    ns.indexNamePrefix + "block",
 		TypeName:     "block",
 		SelectFields: []string{"no"},
@@ -43,7 +44,7 @@ func (ns *Indexer) CheckConsistency() {
 
 	var checked int
 
-	for {
+	for ns.ctx.Err() == nil {
 		block, err := scroll.Next()
 		if err == io.EOF {
 			break
@@ -29,6 +29,7 @@ func (ns *Indexer) ConvBlock(block *types.Block) doc.EsBlock {
 		Size:          int64(proto.Size(block)),
 		RewardAccount: ns.encodeAndResolveAccount(block.Header.Consensus, block.Header.BlockNo),
 		RewardAmount:  rewardAmount,
+		Confirmed:     ns.isConfirmed(block.Header.BlockNo),
 	}
 }
 
@@ -66,7 +67,7 @@ func (ns *Indexer) encodeAndResolveAccount(account []byte, blockNo uint64) strin
 		BlockNo: blockNo,
 	}
 	ctx := context.Background()
-	nameInfo, err := ns.grpcClient.GetNameInfo(ctx, nameRequest)
+	nameInfo, err := ns.client().GetNameInfo(ctx, nameRequest)
 	if err != nil {
 		return "UNRESOLVED: " + encoded
 	}
@@ -99,6 +100,7 @@ func (ns *Indexer) ConvTx(tx *types.Tx, blockNo uint64) doc.EsTx {
 		AmountFloat: bigIntToFloat(amount, 18),
 		Type:        fmt.Sprintf("%d", tx.Body.Type),
 		Category:    category.DetectTxCategory(tx),
+		Confirmed:   ns.isConfirmed(blockNo),
 	}
 	return doc
 }
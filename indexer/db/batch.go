@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+)
+
+const (
+	// batchRetries is the number of times a batch is retried after a transient error like a deadlock
+	batchRetries = 5
+	// batchRetryDelay is the delay before the first retry of a batch, doubled with every retry
+	batchRetryDelay = 100 * time.Millisecond
+)
+
+// BatchItem contains documents to be written to one index as part of a batch
+type BatchItem struct {
+	Params    UpdateParams
+	Documents []doc.DocType
+	// FailOnConflict makes the batch fail if a document already exists, instead of skipping it
+	FailOnConflict bool
+}
+
+// BatchWriter is implemented by controllers that can write documents to several indices in a single transaction.
+// Either all documents of a batch are committed, or none of them.
+type BatchWriter interface {
+	WriteBatch(ctx context.Context, batch []BatchItem) error
+}
+
+// WriteBatch writes a batch using dbController's WriteBatch if it is a BatchWriter.
+// Otherwise, the items are written one after another without a transaction.
+func WriteBatch(ctx context.Context, dbController DbController, batch []BatchItem) error {
+	if writer, ok := dbController.(BatchWriter); ok {
+		return writer.WriteBatch(ctx, batch)
+	}
+	for _, item := range batch {
+		if len(item.Documents) == 0 {
+			continue
+		}
+		if item.FailOnConflict {
+			for _, document := range item.Documents {
+				if _, err := dbController.Insert(ctx, document, item.Params); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		channel := make(chan doc.DocType, len(item.Documents))
+		for _, document := range item.Documents {
+			channel <- document
+		}
+		close(channel)
+		params := item.Params
+		if params.Size <= 0 {
+			params.Size = len(item.Documents)
+		}
+		if _, err := dbController.InsertBulk(ctx, channel, params); err != nil && !IsConflict(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryTransient calls write until it succeeds, fails with an error that is not transient, or runs out of retries.
+// Errors of write are classified using wrap.
+func retryTransient(ctx context.Context, wrap func(error) error, write func() error) error {
+	delay := batchRetryDelay
+	for retry := 0; ; retry++ {
+		err := wrap(write())
+		if err == nil || retry >= batchRetries || !IsTransient(err) {
+			return err
+		}
+		logger.Warn().Err(err).Int("retry", retry+1).Msg("Retrying batch after transient error")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return wrap(ctx.Err())
+		}
+		delay *= 2
+	}
+}
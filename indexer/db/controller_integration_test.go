@@ -0,0 +1,44 @@
+//go:build integration
+// +build integration
+
+package db
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// Run with: go test -tags integration ./indexer/db/
+// The databases are given by INDEXER_TEST_POSTGRES_URL and INDEXER_TEST_MARIADB_URL. Tables are created with a new prefix for every run.
+
+func integrationPrefix() string {
+	return fmt.Sprintf("test%d_", time.Now().UnixNano())
+}
+
+func TestPostgresDbController(t *testing.T) {
+	dbURL := os.Getenv("INDEXER_TEST_POSTGRES_URL")
+	if dbURL == "" {
+		t.Skip("INDEXER_TEST_POSTGRES_URL is not set")
+	}
+	controller, err := NewPostgresDbController(dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer controller.Client.Close()
+	testDbController(t, controller, integrationPrefix())
+}
+
+func TestMariaDbController(t *testing.T) {
+	dbURL := os.Getenv("INDEXER_TEST_MARIADB_URL")
+	if dbURL == "" {
+		t.Skip("INDEXER_TEST_MARIADB_URL is not set")
+	}
+	controller, err := NewMariaDbController(dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer controller.Client.Close()
+	testDbController(t, controller, integrationPrefix())
+}
@@ -0,0 +1,294 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+)
+
+// testBlock returns a block document with the given id and number
+func testBlock(id string, blockNo uint64, rewardAccount string) *doc.EsBlock {
+	return &doc.EsBlock{
+		BaseEsType:    &doc.BaseEsType{Id: id},
+		Timestamp:     time.Unix(1500000000+int64(blockNo), 0).UTC(),
+		BlockNo:       blockNo,
+		RewardAccount: rewardAccount,
+		RewardAmount:  "0",
+	}
+}
+
+func createTestBlock() doc.DocType {
+	block := new(doc.EsBlock)
+	block.BaseEsType = new(doc.BaseEsType)
+	return block
+}
+
+// createTestIndex creates a block index named prefix+"block" and inserts blocks 1 to count
+func createTestIndex(t *testing.T, controller DbController, prefix string, count uint64) string {
+	ctx := context.Background()
+	indexName := prefix + "block"
+	if err := controller.CreateIndex(ctx, indexName, "block"); err != nil {
+		t.Fatalf("CreateIndex(%s): %v", indexName, err)
+	}
+	for blockNo := uint64(1); blockNo <= count; blockNo++ {
+		rewardAccount := "even"
+		if blockNo%2 == 1 {
+			rewardAccount = "odd"
+		}
+		block := testBlock(fmt.Sprintf("%s%d", prefix, blockNo), blockNo, rewardAccount)
+		if _, err := controller.Insert(ctx, block, UpdateParams{IndexName: indexName, TypeName: "block"}); err != nil {
+			t.Fatalf("Insert(%d): %v", blockNo, err)
+		}
+	}
+	return indexName
+}
+
+// scrollBlockNumbers returns the numbers of all blocks returned by a scroll until io.EOF
+func scrollBlockNumbers(t *testing.T, scroll ScrollInstance) []uint64 {
+	blockNumbers := make([]uint64, 0)
+	for {
+		document, err := scroll.Next()
+		if err == io.EOF {
+			return blockNumbers
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		blockNumbers = append(blockNumbers, document.(*doc.EsBlock).BlockNo)
+	}
+}
+
+func equalBlockNumbers(a []uint64, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// testDbController runs the behavior all DbControllers have to agree on.
+// Every subtest uses its own indices below prefix, so a database can be shared with other runs.
+func testDbController(t *testing.T, controller DbController, prefix string) {
+	ctx := context.Background()
+
+	t.Run("InsertConflict", func(t *testing.T) {
+		indexName := createTestIndex(t, controller, prefix+"conflict_", 0)
+		params := UpdateParams{IndexName: indexName, TypeName: "block"}
+		if _, err := controller.Insert(ctx, testBlock("x", 1, "first"), params); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+		_, err := controller.Insert(ctx, testBlock("x", 1, "second"), params)
+		if !IsConflict(err) {
+			t.Fatalf("expected conflict inserting an existing id, got %v", err)
+		}
+
+		params.Upsert = true
+		if _, err := controller.Insert(ctx, testBlock("x", 2, "third"), params); err != nil {
+			t.Fatalf("Upsert: %v", err)
+		}
+		document, err := controller.SelectOne(ctx, QueryParams{IndexName: indexName, SortField: "no"}, createTestBlock)
+		if err != nil {
+			t.Fatalf("SelectOne: %v", err)
+		}
+		block := document.(*doc.EsBlock)
+		if block.GetID() != "x" || block.BlockNo != 2 || block.RewardAccount != "third" {
+			t.Fatalf("expected upsert to replace the document, got %+v", block)
+		}
+		count, err := controller.Count(ctx, QueryParams{IndexName: indexName})
+		if err != nil || count != 1 {
+			t.Fatalf("expected 1 document, got %d (%v)", count, err)
+		}
+	})
+
+	t.Run("InsertBulk", func(t *testing.T) {
+		indexName := createTestIndex(t, controller, prefix+"bulk_", 0)
+		documents := make(chan doc.DocType, 10)
+		for blockNo := uint64(1); blockNo <= 10; blockNo++ {
+			documents <- testBlock(fmt.Sprintf("bulk%d", blockNo), blockNo, "bulk")
+		}
+		close(documents)
+		inserted, err := controller.InsertBulk(ctx, documents, UpdateParams{IndexName: indexName, TypeName: "block", Size: 3})
+		if err != nil || inserted != 10 {
+			t.Fatalf("expected 10 inserted documents, got %d (%v)", inserted, err)
+		}
+		count, err := controller.Count(ctx, QueryParams{IndexName: indexName})
+		if err != nil || count != 10 {
+			t.Fatalf("expected 10 documents, got %d (%v)", count, err)
+		}
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		indexName := createTestIndex(t, controller, prefix+"filter_", 10)
+		cases := []struct {
+			name   string
+			params QueryParams
+			want   []uint64
+		}{
+			{"IntegerRange", QueryParams{IntegerRange: &IntegerRangeQuery{Field: "no", Min: 3, Max: 5}}, []uint64{3, 4, 5}},
+			{"StringMatch", QueryParams{StringMatch: &StringMatchQuery{Field: "reward_account", Value: "even"}}, []uint64{2, 4, 6, 8, 10}},
+			{"Combined", QueryParams{
+				IntegerRange: &IntegerRangeQuery{Field: "no", Min: 3, Max: 7},
+				StringMatch:  &StringMatchQuery{Field: "reward_account", Value: "odd"},
+			}, []uint64{3, 5, 7}},
+			{"Term", QueryParams{Filter: Term("no", uint64(4))}, []uint64{4}},
+			{"Terms", QueryParams{Filter: Terms("no", uint64(2), uint64(9), uint64(11))}, []uint64{2, 9}},
+			{"OpenRange", QueryParams{Filter: Range("no", uint64(8), nil)}, []uint64{8, 9, 10}},
+			{"Not", QueryParams{Filter: Not(Range("no", uint64(2), uint64(9)))}, []uint64{1, 10}},
+			{"Or", QueryParams{Filter: Or(Term("no", uint64(1)), Term("reward_account", "even"))}, []uint64{1, 2, 4, 6, 8, 10}},
+			{"And", QueryParams{Filter: And(Range("no", nil, uint64(5)), Term("reward_account", "odd"))}, []uint64{1, 3, 5}},
+		}
+		for _, c := range cases {
+			c.params.IndexName = indexName
+			c.params.SortField = "no"
+			c.params.SortAsc = true
+			if got := scrollBlockNumbers(t, controller.Scroll(ctx, c.params, createTestBlock)); !equalBlockNumbers(got, c.want) {
+				t.Errorf("%s: expected blocks %v, got %v", c.name, c.want, got)
+			}
+			if count, err := controller.Count(ctx, c.params); err != nil || count != int64(len(c.want)) {
+				t.Errorf("%s: expected count %d, got %d (%v)", c.name, len(c.want), count, err)
+			}
+		}
+
+		document, err := controller.SelectOne(ctx, QueryParams{IndexName: indexName, SortField: "no", SortAsc: false, StringMatch: &StringMatchQuery{Field: "reward_account", Value: "odd"}}, createTestBlock)
+		if err != nil || document == nil || document.(*doc.EsBlock).BlockNo != 9 {
+			t.Errorf("expected highest odd block 9, got %v (%v)", document, err)
+		}
+		document, err = controller.SelectOne(ctx, QueryParams{IndexName: indexName, SortField: "no", IntegerRange: &IntegerRangeQuery{Field: "no", Min: 20, Max: 30}}, createTestBlock)
+		if err != nil || document != nil {
+			t.Errorf("expected no document, got %v (%v)", document, err)
+		}
+	})
+
+	t.Run("UpdateAndDelete", func(t *testing.T) {
+		indexName := createTestIndex(t, controller, prefix+"delete_", 10)
+		updated, err := controller.UpdateField(ctx, QueryParams{IndexName: indexName, IntegerRange: &IntegerRangeQuery{Field: "no", Min: 1, Max: 4}}, "confirmed", true)
+		if err != nil || updated != 4 {
+			t.Fatalf("expected 4 updated documents, got %d (%v)", updated, err)
+		}
+		updated, err = controller.UpdateField(ctx, QueryParams{IndexName: indexName, IntegerRange: &IntegerRangeQuery{Field: "no", Min: 1, Max: 6}}, "confirmed", true)
+		if err != nil || updated != 2 {
+			t.Fatalf("expected only the 2 documents without the value to be updated, got %d (%v)", updated, err)
+		}
+
+		deleted, err := controller.Delete(ctx, QueryParams{IndexName: indexName, TypeName: "block", IntegerRange: &IntegerRangeQuery{Field: "no", Min: 5, Max: 10}, StringMatch: &StringMatchQuery{Field: "reward_account", Value: "even"}})
+		if err != nil || deleted != 3 {
+			t.Fatalf("expected 3 deleted documents, got %d (%v)", deleted, err)
+		}
+		got := scrollBlockNumbers(t, controller.Scroll(ctx, QueryParams{IndexName: indexName, SortField: "no", SortAsc: true, Filter: Term("confirmed", true)}, createTestBlock))
+		if want := []uint64{1, 2, 3, 4, 5}; !equalBlockNumbers(got, want) {
+			t.Fatalf("expected confirmed blocks %v, got %v", want, got)
+		}
+	})
+
+	t.Run("ScrollEOF", func(t *testing.T) {
+		indexName := createTestIndex(t, controller, prefix+"scroll_", 7)
+		// Pages smaller than the result make SQL databases query several pages
+		scroll := controller.Scroll(ctx, QueryParams{IndexName: indexName, SortField: "no", SortAsc: false, Size: 2}, createTestBlock)
+		if got, want := scrollBlockNumbers(t, scroll), []uint64{7, 6, 5, 4, 3, 2, 1}; !equalBlockNumbers(got, want) {
+			t.Fatalf("expected blocks %v, got %v", want, got)
+		}
+		if _, err := scroll.Next(); err != io.EOF {
+			t.Fatalf("expected io.EOF after the end of a scroll, got %v", err)
+		}
+
+		empty := controller.Scroll(ctx, QueryParams{IndexName: indexName, SortField: "no", Size: 2, IntegerRange: &IntegerRangeQuery{Field: "no", Min: 100, Max: 200}}, createTestBlock)
+		if _, err := empty.Next(); err != io.EOF {
+			t.Fatalf("expected io.EOF for an empty scroll, got %v", err)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, err := controller.Count(ctx, QueryParams{IndexName: prefix + "missing_block"})
+		if !IsNotFound(err) {
+			t.Fatalf("expected not found for a missing index, got %v", err)
+		}
+	})
+
+	t.Run("UpdateAliases", func(t *testing.T) {
+		aliasName := prefix + "alias_block"
+		if exists, _, err := controller.GetExistingIndexPrefix(ctx, aliasName, "block"); err != nil || exists {
+			t.Fatalf("expected no index behind a new alias, got %v (%v)", exists, err)
+		}
+
+		firstPrefix, secondPrefix := prefix+"gen1_", prefix+"gen2_"
+		firstIndex := createTestIndex(t, controller, firstPrefix, 2)
+		secondIndex := createTestIndex(t, controller, secondPrefix, 5)
+		for _, generation := range []struct {
+			prefix    string
+			indexName string
+			count     int64
+		}{{firstPrefix, firstIndex, 2}, {secondPrefix, secondIndex, 5}} {
+			if err := controller.UpdateAliases(ctx, map[string]string{aliasName: generation.indexName}); err != nil {
+				t.Fatalf("UpdateAliases(%s): %v", generation.indexName, err)
+			}
+			exists, indexPrefix, err := controller.GetExistingIndexPrefix(ctx, aliasName, "block")
+			if err != nil || !exists || indexPrefix != generation.prefix {
+				t.Fatalf("expected alias to point to prefix %s, got %v %s (%v)", generation.prefix, exists, indexPrefix, err)
+			}
+			count, err := controller.Count(ctx, QueryParams{IndexName: aliasName})
+			if err != nil || count != generation.count {
+				t.Fatalf("expected %d documents behind alias, got %d (%v)", generation.count, count, err)
+			}
+		}
+	})
+}
+
+func TestMemoryDbController(t *testing.T) {
+	testDbController(t, NewMemoryDbController(), "test_")
+}
+
+func TestSQLiteDbController(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indexer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	controller, err := NewSQLiteDbController(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer controller.Client.Close()
+	testDbController(t, controller, "test_")
+}
+
+func TestSQLiteDbControllerDropsStaleGenerations(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "indexer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	controller, err := NewSQLiteDbController(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer controller.Client.Close()
+
+	indexNames := make([]string, 0)
+	for generation := 1; generation <= 3; generation++ {
+		indexName := createTestIndex(t, controller, fmt.Sprintf("gen%d_", generation), 1)
+		if err := controller.UpdateAliases(ctx, map[string]string{"alias_block": indexName}); err != nil {
+			t.Fatalf("UpdateAliases(%s): %v", indexName, err)
+		}
+		indexNames = append(indexNames, indexName)
+	}
+	if _, err := controller.Count(ctx, QueryParams{IndexName: indexNames[0]}); !IsNotFound(err) {
+		t.Fatalf("expected the oldest table to be dropped, got %v", err)
+	}
+	for _, indexName := range indexNames[1:] {
+		if count, err := controller.Count(ctx, QueryParams{IndexName: indexName}); err != nil || count != 1 {
+			t.Fatalf("expected %s to be kept, got %d (%v)", indexName, count, err)
+		}
+	}
+}
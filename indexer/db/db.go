@@ -1,7 +1,9 @@
 package db
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	doc "github.com/aergoio/aergo-indexer/indexer/documents"
 	"github.com/aergoio/aergo-lib/log"
@@ -16,6 +18,8 @@ type UpdateParams struct {
 	TypeName  string
 	Upsert    bool
 	Size      int
+	// DeadLetterIndex receives documents that permanently failed to be written in bulk, if the database supports it
+	DeadLetterIndex string
 }
 
 type QueryParams struct {
@@ -28,6 +32,7 @@ type QueryParams struct {
 	SelectFields []string
 	IntegerRange *IntegerRangeQuery
 	StringMatch  *StringMatchQuery
+	Filter       Filter
 }
 
 type IntegerRangeQuery struct {
@@ -41,21 +46,52 @@ type StringMatchQuery struct {
 	Value string
 }
 
+// DbController is implemented by all databases. Errors of the database driver are returned as *Error,
+// classified as conflict, not found, transient or permanent, so callers can decide whether to retry regardless of the database.
 type DbController interface {
-	Insert(document doc.DocType, params UpdateParams) (uint64, error)
-	InsertBulk(documentChannel chan doc.DocType, params UpdateParams) (uint64, error)
-	Delete(params QueryParams) (uint64, error)
-	Count(params QueryParams) (int64, error)
-	SelectOne(params QueryParams, createDocument CreateDocFunction) (doc.DocType, error)
-	Scroll(params QueryParams, createDocument CreateDocFunction) ScrollInstance
-	GetExistingIndexPrefix(aliasName string, documentType string) (bool, string, error)
-	CreateIndex(indexName string, documentType string) error
-	UpdateAlias(aliasName string, indexName string) error
-	IsConflict(err interface{}) bool
+	Insert(ctx context.Context, document doc.DocType, params UpdateParams) (uint64, error)
+	InsertBulk(ctx context.Context, documentChannel chan doc.DocType, params UpdateParams) (uint64, error)
+	Delete(ctx context.Context, params QueryParams) (uint64, error)
+	UpdateField(ctx context.Context, params QueryParams, field string, value interface{}) (uint64, error)
+	Count(ctx context.Context, params QueryParams) (int64, error)
+	SelectOne(ctx context.Context, params QueryParams, createDocument CreateDocFunction) (doc.DocType, error)
+	// Scroll creates a scroll instance whose queries use ctx
+	Scroll(ctx context.Context, params QueryParams, createDocument CreateDocFunction) ScrollInstance
+	GetExistingIndexPrefix(ctx context.Context, aliasName string, documentType string) (bool, string, error)
+	CreateIndex(ctx context.Context, indexName string, documentType string) error
+	UpdateAlias(ctx context.Context, aliasName string, indexName string) error
+	UpdateAliases(ctx context.Context, aliases map[string]string) error
+	// MigrateIndex adds new fields of documentType's schema to an existing index and records its schema version.
+	// It returns a *SchemaReindexError if the index can only be brought up to date by a full reindex.
+	MigrateIndex(ctx context.Context, indexName string, documentType string) error
 }
 
 type CreateDocFunction = func() doc.DocType
 
+// Locker is a distributed lock that prevents several instances from writing to the same data set at once
+type Locker interface {
+	// Acquire takes the lock for ttl, or fails if another instance holds it
+	Acquire(ctx context.Context, ttl time.Duration) error
+	// KeepAlive extends the lock every interval in the background until it is released
+	KeepAlive(ctx context.Context, interval time.Duration)
+	// Release gives up the lock, failing if it was not held
+	Release() error
+	IsAcquired() bool
+	// Owner is the unique name of this instance
+	Owner() string
+}
+
+// LockProvider is implemented by DbControllers that can coordinate several instances using a lock stored in the database
+type LockProvider interface {
+	NewLock(name string) Locker
+}
+
+// Partitionable is implemented by DbControllers that can split the indices of PartitionedTypes into partitions.
+// Queries with the TypeName of a partitioned type cover all partitions of the index.
+type Partitionable interface {
+	SetPartitioning(partitioning *Partitioning) error
+}
+
 type ScrollInstance interface {
 	/*
 		params QueryParams
@@ -64,10 +100,12 @@ type ScrollInstance interface {
 	Next() (doc.DocType, error)
 }
 
-type IndexConflictError struct {
-	WrappedError error
+// SchemaReindexError is returned when an index cannot be migrated to the schema of the running indexer
+type SchemaReindexError struct {
+	IndexName string
+	Reason    string
 }
 
-func (i *IndexConflictError) Error() string {
-	return fmt.Sprintf("conflict: %s", i.WrappedError.Error())
+func (e *SchemaReindexError) Error() string {
+	return fmt.Sprintf("index %s requires a full reindex (--reindex): %s", e.IndexName, e.Reason)
 }
@@ -8,7 +8,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -16,9 +18,26 @@ import (
 	"github.com/olivere/elastic"
 )
 
+const (
+	// typelessDocType is the type name of documents in indices without mapping types
+	typelessDocType = "_doc"
+	// bulkRetries is the number of times bulk items rejected by an overloaded cluster are retried
+	bulkRetries = 5
+	// bulkRetryDelay is the delay before the first retry of a bulk. It doubles with every further retry
+	bulkRetryDelay = 500 * time.Millisecond
+	// maxBulkRetryDelay is the maximum delay between two retries of a bulk
+	maxBulkRetryDelay = 30 * time.Second
+)
+
 // ElasticsearchDbController implements DbController
 type ElasticsearchDbController struct {
 	Client *elastic.Client
+	// Typeless is set for clusters without mapping types, i.e. Elasticsearch 7+ and OpenSearch
+	Typeless bool
+
+	partitioning   *Partitioning
+	partitions     map[string]bool // partitions known to exist
+	partitionMutex sync.Mutex
 }
 
 // NewElasticClient creates a new instance of elastic.Client
@@ -49,11 +68,50 @@ func NewElasticsearchDbController(esURL string) (*ElasticsearchDbController, err
 	if err != nil {
 		return nil, err
 	}
+	version, typeless, err := detectTypeless(client)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info().Str("version", version).Bool("typeless", typeless).Msg("Connected to Elasticsearch")
 	return &ElasticsearchDbController{
-		Client: client,
+		Client:   client,
+		Typeless: typeless,
 	}, nil
 }
 
+// detectTypeless queries the cluster version and returns whether it requires typeless mappings and APIs
+func detectTypeless(client *elastic.Client) (string, bool, error) {
+	res, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{Method: "GET", Path: "/"})
+	if err != nil {
+		return "", false, err
+	}
+	var info struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if err := json.Unmarshal(res.Body, &info); err != nil {
+		return "", false, err
+	}
+	if info.Version.Distribution == "opensearch" {
+		return "opensearch " + info.Version.Number, true, nil
+	}
+	major, err := strconv.Atoi(strings.SplitN(info.Version.Number, ".", 2)[0])
+	if err != nil {
+		return "", false, fmt.Errorf("could not parse version %s", info.Version.Number)
+	}
+	return info.Version.Number, major >= 7, nil
+}
+
+// docType returns the type name to use in APIs that still require one
+func (esdb *ElasticsearchDbController) docType(typeName string) string {
+	if esdb.Typeless {
+		return typelessDocType
+	}
+	return typeName
+}
+
 func getFirstError(res *elastic.BulkResponse) error {
 	if res.Errors {
 		for _, v := range res.Items {
@@ -68,51 +126,216 @@ func getFirstError(res *elastic.BulkResponse) error {
 	return nil
 }
 
-// IsConflict returns if error is due to a conflict
-func (esdb *ElasticsearchDbController) IsConflict(err interface{}) bool {
-	return elastic.IsConflict(err)
+// esErrorKind classifies errors of the Elasticsearch client
+func esErrorKind(err error) ErrorKind {
+	switch {
+	case elastic.IsConflict(err), isIndexExists(err):
+		return KindConflict
+	case elastic.IsNotFound(err):
+		return KindNotFound
+	case isRetryableBulkError(err), elastic.IsStatusCode(err, http.StatusBadGateway), elastic.IsStatusCode(err, http.StatusGatewayTimeout):
+		return KindTransient
+	}
+	return KindPermanent
+}
+
+// wrapError classifies an error of the Elasticsearch client
+func (esdb *ElasticsearchDbController) wrapError(err error) error {
+	return wrapError(err, esErrorKind)
 }
 
 // Insert inserts a single document using the updata params
+// With params.Upsert, an existing document with the same id is replaced
 // It returns the number of inserted documents (1) or an error
-func (esdb *ElasticsearchDbController) Insert(document doc.DocType, params UpdateParams) (uint64, error) {
-	ctx := context.Background()
-	_, err := esdb.Client.Index().Index(params.IndexName).Type(params.TypeName).OpType("create").Id(document.GetID()).BodyJson(document).Do(ctx)
+func (esdb *ElasticsearchDbController) Insert(ctx context.Context, document doc.DocType, params UpdateParams) (uint64, error) {
+	indexName, err := esdb.documentIndex(ctx, document, params)
 	if err != nil {
-		return 0, err
+		return 0, esdb.wrapError(err)
+	}
+	svc := esdb.Client.Index().Index(indexName).Type(esdb.docType(params.TypeName)).Id(document.GetID()).BodyJson(document)
+	if !params.Upsert {
+		svc = svc.OpType("create")
+	}
+	_, err = svc.Do(ctx)
+	if err != nil {
+		return 0, esdb.wrapError(err)
 	}
 	return 1, nil
 }
 
+// bulkFailure is a document that could not be written in bulk, with the reason
+type bulkFailure struct {
+	document doc.DocType
+	err      string
+}
+
+// isRetryableBulkError returns whether a bulk request failed because the cluster is overloaded or unreachable
+func isRetryableBulkError(err error) bool {
+	return elastic.IsConnErr(err) || elastic.IsTimeout(err) ||
+		elastic.IsStatusCode(err, http.StatusTooManyRequests) || elastic.IsStatusCode(err, http.StatusServiceUnavailable)
+}
+
+// isRetryableBulkItem returns whether a bulk item was rejected temporarily
+func isRetryableBulkItem(item *elastic.BulkResponseItem) bool {
+	return item.Status == http.StatusTooManyRequests || item.Status == http.StatusServiceUnavailable ||
+		(item.Error != nil && item.Error.Type == "es_rejected_execution_exception")
+}
+
+// isExistingBulkItem returns whether a create failed because the document is already indexed
+func isExistingBulkItem(action string, item *elastic.BulkResponseItem) bool {
+	return action == "create" && item.Status == http.StatusConflict && item.Error != nil && item.Error.Type == "version_conflict_engine_exception"
+}
+
+// bulkItemError describes the error of a failed bulk item
+func bulkItemError(action string, item *elastic.BulkResponseItem) string {
+	resJSON, _ := json.Marshal(item.Error)
+	return fmt.Sprintf("%s %s (%s): %s", action, item.Type, item.Id, string(resJSON))
+}
+
+// bulkRequest creates the bulk request writing a document to indexName
+func bulkRequest(indexName string, document doc.DocType, upsert bool) elastic.BulkableRequest {
+	if upsert {
+		return elastic.NewBulkUpdateRequest().Index(indexName).Id(document.GetID()).Doc(document).DocAsUpsert(true)
+	}
+	return elastic.NewBulkIndexRequest().Index(indexName).OpType("create").Id(document.GetID()).Doc(document)
+}
+
+// commitBulk writes documents in one bulk request. Items rejected by an overloaded cluster are retried with backoff,
+// and documents that are already indexed count as written.
+// It returns the number of written documents and the documents that failed permanently.
+func (esdb *ElasticsearchDbController) commitBulk(ctx context.Context, documents []doc.DocType, params UpdateParams) (uint64, []bulkFailure, error) {
+	var written uint64
+	var failures []bulkFailure
+	delay := bulkRetryDelay
+	for retry := 0; len(documents) > 0; retry++ {
+		bulk := esdb.Client.Bulk().Index(params.IndexName)
+		if !esdb.Typeless {
+			bulk = bulk.Type(params.TypeName)
+		}
+		for _, document := range documents {
+			indexName, err := esdb.documentIndex(ctx, document, params)
+			if err != nil {
+				return written, failures, err
+			}
+			bulk.Add(bulkRequest(indexName, document, params.Upsert))
+		}
+		res, err := bulk.Do(ctx)
+		var retryable []doc.DocType
+		if err != nil {
+			if !isRetryableBulkError(err) {
+				return written, failures, err
+			}
+			retryable = documents
+		} else {
+			for i, responseItem := range res.Items {
+				if i >= len(documents) {
+					break
+				}
+				for action, item := range responseItem {
+					switch {
+					case item.Status < http.StatusMultipleChoices, isExistingBulkItem(action, item):
+						written++
+					case isRetryableBulkItem(item):
+						retryable = append(retryable, documents[i])
+					default:
+						failures = append(failures, bulkFailure{documents[i], bulkItemError(action, item)})
+					}
+				}
+			}
+		}
+		if len(retryable) == 0 {
+			break
+		}
+		if retry >= bulkRetries {
+			if err != nil {
+				return written, failures, err
+			}
+			for _, document := range retryable {
+				failures = append(failures, bulkFailure{document, fmt.Sprintf("still rejected after %d retries", bulkRetries)})
+			}
+			break
+		}
+		logger.Warn().Int("documents", len(retryable)).Str("delay", delay.String()).Str("indexName", params.IndexName).Msg("Retrying rejected bulk items")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return written, failures, ctx.Err()
+		}
+		delay *= 2
+		if delay > maxBulkRetryDelay {
+			delay = maxBulkRetryDelay
+		}
+		documents = retryable
+	}
+	return written, failures, nil
+}
+
+// writeDeadLetters stores documents that could not be written to params.IndexName in params.DeadLetterIndex, along with the errors
+func (esdb *ElasticsearchDbController) writeDeadLetters(ctx context.Context, params UpdateParams, failures []bulkFailure) error {
+	exists, err := esdb.Client.IndexExists(params.DeadLetterIndex).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		// Another instance may create it at the same time, in which case the documents are still written
+		if err := esdb.CreateIndex(ctx, params.DeadLetterIndex, "dead_letter"); err != nil {
+			logger.Warn().Err(err).Str("indexName", params.DeadLetterIndex).Msg("Failed to create dead-letter index")
+		}
+	}
+	bulk := esdb.Client.Bulk().Index(params.DeadLetterIndex)
+	if !esdb.Typeless {
+		bulk = bulk.Type("dead_letter")
+	}
+	for _, failure := range failures {
+		source, _ := json.Marshal(failure.document)
+		deadLetter := doc.EsDeadLetter{
+			BaseEsType: &doc.BaseEsType{params.IndexName + "_" + failure.document.GetID()},
+			Timestamp:  time.Now().UTC(),
+			IndexName:  params.IndexName,
+			DocumentID: failure.document.GetID(),
+			Error:      failure.err,
+			Source:     string(source),
+		}
+		bulk.Add(elastic.NewBulkIndexRequest().Id(deadLetter.Id).Doc(deadLetter))
+	}
+	res, err := bulk.Do(ctx)
+	if err == nil {
+		err = getFirstError(res)
+	}
+	return err
+}
+
 // InsertBulk inserts documents arriving in documentChannel in bulk using the updata params
+// It commits all documents until documentChannel is closed, unless ctx is cancelled
+// Documents that fail permanently are moved to params.DeadLetterIndex. Without one, the first failure is returned as error
 // It returns the number of inserted documents or an error
-func (esdb *ElasticsearchDbController) InsertBulk(documentChannel chan doc.DocType, params UpdateParams) (uint64, error) {
-	ctx := context.Background()
+func (esdb *ElasticsearchDbController) InsertBulk(ctx context.Context, documentChannel chan doc.DocType, params UpdateParams) (uint64, error) {
 	var total uint64
-	bulk := esdb.Client.Bulk().Index(params.IndexName).Type(params.TypeName)
+	var bulk []doc.DocType
 
 	begin := time.Now()
 	commitBulk := func() error {
-		res, err := bulk.Do(ctx)
+		written, failures, err := esdb.commitBulk(ctx, bulk, params)
+		bulk = nil
+		atomic.AddUint64(&total, written)
 		dur := time.Since(begin).Seconds()
 		pps := int64(float64(total) / dur)
 		logger.Info().Int("chunkSize", params.Size).Uint64("total", total).Int64("perSecond", pps).Str("indexName", params.IndexName).Msg("Comitted bulk chunk")
-		if err == nil {
-			err = getFirstError(res)
-		}
 		if err != nil {
-			return err
+			return esdb.wrapError(err)
+		}
+		if len(failures) == 0 {
+			return nil
 		}
-		return nil
+		if params.DeadLetterIndex == "" {
+			return newError(KindPermanent, errors.New(failures[0].err))
+		}
+		logger.Warn().Int("failed", len(failures)).Str("indexName", params.IndexName).Str("deadLetterIndex", params.DeadLetterIndex).Str("error", failures[0].err).Msg("Moving failed documents to dead-letter index")
+		return esdb.wrapError(esdb.writeDeadLetters(ctx, params, failures))
 	}
 	for d := range documentChannel {
-		atomic.AddUint64(&total, 1)
-		if params.Upsert {
-			bulk.Add(elastic.NewBulkUpdateRequest().Id(d.GetID()).Doc(d).DocAsUpsert(true))
-		} else {
-			bulk.Add(elastic.NewBulkIndexRequest().OpType("create").Id(d.GetID()).Doc(d))
-		}
-		if bulk.NumberOfActions() >= params.Size {
+		bulk = append(bulk, d)
+		if len(bulk) >= params.Size {
 			err := commitBulk()
 			if err != nil {
 				return total, err
@@ -122,12 +345,12 @@ func (esdb *ElasticsearchDbController) InsertBulk(documentChannel chan doc.DocTy
 		select {
 		default:
 		case <-ctx.Done():
-			return total, ctx.Err()
+			return total, esdb.wrapError(ctx.Err())
 		}
 	}
 
 	// Commit the final batch before exiting
-	if bulk.NumberOfActions() > 0 {
+	if len(bulk) > 0 {
 		err := commitBulk()
 		if err != nil {
 			return total, err
@@ -136,37 +359,95 @@ func (esdb *ElasticsearchDbController) InsertBulk(documentChannel chan doc.DocTy
 	return total, nil
 }
 
-// Delete removes documents specified by the query params
-func (esdb *ElasticsearchDbController) Delete(params QueryParams) (uint64, error) {
-	var query *elastic.RangeQuery
-	if params.IntegerRange != nil {
-		query = elastic.NewRangeQuery(params.IntegerRange.Field).From(params.IntegerRange.Min).To(params.IntegerRange.Max)
+// esField maps a document field to its Elasticsearch field. The id is not part of the source
+func esField(field string) string {
+	if field == "id" {
+		return "_id"
 	}
-	if params.StringMatch != nil {
-		return 0, errors.New("Delete is not imlemented for string matches")
+	return field
+}
+
+// filterToEsQuery translates a filter into an Elasticsearch query
+func filterToEsQuery(filter Filter) elastic.Query {
+	switch f := filter.(type) {
+	case AndFilter:
+		query := elastic.NewBoolQuery()
+		for _, filter := range f.Filters {
+			query = query.Filter(filterToEsQuery(filter))
+		}
+		return query
+	case OrFilter:
+		if len(f.Filters) == 0 {
+			return elastic.NewBoolQuery().MustNot(elastic.NewMatchAllQuery())
+		}
+		query := elastic.NewBoolQuery().MinimumShouldMatch("1")
+		for _, filter := range f.Filters {
+			query = query.Should(filterToEsQuery(filter))
+		}
+		return query
+	case NotFilter:
+		return elastic.NewBoolQuery().MustNot(filterToEsQuery(f.Filter))
+	case TermFilter:
+		if f.Value == nil {
+			return elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery(esField(f.Field)))
+		}
+		return elastic.NewTermQuery(esField(f.Field), f.Value)
+	case TermsFilter:
+		return elastic.NewTermsQuery(esField(f.Field), f.Values...)
+	case RangeFilter:
+		query := elastic.NewRangeQuery(esField(f.Field))
+		if f.Min != nil {
+			query = query.Gte(f.Min)
+		}
+		if f.Max != nil {
+			query = query.Lte(f.Max)
+		}
+		return query
 	}
+	return elastic.NewMatchAllQuery()
+}
 
-	ctx := context.Background()
-	res, err := esdb.Client.DeleteByQuery().Index(params.IndexName).Query(query).Do(ctx)
+// esQuery returns the query for the filter of the query params
+func esQuery(params QueryParams) elastic.Query {
+	return filterToEsQuery(params.filter())
+}
+
+// Delete removes documents specified by the query params
+func (esdb *ElasticsearchDbController) Delete(ctx context.Context, params QueryParams) (uint64, error) {
+	res, err := esdb.Client.DeleteByQuery().Index(esdb.queryIndices(params)...).Query(esQuery(params)).Do(ctx)
 	if err != nil {
-		return 0, err
+		return 0, esdb.wrapError(err)
 	}
 	return uint64(res.Deleted), nil
 }
 
-// Count returns the number of indexed documents
-func (esdb *ElasticsearchDbController) Count(params QueryParams) (int64, error) {
-	ctx := context.Background()
-	return esdb.Client.Count(params.IndexName).Do(ctx)
+// UpdateField sets field to value in all documents specified by the query params that don't have this value yet
+func (esdb *ElasticsearchDbController) UpdateField(ctx context.Context, params QueryParams, field string, value interface{}) (uint64, error) {
+	query := elastic.NewBoolQuery().MustNot(elastic.NewTermQuery(field, value)).Filter(esQuery(params))
+	script := elastic.NewScript("ctx._source[params.field] = params.value").Params(map[string]interface{}{"field": field, "value": value})
+
+	res, err := esdb.Client.UpdateByQuery(esdb.queryIndices(params)...).Query(query).Script(script).Do(ctx)
+	if err != nil {
+		return 0, esdb.wrapError(err)
+	}
+	return uint64(res.Updated), nil
+}
+
+// Count returns the number of documents matching the query params
+func (esdb *ElasticsearchDbController) Count(ctx context.Context, params QueryParams) (int64, error) {
+	count, err := esdb.Client.Count(esdb.queryIndices(params)...).Query(esQuery(params)).Do(ctx)
+	return count, esdb.wrapError(err)
 }
 
 // SelectOne selects a single document
-func (esdb *ElasticsearchDbController) SelectOne(params QueryParams, createDocument CreateDocFunction) (doc.DocType, error) {
-	ctx := context.Background()
-	query := elastic.NewMatchAllQuery()
-	res, err := esdb.Client.Search().Index(params.IndexName).Query(query).Sort(params.SortField, params.SortAsc).From(params.From).Size(1).Do(ctx)
+func (esdb *ElasticsearchDbController) SelectOne(ctx context.Context, params QueryParams, createDocument CreateDocFunction) (doc.DocType, error) {
+	search := esdb.Client.Search().Index(esdb.queryIndices(params)...).Query(esQuery(params)).Sort(params.SortField, params.SortAsc).From(params.From).Size(1)
+	if esdb.Typeless {
+		search = search.RestTotalHitsAsInt(true)
+	}
+	res, err := search.Do(ctx)
 	if err != nil {
-		return nil, err
+		return nil, esdb.wrapError(err)
 	}
 	if res == nil || res.TotalHits() == 0 || len(res.Hits.Hits) == 0 {
 		return nil, nil
@@ -175,77 +456,224 @@ func (esdb *ElasticsearchDbController) SelectOne(params QueryParams, createDocum
 	hit := res.Hits.Hits[0]
 	document := createDocument()
 	if err := json.Unmarshal(*hit.Source, document); err != nil {
-		return nil, err
+		return nil, esdb.wrapError(err)
 	}
 	document.SetID(hit.Id)
-	if err != nil {
-		return nil, err
-	}
 	return document, nil
 }
 
 // UpdateAlias updates an alias with a new index name and delete stale indices
-func (esdb *ElasticsearchDbController) UpdateAlias(aliasName string, indexName string) error {
-	ctx := context.Background()
+func (esdb *ElasticsearchDbController) UpdateAlias(ctx context.Context, aliasName string, indexName string) error {
+	return esdb.UpdateAliases(ctx, map[string]string{aliasName: indexName})
+}
+
+// UpdateAliases updates several aliases with new index names in one atomic request and delete stale indices
+func (esdb *ElasticsearchDbController) UpdateAliases(ctx context.Context, aliases map[string]string) error {
 	svc := esdb.Client.Alias()
 	res, err := esdb.Client.Aliases().Index("_all").Do(ctx)
 	if err != nil {
-		return err
+		return esdb.wrapError(err)
 	}
-	indices := res.IndicesByAlias(aliasName)
-	if len(indices) > 0 {
+	var oldIndices []string
+	for aliasName, indexName := range aliases {
 		// Remove old aliases
-		for _, indexName := range indices {
-			svc.Remove(indexName, aliasName)
+		for _, oldIndexName := range res.IndicesByAlias(aliasName) {
+			svc.Remove(oldIndexName, aliasName)
+			if oldIndexName != indexName && !strings.HasPrefix(oldIndexName, indexName+partitionSeparator) {
+				oldIndices = append(oldIndices, oldIndexName)
+			}
+		}
+		// Add new alias, including all partitions of the new index
+		svc.Add(indexName, aliasName)
+		if esdb.partitioning != nil {
+			partitions, err := esdb.partitionsOf(ctx, indexName)
+			if err != nil {
+				return esdb.wrapError(err)
+			}
+			for _, partitionName := range partitions {
+				svc.Add(partitionName, aliasName)
+			}
 		}
 	}
-	// Add new alias
-	svc.Add(indexName, aliasName)
 	_, err = svc.Do(ctx)
+	if err != nil {
+		return esdb.wrapError(err)
+	}
 	// Delete old indices
-	if len(indices) > 0 {
-		for _, indexName := range indices {
-			esdb.Client.DeleteIndex(indexName).Do(ctx)
-		}
+	for _, indexName := range oldIndices {
+		esdb.Client.DeleteIndex(indexName).Do(ctx)
 	}
-	return err
+	return nil
 }
 
 // GetExistingIndexPrefix checks for existing indices and returns the prefix, if any
-func (esdb *ElasticsearchDbController) GetExistingIndexPrefix(aliasName string, documentType string) (bool, string, error) {
-	ctx := context.Background()
+func (esdb *ElasticsearchDbController) GetExistingIndexPrefix(ctx context.Context, aliasName string, documentType string) (bool, string, error) {
 	res, err := esdb.Client.Aliases().Index("_all").Do(ctx)
 	if err != nil {
-		return false, "", err
+		return false, "", esdb.wrapError(err)
 	}
-	indices := res.IndicesByAlias(aliasName)
-	if len(indices) > 0 {
-		indexNamePrefix := strings.TrimRight(indices[0], documentType)
+	for _, indexName := range res.IndicesByAlias(aliasName) {
+		// Partitions share the alias of their index
+		if strings.Contains(indexName, partitionSeparator) {
+			continue
+		}
+		indexNamePrefix := strings.TrimSuffix(indexName, documentType)
 		return true, indexNamePrefix, nil
 	}
 	return false, "", nil
 }
 
+// esMappingBody returns the index body of documentType with its schema version stored in the mapping's _meta,
+// along with the mapping type name and its properties. Typeless bodies contain the mapping without the type name.
+func esMappingBody(documentType string, typeless bool) (map[string]interface{}, string, map[string]interface{}, error) {
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(doc.EsMappings[documentType]), &body); err != nil {
+		return nil, "", nil, err
+	}
+	mappings, _ := body["mappings"].(map[string]interface{})
+	for typeName, mapping := range mappings {
+		mapping, ok := mapping.(map[string]interface{})
+		if !ok {
+			break
+		}
+		mapping["_meta"] = map[string]interface{}{"schema_version": doc.SchemaVersions[documentType].Version}
+		properties, _ := mapping["properties"].(map[string]interface{})
+		if typeless {
+			body["mappings"] = mapping
+		}
+		return body, typeName, properties, nil
+	}
+	return nil, "", nil, fmt.Errorf("no mapping for document type %s", documentType)
+}
+
+// esFieldConflicts returns whether an existing field mapping is incompatible with the expected one
+func esFieldConflicts(existing interface{}, expected interface{}) bool {
+	existingMapping, _ := existing.(map[string]interface{})
+	expectedMapping, _ := expected.(map[string]interface{})
+	for _, key := range []string{"type", "enabled"} {
+		if value, ok := expectedMapping[key]; ok && fmt.Sprint(existingMapping[key]) != fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
 // CreateIndex creates index according to documentType definition
-func (esdb *ElasticsearchDbController) CreateIndex(indexName string, documentType string) error {
-	ctx := context.Background()
-	createIndex, err := esdb.Client.CreateIndex(indexName).BodyString(doc.EsMappings[documentType]).Do(ctx)
+func (esdb *ElasticsearchDbController) CreateIndex(ctx context.Context, indexName string, documentType string) error {
+	body, _, _, err := esMappingBody(documentType, esdb.Typeless)
 	if err != nil {
-		return err
+		return esdb.wrapError(err)
+	}
+	createIndex, err := esdb.Client.CreateIndex(indexName).BodyJson(body).Do(ctx)
+	if err != nil {
+		return esdb.wrapError(err)
 	}
 	if !createIndex.Acknowledged {
-		return errors.New("CreateIndex not acknowledged")
+		return newError(KindTransient, errors.New("CreateIndex not acknowledged"))
+	}
+	return nil
+}
+
+// MigrateIndex adds missing fields of documentType's mapping to an existing index and its partitions.
+// The schema version is stored in the mapping's _meta.
+// Fields whose type changed cannot be migrated, as Elasticsearch cannot change the mapping of existing fields.
+func (esdb *ElasticsearchDbController) MigrateIndex(ctx context.Context, indexName string, documentType string) error {
+	indices := []string{indexName}
+	if esdb.isPartitioned(documentType) {
+		partitions, err := esdb.partitionsOf(ctx, indexName)
+		if err != nil {
+			return esdb.wrapError(err)
+		}
+		indices = append(indices, partitions...)
+	}
+	for _, indexName := range indices {
+		if err := esdb.migrateIndex(ctx, indexName, documentType); err != nil {
+			return esdb.wrapError(err)
+		}
+	}
+	return nil
+}
+
+// migrateIndex adds missing fields of documentType's mapping to a single index
+func (esdb *ElasticsearchDbController) migrateIndex(ctx context.Context, indexName string, documentType string) error {
+	_, typeName, expected, err := esMappingBody(documentType, esdb.Typeless)
+	if err != nil {
+		return err
+	}
+	getMapping := esdb.Client.GetMapping().Index(indexName)
+	if !esdb.Typeless {
+		getMapping = getMapping.Type(typeName)
+	}
+	res, err := getMapping.Do(ctx)
+	if err != nil {
+		return err
+	}
+	index, _ := res[indexName].(map[string]interface{})
+	mapping, _ := index["mappings"].(map[string]interface{})
+	if !esdb.Typeless {
+		mapping, _ = mapping[typeName].(map[string]interface{})
+	}
+	if mapping == nil {
+		return fmt.Errorf("index %s has no mapping for type %s", indexName, typeName)
+	}
+	stored := unversionedSchema
+	if meta, ok := mapping["_meta"].(map[string]interface{}); ok {
+		if version, ok := meta["schema_version"].(float64); ok {
+			stored = int(version)
+		}
+	}
+	if err := checkSchemaVersion(indexName, documentType, stored); err != nil {
+		return err
+	}
+
+	properties, _ := mapping["properties"].(map[string]interface{})
+	added := make(map[string]interface{})
+	for field, definition := range expected {
+		existing, ok := properties[field]
+		if !ok {
+			added[field] = definition
+			continue
+		}
+		if esFieldConflicts(existing, definition) {
+			return &SchemaReindexError{IndexName: indexName, Reason: fmt.Sprintf("mapping of field %s changed", field)}
+		}
+	}
+	for field := range properties {
+		if _, ok := expected[field]; !ok {
+			logger.Warn().Str("indexName", indexName).Str("field", field).Msg("Index has a field that is not part of the mapping")
+		}
+	}
+	body := map[string]interface{}{
+		"_meta":      map[string]interface{}{"schema_version": doc.SchemaVersions[documentType].Version},
+		"properties": added,
+	}
+	if esdb.Typeless {
+		// The client's mapping API requires a type, which typeless clusters reject
+		_, err = esdb.Client.PerformRequest(ctx, elastic.PerformRequestOptions{Method: "PUT", Path: "/" + indexName + "/_mapping", Body: body})
+	} else {
+		_, err = esdb.Client.PutMapping().Index(indexName).Type(typeName).BodyJson(body).Do(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	for field := range added {
+		logger.Info().Str("indexName", indexName).Str("field", field).Msg("Added field to mapping")
 	}
 	return nil
 }
 
 // Scroll creates a new scroll instance with the specified query and unmarshal function
-func (esdb *ElasticsearchDbController) Scroll(params QueryParams, createDocument CreateDocFunction) ScrollInstance {
+func (esdb *ElasticsearchDbController) Scroll(ctx context.Context, params QueryParams, createDocument CreateDocFunction) ScrollInstance {
 	fsc := elastic.NewFetchSourceContext(true).Include(params.SelectFields...)
-	scroll := esdb.Client.Scroll(params.IndexName).Type(params.TypeName).Size(params.Size).Sort(params.SortField, params.SortAsc).FetchSourceContext(fsc)
+	scroll := esdb.Client.Scroll(esdb.queryIndices(params)...).Size(params.Size).Sort(params.SortField, params.SortAsc).FetchSourceContext(fsc).Query(esQuery(params))
+	if esdb.Typeless {
+		scroll = scroll.RestTotalHitsAsInt(true)
+	} else {
+		scroll = scroll.Type(params.TypeName)
+	}
 	return &EsScrollInstance{
 		scrollService:  scroll,
-		ctx:            context.Background(),
+		ctx:            ctx,
 		createDocument: createDocument,
 	}
 }
@@ -266,7 +694,7 @@ func (scroll *EsScrollInstance) Next() (doc.DocType, error) {
 	if scroll.result == nil || scroll.current >= scroll.currentLength {
 		result, err := scroll.scrollService.Do(scroll.ctx)
 		if err != nil {
-			return nil, err // returns io.EOF when scroll is done
+			return nil, wrapError(err, esErrorKind) // returns io.EOF when scroll is done
 		}
 		scroll.result = result
 		scroll.current = 0
@@ -280,7 +708,7 @@ func (scroll *EsScrollInstance) Next() (doc.DocType, error) {
 
 		unmarshalled := scroll.createDocument()
 		if err := json.Unmarshal(*doc.Source, unmarshalled); err != nil {
-			return nil, err
+			return nil, wrapError(err, esErrorKind)
 		}
 		unmarshalled.SetID(doc.Id)
 		return unmarshalled, nil
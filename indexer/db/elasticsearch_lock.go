@@ -0,0 +1,43 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	distributedLock "github.com/graup/es-distributed-lock"
+)
+
+// EsLock adapts the time-based lock stored in Elasticsearch to Locker
+type EsLock struct {
+	lock *distributedLock.Lock
+}
+
+// NewLock creates a lock with the given name. Instances using the same name exclude each other
+func (esdb *ElasticsearchDbController) NewLock(name string) Locker {
+	return &EsLock{distributedLock.NewLock(esdb.Client, name)}
+}
+
+// Acquire takes the lock for ttl, or fails if another instance holds it
+func (l *EsLock) Acquire(ctx context.Context, ttl time.Duration) error {
+	return l.lock.Acquire(ctx, ttl)
+}
+
+// KeepAlive extends the lock in the background until it is released
+func (l *EsLock) KeepAlive(ctx context.Context, interval time.Duration) {
+	l.lock.KeepAlive(ctx, interval)
+}
+
+// Release gives up the lock, failing if it was not held
+func (l *EsLock) Release() error {
+	return l.lock.MustRelease()
+}
+
+// IsAcquired returns whether the lock is held and has not expired
+func (l *EsLock) IsAcquired() bool {
+	return l.lock.IsAcquired()
+}
+
+// Owner returns the unique name of this lock instance
+func (l *EsLock) Owner() string {
+	return l.lock.Owner
+}
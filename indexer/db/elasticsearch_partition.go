@@ -0,0 +1,97 @@
+package db
+
+import (
+	"context"
+	"sort"
+
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+	"github.com/olivere/elastic"
+)
+
+// SetPartitioning enables writing the documents of PartitionedTypes to one index per partition.
+// Partitions are created on first use and share the aliases of the index they belong to.
+func (esdb *ElasticsearchDbController) SetPartitioning(partitioning *Partitioning) error {
+	esdb.partitioning = partitioning
+	return nil
+}
+
+// isPartitioned returns whether documents of typeName are written to partitions
+func (esdb *ElasticsearchDbController) isPartitioned(typeName string) bool {
+	return esdb.partitioning != nil && isPartitionedType(typeName)
+}
+
+// queryIndices returns the indices to query for the query params, including all partitions of partitioned types
+func (esdb *ElasticsearchDbController) queryIndices(params QueryParams) []string {
+	if esdb.isPartitioned(params.TypeName) {
+		return []string{params.IndexName, params.IndexName + partitionSeparator + "*"}
+	}
+	return []string{params.IndexName}
+}
+
+// documentIndex returns the index a document is written to, creating its partition if necessary
+func (esdb *ElasticsearchDbController) documentIndex(ctx context.Context, document doc.DocType, params UpdateParams) (string, error) {
+	partitioned, ok := document.(doc.Partitioned)
+	if !ok || !esdb.isPartitioned(params.TypeName) {
+		return params.IndexName, nil
+	}
+	partitionName := esdb.partitioning.partitionIndexName(params.IndexName, partitioned)
+	return partitionName, esdb.ensurePartition(ctx, params.IndexName, params.TypeName, partitionName)
+}
+
+// isIndexExists returns if error is due to an index that already exists
+func isIndexExists(err error) bool {
+	e, ok := err.(*elastic.Error)
+	return ok && e.Details != nil && e.Details.Type == "resource_already_exists_exception"
+}
+
+// ensurePartition creates a partition of indexName unless it exists, and adds it to the aliases of indexName
+func (esdb *ElasticsearchDbController) ensurePartition(ctx context.Context, indexName string, documentType string, partitionName string) error {
+	esdb.partitionMutex.Lock()
+	defer esdb.partitionMutex.Unlock()
+	if esdb.partitions[partitionName] {
+		return nil
+	}
+	exists, err := esdb.Client.IndexExists(partitionName).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := esdb.CreateIndex(ctx, partitionName, documentType); err != nil && !IsConflict(err) {
+			return err
+		}
+		logger.Info().Str("indexName", partitionName).Msg("Created partition")
+	}
+	// While reindexing, indexName has no aliases yet. They are added to all partitions when swapping aliases
+	res, err := esdb.Client.Aliases().Index(indexName).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if index, ok := res.Indices[indexName]; ok && len(index.Aliases) > 0 {
+		svc := esdb.Client.Alias()
+		for _, alias := range index.Aliases {
+			svc.Add(partitionName, alias.AliasName)
+		}
+		if _, err := svc.Do(ctx); err != nil {
+			return err
+		}
+	}
+	if esdb.partitions == nil {
+		esdb.partitions = make(map[string]bool)
+	}
+	esdb.partitions[partitionName] = true
+	return nil
+}
+
+// partitionsOf returns the names of all partitions of indexName
+func (esdb *ElasticsearchDbController) partitionsOf(ctx context.Context, indexName string) ([]string, error) {
+	res, err := esdb.Client.IndexGet(indexName + partitionSeparator + "*").Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	partitions := make([]string, 0, len(res))
+	for partitionName := range res {
+		partitions = append(partitions, partitionName)
+	}
+	sort.Strings(partitions)
+	return partitions, nil
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"os"
+)
+
+// ErrorKind classifies errors of DbControllers, so callers can decide how to handle them regardless of the database
+type ErrorKind int
+
+const (
+	// KindPermanent errors fail again if the operation is retried
+	KindPermanent ErrorKind = iota
+	// KindConflict errors are caused by a document or index that exists already
+	KindConflict
+	// KindNotFound errors are caused by an index or document that does not exist
+	KindNotFound
+	// KindTransient errors, like timeouts, deadlocks, overload or lost connections, may go away if the operation is retried
+	KindTransient
+)
+
+func (kind ErrorKind) String() string {
+	switch kind {
+	case KindConflict:
+		return "conflict"
+	case KindNotFound:
+		return "not found"
+	case KindTransient:
+		return "transient"
+	}
+	return "permanent"
+}
+
+// Error is returned by DbControllers, wrapping the error of the database driver with its kind
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error of the database driver
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// newError classifies err as kind
+func newError(kind ErrorKind, err error) error {
+	return &Error{Kind: kind, Err: err}
+}
+
+// wrapError wraps err of a database driver using classify to determine its kind.
+// Errors that are already classified, SchemaReindexErrors and io.EOF are returned as they are.
+func wrapError(err error, classify func(error) ErrorKind) error {
+	switch err.(type) {
+	case nil:
+		return nil
+	case *Error, *SchemaReindexError:
+		return err
+	}
+	if err == io.EOF {
+		// Marks the end of scrolls
+		return err
+	}
+	if kind, ok := contextErrorKind(err); ok {
+		return &Error{Kind: kind, Err: err}
+	}
+	return &Error{Kind: classify(err), Err: err}
+}
+
+// contextErrorKind classifies errors that are common to all databases: timeouts are transient, cancellation is permanent.
+// Network errors are only transient if they are timeouts or temporary, so e.g. a refused connection is not retried.
+// Errors wrapped by HTTP requests or by drivers are unwrapped, as errors.Is and errors.As are not available with Go 1.12
+func contextErrorKind(err error) (ErrorKind, bool) {
+	for err != nil {
+		if err == context.DeadlineExceeded {
+			return KindTransient, true
+		}
+		if err == context.Canceled {
+			return KindPermanent, true
+		}
+		if netErr, ok := err.(net.Error); ok && (netErr.Timeout() || netErr.Temporary()) {
+			return KindTransient, true
+		}
+		next := unwrapError(err)
+		if next == err {
+			break
+		}
+		err = next
+	}
+	return KindPermanent, false
+}
+
+// unwrapError returns the error wrapped by err, or nil if it does not wrap one
+func unwrapError(err error) error {
+	switch e := err.(type) {
+	case *url.Error:
+		return e.Err
+	case *net.OpError:
+		return e.Err
+	case *os.SyscallError:
+		return e.Err
+	case interface{ Unwrap() error }:
+		return e.Unwrap()
+	case interface{ Cause() error }:
+		return e.Cause()
+	}
+	return nil
+}
+
+// KindOf returns the kind of err. Unclassified errors are permanent, except for timeouts and temporary network errors
+func KindOf(err error) ErrorKind {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	kind, _ := contextErrorKind(err)
+	return kind
+}
+
+// IsConflict returns if err is due to a document or index that exists already, e.g. because it was created by another instance
+func IsConflict(err error) bool {
+	return err != nil && KindOf(err) == KindConflict
+}
+
+// IsNotFound returns if err is due to an index or document that does not exist
+func IsNotFound(err error) bool {
+	return err != nil && KindOf(err) == KindNotFound
+}
+
+// IsTransient returns if err may go away when the operation is retried
+func IsTransient(err error) bool {
+	return err != nil && KindOf(err) == KindTransient
+}
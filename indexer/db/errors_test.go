@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// testNetError is a net.Error with fixed Timeout and Temporary results
+type testNetError struct {
+	timeout   bool
+	temporary bool
+}
+
+func (e testNetError) Error() string   { return "net error" }
+func (e testNetError) Timeout() bool   { return e.timeout }
+func (e testNetError) Temporary() bool { return e.temporary }
+
+// testCauseError wraps an error like github.com/pkg/errors, which olivere/elastic uses
+type testCauseError struct {
+	cause error
+}
+
+func (e testCauseError) Error() string { return "wrapped: " + e.cause.Error() }
+func (e testCauseError) Cause() error  { return e.cause }
+
+// testUnwrapError wraps an error like errors wrapped with %w in Go 1.13 and later
+type testUnwrapError struct {
+	err error
+}
+
+func (e testUnwrapError) Error() string { return "wrapped: " + e.err.Error() }
+func (e testUnwrapError) Unwrap() error { return e.err }
+
+func TestErrorKinds(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}
+	cases := []struct {
+		name string
+		err  error
+		want ErrorKind
+	}{
+		{"DeadlineExceeded", context.DeadlineExceeded, KindTransient},
+		{"Canceled", context.Canceled, KindPermanent},
+		{"URLDeadlineExceeded", &url.Error{Op: "Post", URL: "http://localhost:9200", Err: context.DeadlineExceeded}, KindTransient},
+		{"URLCanceled", &url.Error{Op: "Post", URL: "http://localhost:9200", Err: context.Canceled}, KindPermanent},
+		{"NetTimeout", testNetError{timeout: true}, KindTransient},
+		{"NetTemporary", testNetError{temporary: true}, KindTransient},
+		{"NetOther", testNetError{}, KindNotFound},
+		{"URLNetTimeout", &url.Error{Op: "Get", URL: "http://localhost:9200", Err: &net.OpError{Op: "read", Net: "tcp", Err: testNetError{timeout: true}}}, KindTransient},
+		{"ConnectionRefused", refused, KindNotFound},
+		{"URLConnectionRefused", &url.Error{Op: "Get", URL: "http://localhost:9200", Err: refused}, KindNotFound},
+		{"CauseDeadlineExceeded", testCauseError{context.DeadlineExceeded}, KindTransient},
+		{"UnwrapNetTimeout", testUnwrapError{testNetError{timeout: true}}, KindTransient},
+		{"Classified", newError(KindConflict, errors.New("exists")), KindConflict},
+		{"Driver", errors.New("driver error"), KindNotFound},
+	}
+	// The classifier of the database decides about errors that are not common to all databases
+	classify := func(error) ErrorKind { return KindNotFound }
+	for _, c := range cases {
+		if kind := KindOf(wrapError(c.err, classify)); kind != c.want {
+			t.Errorf("%s: expected %s, got %s", c.name, c.want, kind)
+		}
+	}
+
+	if err := wrapError(io.EOF, classify); err != io.EOF {
+		t.Errorf("expected io.EOF to be returned as it is, got %v", err)
+	}
+	if wrapError(nil, classify) != nil {
+		t.Error("expected nil for nil")
+	}
+	if IsTransient(refused) || !IsTransient(&url.Error{Op: "Get", URL: "http://localhost:9200", Err: context.DeadlineExceeded}) {
+		t.Error("expected unclassified errors to be transient only if they are timeouts")
+	}
+}
@@ -0,0 +1,312 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+)
+
+// fanOutBufferSize is the number of bulk documents a secondary backend can fall behind the primary before it is marked as failed
+const fanOutBufferSize = 10000
+
+// BackendState is the state of a secondary backend of FanOutDbController
+type BackendState int
+
+const (
+	// BackendActive backends receive all writes
+	BackendActive BackendState = iota
+	// BackendCatchingUp backends receive all writes except checkpoints, while the blocks they missed are indexed
+	BackendCatchingUp
+	// BackendFailed backends receive no writes until they are caught up
+	BackendFailed
+)
+
+// FanOutBackend is one of the databases written by FanOutDbController
+type FanOutBackend struct {
+	Name       string
+	Controller DbController
+	state      BackendState
+	err        error
+}
+
+// FanOutDbController implements DbController by writing to several databases at once.
+// The first backend is the primary: it answers all queries, and its results are returned for writes.
+// Secondary backends that fail to write are marked as failed and skipped, so they don't block the others,
+// until the indexer has caught them up from their own checkpoint.
+type FanOutDbController struct {
+	backends []*FanOutBackend
+	mutex    sync.RWMutex
+}
+
+// NewFanOutDbController creates a new instance of FanOutDbController. The first backend is the primary
+func NewFanOutDbController(backends []*FanOutBackend) (*FanOutDbController, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("fan out requires at least one backend")
+	}
+	return &FanOutDbController{
+		backends: backends,
+	}, nil
+}
+
+// Primary returns the database answering all queries
+func (fdb *FanOutDbController) Primary() DbController {
+	return fdb.backends[0].Controller
+}
+
+// Close closes all backends that buffer writes and returns the first error
+func (fdb *FanOutDbController) Close() error {
+	var firstErr error
+	for _, backend := range fdb.backends {
+		if closer, ok := backend.Controller.(io.Closer); ok {
+			if err := closer.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Secondaries returns the backends besides the primary
+func (fdb *FanOutDbController) Secondaries() []*FanOutBackend {
+	return fdb.backends[1:]
+}
+
+// State returns the state of a secondary backend, and the error it failed with, if any
+func (fdb *FanOutDbController) State(backend *FanOutBackend) (BackendState, error) {
+	fdb.mutex.RLock()
+	defer fdb.mutex.RUnlock()
+	return backend.state, backend.err
+}
+
+// Fail marks a secondary backend as failed, so it receives no writes until it is caught up
+func (fdb *FanOutDbController) Fail(backend *FanOutBackend, err error) {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	if backend.state != BackendFailed {
+		logger.Warn().Err(err).Str("backend", backend.Name).Msg("Backend failed, skipping it until it is caught up")
+	}
+	backend.state = BackendFailed
+	backend.err = err
+}
+
+// BeginCatchUp lets a failed backend receive all writes except checkpoints again
+func (fdb *FanOutDbController) BeginCatchUp(backend *FanOutBackend) {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	backend.state = BackendCatchingUp
+}
+
+// EndCatchUp marks a backend as active after the blocks it missed have been indexed, unless it failed again meanwhile
+func (fdb *FanOutDbController) EndCatchUp(backend *FanOutBackend) bool {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	if backend.state != BackendCatchingUp {
+		return false
+	}
+	backend.state = BackendActive
+	backend.err = nil
+	return true
+}
+
+// receives returns whether a backend receives writes of typeName
+func (fdb *FanOutDbController) receives(backend *FanOutBackend, typeName string) bool {
+	fdb.mutex.RLock()
+	defer fdb.mutex.RUnlock()
+	return backend.state == BackendActive || (backend.state == BackendCatchingUp && typeName != "checkpoint")
+}
+
+// receivers returns the primary and the secondary backends receiving writes of typeName
+func (fdb *FanOutDbController) receivers(typeName string) []*FanOutBackend {
+	receivers := []*FanOutBackend{fdb.backends[0]}
+	for _, backend := range fdb.Secondaries() {
+		if fdb.receives(backend, typeName) {
+			receivers = append(receivers, backend)
+		}
+	}
+	return receivers
+}
+
+// writeAll calls write for the primary and all secondaries receiving writes of typeName in parallel, and returns the primary's result.
+// Secondaries failing with an error other than a conflict are marked as failed.
+func (fdb *FanOutDbController) writeAll(typeName string, write func(*FanOutBackend) (uint64, error)) (uint64, error) {
+	receivers := fdb.receivers(typeName)
+	counts := make([]uint64, len(receivers))
+	errs := make([]error, len(receivers))
+	var wg sync.WaitGroup
+	for i, backend := range receivers {
+		wg.Add(1)
+		go func(i int, backend *FanOutBackend) {
+			defer wg.Done()
+			counts[i], errs[i] = write(backend)
+		}(i, backend)
+	}
+	wg.Wait()
+	for i, backend := range receivers[1:] {
+		if err := errs[i+1]; err != nil && !IsConflict(err) {
+			fdb.Fail(backend, err)
+		}
+	}
+	return counts[0], errs[0]
+}
+
+// SetPartitioning configures partitioning for all backends, failing if any of them does not support it
+func (fdb *FanOutDbController) SetPartitioning(partitioning *Partitioning) error {
+	for _, backend := range fdb.backends {
+		partitionable, ok := backend.Controller.(Partitionable)
+		if !ok {
+			return fmt.Errorf("backend %s does not support partitioning", backend.Name)
+		}
+		if err := partitionable.SetPartitioning(partitioning); err != nil {
+			return fmt.Errorf("backend %s: %s", backend.Name, err)
+		}
+	}
+	return nil
+}
+
+// Insert inserts a single document into all backends using the updata params
+// It returns the number of documents inserted into the primary (1) or an error
+func (fdb *FanOutDbController) Insert(ctx context.Context, document doc.DocType, params UpdateParams) (uint64, error) {
+	return fdb.writeAll(params.TypeName, func(backend *FanOutBackend) (uint64, error) {
+		return backend.Controller.Insert(ctx, document, params)
+	})
+}
+
+// InsertBulk inserts documents arriving in documentChannel in bulk into all backends using the updata params
+// A secondary that falls more than fanOutBufferSize documents behind the primary is marked as failed instead of slowing down the others
+// It returns the number of documents inserted into the primary or an error
+func (fdb *FanOutDbController) InsertBulk(ctx context.Context, documentChannel chan doc.DocType, params UpdateParams) (uint64, error) {
+	receivers := fdb.receivers(params.TypeName)
+	channels := make([]chan doc.DocType, len(receivers))
+	totals := make([]uint64, len(receivers))
+	errs := make([]error, len(receivers))
+	var wg sync.WaitGroup
+	for i, backend := range receivers {
+		channels[i] = make(chan doc.DocType, fanOutBufferSize)
+		wg.Add(1)
+		go func(i int, backend *FanOutBackend) {
+			defer wg.Done()
+			totals[i], errs[i] = backend.Controller.InsertBulk(ctx, channels[i], params)
+			// Keep receiving, so a backend that stopped early does not block the others
+			for range channels[i] {
+			}
+		}(i, backend)
+	}
+
+	dropped := make([]bool, len(receivers))
+	for d := range documentChannel {
+		channels[0] <- d
+		for i := 1; i < len(channels); i++ {
+			if dropped[i] {
+				continue
+			}
+			select {
+			case channels[i] <- d:
+			default:
+				dropped[i] = true
+				close(channels[i])
+			}
+		}
+	}
+	for i, channel := range channels {
+		if !dropped[i] {
+			close(channel)
+		}
+	}
+	wg.Wait()
+
+	for i, backend := range receivers[1:] {
+		if dropped[i+1] {
+			fdb.Fail(backend, fmt.Errorf("fell more than %d documents behind while bulk indexing %s", fanOutBufferSize, params.IndexName))
+		} else if err := errs[i+1]; err != nil && !IsConflict(err) {
+			fdb.Fail(backend, err)
+		}
+	}
+	return totals[0], errs[0]
+}
+
+// WriteBatch writes a batch to all backends. Backends that are not BatchWriters write the items one after another
+// Checkpoints are left out for backends that are catching up
+func (fdb *FanOutDbController) WriteBatch(ctx context.Context, batch []BatchItem) error {
+	_, err := fdb.writeAll("", func(backend *FanOutBackend) (uint64, error) {
+		items := batch
+		if !fdb.receives(backend, "checkpoint") {
+			items = make([]BatchItem, 0, len(batch))
+			for _, item := range batch {
+				if item.Params.TypeName != "checkpoint" {
+					items = append(items, item)
+				}
+			}
+		}
+		return 0, WriteBatch(ctx, backend.Controller, items)
+	})
+	return err
+}
+
+// Delete removes documents specified by the query params from all backends
+// It returns the number of documents deleted from the primary
+func (fdb *FanOutDbController) Delete(ctx context.Context, params QueryParams) (uint64, error) {
+	return fdb.writeAll(params.TypeName, func(backend *FanOutBackend) (uint64, error) {
+		return backend.Controller.Delete(ctx, params)
+	})
+}
+
+// UpdateField sets field to value in all documents specified by the query params in all backends
+// It returns the number of documents updated in the primary
+func (fdb *FanOutDbController) UpdateField(ctx context.Context, params QueryParams, field string, value interface{}) (uint64, error) {
+	return fdb.writeAll(params.TypeName, func(backend *FanOutBackend) (uint64, error) {
+		return backend.Controller.UpdateField(ctx, params, field, value)
+	})
+}
+
+// Count returns the number of documents matching the query params in the primary
+func (fdb *FanOutDbController) Count(ctx context.Context, params QueryParams) (int64, error) {
+	return fdb.Primary().Count(ctx, params)
+}
+
+// SelectOne selects a single document from the primary
+func (fdb *FanOutDbController) SelectOne(ctx context.Context, params QueryParams, createDocument CreateDocFunction) (doc.DocType, error) {
+	return fdb.Primary().SelectOne(ctx, params, createDocument)
+}
+
+// Scroll creates a new scroll instance on the primary with the specified query and unmarshal function
+func (fdb *FanOutDbController) Scroll(ctx context.Context, params QueryParams, createDocument CreateDocFunction) ScrollInstance {
+	return fdb.Primary().Scroll(ctx, params, createDocument)
+}
+
+// GetExistingIndexPrefix checks for existing indices in the primary and returns the prefix, if any
+func (fdb *FanOutDbController) GetExistingIndexPrefix(ctx context.Context, aliasName string, documentType string) (bool, string, error) {
+	return fdb.Primary().GetExistingIndexPrefix(ctx, aliasName, documentType)
+}
+
+// CreateIndex creates index according to documentType definition in all backends
+func (fdb *FanOutDbController) CreateIndex(ctx context.Context, indexName string, documentType string) error {
+	_, err := fdb.writeAll("", func(backend *FanOutBackend) (uint64, error) {
+		return 0, backend.Controller.CreateIndex(ctx, indexName, documentType)
+	})
+	return err
+}
+
+// UpdateAlias updates an alias with a new index name in all backends
+func (fdb *FanOutDbController) UpdateAlias(ctx context.Context, aliasName string, indexName string) error {
+	return fdb.UpdateAliases(ctx, map[string]string{aliasName: indexName})
+}
+
+// UpdateAliases updates several aliases with new index names in all backends
+func (fdb *FanOutDbController) UpdateAliases(ctx context.Context, aliases map[string]string) error {
+	_, err := fdb.writeAll("", func(backend *FanOutBackend) (uint64, error) {
+		return 0, backend.Controller.UpdateAliases(ctx, aliases)
+	})
+	return err
+}
+
+// MigrateIndex migrates an existing index to the schema of documentType in all backends
+func (fdb *FanOutDbController) MigrateIndex(ctx context.Context, indexName string, documentType string) error {
+	_, err := fdb.writeAll("", func(backend *FanOutBackend) (uint64, error) {
+		return 0, backend.Controller.MigrateIndex(ctx, indexName, documentType)
+	})
+	return err
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+)
+
+// failingDbController fails all writes with err
+type failingDbController struct {
+	DbController
+	err    error
+	writes int
+}
+
+func (fdb *failingDbController) Insert(ctx context.Context, document doc.DocType, params UpdateParams) (uint64, error) {
+	fdb.writes++
+	return 0, fdb.err
+}
+
+// blockingDbController only starts bulk inserts once release is closed
+type blockingDbController struct {
+	DbController
+	release chan struct{}
+}
+
+func (bdb *blockingDbController) InsertBulk(ctx context.Context, documentChannel chan doc.DocType, params UpdateParams) (uint64, error) {
+	<-bdb.release
+	return bdb.DbController.InsertBulk(ctx, documentChannel, params)
+}
+
+// releasingDbController closes release once its bulk inserts are done
+type releasingDbController struct {
+	DbController
+	release chan struct{}
+}
+
+func (rdb *releasingDbController) InsertBulk(ctx context.Context, documentChannel chan doc.DocType, params UpdateParams) (uint64, error) {
+	defer close(rdb.release)
+	return rdb.DbController.InsertBulk(ctx, documentChannel, params)
+}
+
+func TestFanOutSkipsFailedSecondary(t *testing.T) {
+	ctx := context.Background()
+	primary := NewMemoryDbController()
+	failing := &failingDbController{DbController: NewMemoryDbController(), err: errors.New("unavailable")}
+	fanOut, err := NewFanOutDbController([]*FanOutBackend{{Name: "primary", Controller: primary}, {Name: "secondary", Controller: failing}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondary := fanOut.Secondaries()[0]
+	indexName := createTestIndex(t, fanOut, "test_", 0)
+
+	for blockNo := uint64(1); blockNo <= 2; blockNo++ {
+		inserted, err := fanOut.Insert(ctx, testBlock(fmt.Sprintf("test_%d", blockNo), blockNo, "odd"), UpdateParams{IndexName: indexName, TypeName: "block"})
+		if err != nil || inserted != 1 {
+			t.Fatalf("expected the primary's result, got %d (%v)", inserted, err)
+		}
+	}
+	if state, err := fanOut.State(secondary); state != BackendFailed || err != failing.err {
+		t.Fatalf("expected secondary to fail with %v, got %v (%v)", failing.err, state, err)
+	}
+	if failing.writes != 1 {
+		t.Fatalf("expected failed secondary to be skipped, got %d writes", failing.writes)
+	}
+	if count, err := primary.Count(ctx, QueryParams{IndexName: indexName}); err != nil || count != 2 {
+		t.Fatalf("expected 2 documents in the primary, got %d (%v)", count, err)
+	}
+
+	fanOut.BeginCatchUp(secondary)
+	if state, _ := fanOut.State(secondary); state != BackendCatchingUp || fanOut.receives(secondary, "checkpoint") || !fanOut.receives(secondary, "block") {
+		t.Fatalf("expected secondary catching up to receive all writes but checkpoints, got %v", state)
+	}
+	if !fanOut.EndCatchUp(secondary) {
+		t.Fatal("expected catch up to end")
+	}
+	if state, err := fanOut.State(secondary); state != BackendActive || err != nil {
+		t.Fatalf("expected secondary to be active, got %v (%v)", state, err)
+	}
+}
+
+func TestFanOutInsertBulkDropsSlowSecondary(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	primary := &releasingDbController{DbController: NewMemoryDbController(), release: release}
+	slow := &blockingDbController{DbController: NewMemoryDbController(), release: release}
+	fanOut, err := NewFanOutDbController([]*FanOutBackend{{Name: "primary", Controller: primary}, {Name: "secondary", Controller: slow}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexName := createTestIndex(t, fanOut, "test_", 0)
+
+	// The secondary does not read any document until the primary is done, so it falls behind by one document too many
+	documents := make(chan doc.DocType, fanOutBufferSize+1)
+	for blockNo := uint64(1); blockNo <= fanOutBufferSize+1; blockNo++ {
+		documents <- testBlock(fmt.Sprintf("test_%d", blockNo), blockNo, "bulk")
+	}
+	close(documents)
+	inserted, err := fanOut.InsertBulk(ctx, documents, UpdateParams{IndexName: indexName, TypeName: "block", Size: 1000})
+	if err != nil || inserted != fanOutBufferSize+1 {
+		t.Fatalf("expected all documents to be inserted into the primary, got %d (%v)", inserted, err)
+	}
+	state, err := fanOut.State(fanOut.Secondaries()[0])
+	if state != BackendFailed || err == nil || !strings.Contains(err.Error(), "behind") {
+		t.Fatalf("expected secondary to fail for falling behind, got %v (%v)", state, err)
+	}
+}
@@ -0,0 +1,984 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+)
+
+const (
+	// fileStateName is the file holding the state of a FileDbController
+	fileStateName = "state.json"
+	// filePartSuffix marks data files that are still being written
+	filePartSuffix = ".part"
+	// fileBulkExtension is the extension of data files in Elasticsearch _bulk format
+	fileBulkExtension = ".bulk.ndjson.gz"
+	// fileQueriesExtension is the extension of the files next to _bulk data files that hold their deletes and updates by query
+	fileQueriesExtension = ".queries.ndjson"
+	// defaultFileRotateSize is the uncompressed size in megabytes after which a data file is completed and a new one is started
+	defaultFileRotateSize = 64
+	// fileRecentBlocks is the number of latest block documents kept in the state, e.g. to look up block hashes on reorganizations
+	fileRecentBlocks = 1000
+	// fileStateInterval is the interval in which changes of the state are persisted. It is also persisted whenever a data file is completed
+	fileStateInterval = 10 * time.Second
+)
+
+// fileStateTypes are the document types that are kept in the state instead of data files, as the indexer reads them back
+var fileStateTypes = []string{"checkpoint", "failed_block"}
+
+// FileDbController implements DbController by writing documents to rotating, gzip compressed NDJSON files,
+// so the output can be loaded into any database later.
+// Each index is written to its own directory. Files are numbered in the order they were started across all indices,
+// and keep a .part suffix until they are complete.
+// Deletes and updates by query are recorded as tombstone lines, or, in Elasticsearch _bulk format, which has no such operations,
+// as request bodies for _delete_by_query and _update_by_query in an append-only queries file next to the current data file.
+// The checkpoint, failed blocks, the numbers of written blocks, and the latest block documents are kept in a state file,
+// so the indexer can resume and find its best block. The state is persisted periodically, on rotation and on Close, so after a crash,
+// the indexer resumes from an earlier checkpoint and blocks written since then are rolled back with tombstones and written again.
+type FileDbController struct {
+	dir        string
+	bulk       bool
+	typeless   bool
+	rotateSize int64
+	state      *MemoryDbController
+	stateDirty bool                    // whether the state changed since it was persisted
+	types      map[string]string       // document type by index name
+	blocks     map[string][]blockRange // numbers of written blocks by index name
+	sequence   uint64
+	files      map[string]*fileWriter // current data file by index name
+	mutex      sync.Mutex
+	done       chan struct{}
+}
+
+// fileState is the persisted state of a FileDbController
+type fileState struct {
+	Sequence uint64                  `json:"sequence"`
+	Types    map[string]string       `json:"types"`
+	Blocks   map[string][]blockRange `json:"blocks"`
+	Indices  map[string]memoryIndex  `json:"indices"`
+	Aliases  map[string]string       `json:"aliases"`
+	Versions map[string]int          `json:"versions"`
+}
+
+// fileLine is a document line of a data file in NDJSON format
+type fileLine struct {
+	Op  string          `json:"op"`
+	ID  string          `json:"id"`
+	Doc json.RawMessage `json:"doc"`
+}
+
+// fileQueryLine is a line of a queries file. The query is applied after the first After actions of the data file it belongs to
+type fileQueryLine struct {
+	After int                    `json:"after"`
+	Op    string                 `json:"op"`
+	Body  map[string]interface{} `json:"body"`
+}
+
+// NewFileDbController creates a new instance of FileDbController writing to the directory dbURL, which is created if it does not exist.
+// Options are given as query parameters: format=bulk writes Elasticsearch _bulk requests instead of plain NDJSON,
+// typeless=true leaves out the mapping type in _bulk requests for Elasticsearch 7 and later,
+// and rotate sets the uncompressed size of data files in megabytes, e.g. /data/indexer?format=bulk&rotate=256
+func NewFileDbController(dbURL string) (*FileDbController, error) {
+	dir, options := dbURL, url.Values{}
+	if i := strings.Index(dbURL, "?"); i >= 0 {
+		var err error
+		dir = dbURL[:i]
+		if options, err = url.ParseQuery(dbURL[i+1:]); err != nil {
+			return nil, err
+		}
+	}
+	fdb := &FileDbController{
+		dir:        dir,
+		rotateSize: defaultFileRotateSize << 20,
+		state:      NewMemoryDbController(),
+		types:      make(map[string]string),
+		blocks:     make(map[string][]blockRange),
+		files:      make(map[string]*fileWriter),
+		done:       make(chan struct{}),
+	}
+	switch format := options.Get("format"); format {
+	case "", "ndjson":
+	case "bulk":
+		fdb.bulk = true
+	default:
+		return nil, fmt.Errorf("invalid file format %s, expected ndjson or bulk", format)
+	}
+	if typeless := options.Get("typeless"); typeless != "" {
+		var err error
+		if fdb.typeless, err = strconv.ParseBool(typeless); err != nil {
+			return nil, fmt.Errorf("invalid typeless option %s, expected true or false", typeless)
+		}
+	}
+	if rotate := options.Get("rotate"); rotate != "" {
+		size, err := strconv.ParseInt(rotate, 10, 64)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid rotate size %s, expected megabytes", rotate)
+		}
+		fdb.rotateSize = size << 20
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := fdb.loadState(); err != nil {
+		return nil, err
+	}
+	if err := fdb.recoverFiles(); err != nil {
+		return nil, err
+	}
+	go fdb.saveStatePeriodically()
+	return fdb, nil
+}
+
+// loadState restores the state persisted by a previous run, if any
+func (fdb *FileDbController) loadState() error {
+	data, err := ioutil.ReadFile(filepath.Join(fdb.dir, fileStateName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state fileState
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&state); err != nil {
+		return fmt.Errorf("could not read %s: %s", fileStateName, err)
+	}
+	fdb.sequence = state.Sequence
+	if state.Types != nil {
+		fdb.types = state.Types
+	}
+	if state.Blocks != nil {
+		fdb.blocks = state.Blocks
+	}
+	if state.Indices != nil {
+		fdb.state.indices = state.Indices
+	}
+	if state.Aliases != nil {
+		fdb.state.aliases = state.Aliases
+	}
+	if state.Versions != nil {
+		fdb.state.versions = state.Versions
+	}
+	return nil
+}
+
+// saveState flushes the data files and then persists the state, so the state never refers to documents that are not on disk
+func (fdb *FileDbController) saveState() error {
+	for _, writer := range fdb.files {
+		if err := writer.flush(); err != nil {
+			return err
+		}
+	}
+	fdb.state.mutex.RLock()
+	data, err := json.Marshal(fileState{
+		Sequence: fdb.sequence,
+		Types:    fdb.types,
+		Blocks:   fdb.blocks,
+		Indices:  fdb.state.indices,
+		Aliases:  fdb.state.aliases,
+		Versions: fdb.state.versions,
+	})
+	fdb.state.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(fdb.dir, fileStateName)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	fdb.stateDirty = false
+	return nil
+}
+
+// saveStatePeriodically persists the state every fileStateInterval if it changed, until the controller is closed
+func (fdb *FileDbController) saveStatePeriodically() {
+	ticker := time.NewTicker(fileStateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-fdb.done:
+			return
+		}
+		fdb.mutex.Lock()
+		if fdb.stateDirty {
+			if err := fdb.saveState(); err != nil {
+				logger.Warn().Err(err).Str("dir", fdb.dir).Msg("Failed to save state")
+			}
+		}
+		fdb.mutex.Unlock()
+	}
+}
+
+// Close completes all data files and persists the state
+func (fdb *FileDbController) Close() error {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	select {
+	case <-fdb.done:
+		return nil
+	default:
+		close(fdb.done)
+	}
+	for indexName := range fdb.files {
+		if err := fdb.closeFile(indexName); err != nil {
+			return fdb.wrapError(err)
+		}
+	}
+	return fdb.wrapError(fdb.saveState())
+}
+
+// recoverFiles completes the data files that were still being written when the indexer stopped unexpectedly,
+// and continues numbering files after the existing ones.
+// The content of incomplete files is kept up to the last complete document that can be decompressed.
+func (fdb *FileDbController) recoverFiles() error {
+	files, err := filepath.Glob(filepath.Join(fdb.dir, "*", "*"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		number := strings.SplitN(filepath.Base(file), ".", 2)[0]
+		if sequence, err := strconv.ParseUint(number, 10, 64); err == nil && sequence > fdb.sequence {
+			fdb.sequence = sequence
+		}
+		if !strings.HasSuffix(file, filePartSuffix) {
+			continue
+		}
+		path := strings.TrimSuffix(file, filePartSuffix)
+		recoverPart := fdb.recoverFile
+		if strings.HasSuffix(path, fileQueriesExtension) {
+			recoverPart = recoverQueriesFile
+		}
+		if err := recoverPart(path); err != nil {
+			return err
+		}
+		logger.Warn().Str("file", file).Msg("Recovered incomplete data file")
+	}
+	return nil
+}
+
+// recoverFile rewrites the readable part of an incomplete data file as a complete file
+func (fdb *FileDbController) recoverFile(path string) error {
+	file, err := os.Open(path + filePartSuffix)
+	if err != nil {
+		return err
+	}
+	var content []byte
+	if reader, err := gzip.NewReader(file); err == nil {
+		// Reading fails at the end of the data flushed last, everything before is intact
+		content, _ = ioutil.ReadAll(reader)
+	}
+	file.Close()
+
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	lines = lines[:len(lines)-1] // incomplete line, or empty after the last newline
+	if fdb.bulk && len(lines)%2 == 1 {
+		lines = lines[:len(lines)-1] // action without source
+	}
+	if len(lines) == 0 {
+		return os.Remove(path + filePartSuffix)
+	}
+	writer, err := createFileWriter(path)
+	if err != nil {
+		return err
+	}
+	if err := writer.write(bytes.Join(lines, nil)); err != nil {
+		writer.file.Close()
+		return err
+	}
+	return writer.close()
+}
+
+// recoverQueriesFile completes an incomplete queries file, leaving out a line that was not written completely.
+// Queries that apply after actions that were lost with the data file are kept, they are applied at the end of the data file
+func recoverQueriesFile(path string) error {
+	content, err := ioutil.ReadFile(path + filePartSuffix)
+	if err != nil {
+		return err
+	}
+	if i := bytes.LastIndexByte(content, '\n'); i+1 < len(content) {
+		content = content[:i+1]
+	}
+	if err := ioutil.WriteFile(path+filePartSuffix, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+filePartSuffix, path)
+}
+
+// nextPath returns the path of a new file of an index
+func (fdb *FileDbController) nextPath(indexName string, extension string) (string, error) {
+	dir := filepath.Join(fdb.dir, indexName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	fdb.sequence++
+	return filepath.Join(dir, fmt.Sprintf("%012d%s", fdb.sequence, extension)), nil
+}
+
+// openFile returns the current data file of an index, starting a new one if there is none or the current one is full.
+// The state is persisted after completing a full file
+func (fdb *FileDbController) openFile(indexName string) (*fileWriter, error) {
+	writer, ok := fdb.files[indexName]
+	if ok && writer.size < fdb.rotateSize {
+		return writer, nil
+	}
+	if ok {
+		if err := fdb.closeFile(indexName); err != nil {
+			return nil, err
+		}
+		if err := fdb.saveState(); err != nil {
+			return nil, err
+		}
+	}
+	extension := ".ndjson.gz"
+	if fdb.bulk {
+		extension = fileBulkExtension
+	}
+	path, err := fdb.nextPath(indexName, extension)
+	if err != nil {
+		return nil, err
+	}
+	writer, err = createFileWriter(path)
+	if err != nil {
+		return nil, err
+	}
+	fdb.files[indexName] = writer
+	return writer, nil
+}
+
+// closeFile completes the current data file of an index, if any
+func (fdb *FileDbController) closeFile(indexName string) error {
+	writer, ok := fdb.files[indexName]
+	if !ok {
+		return nil
+	}
+	delete(fdb.files, indexName)
+	return writer.close()
+}
+
+// writeDocument appends a document of typeName to the data file of an index. With upsert, it replaces an existing document with the same id
+func (fdb *FileDbController) writeDocument(indexName string, typeName string, document doc.DocType, upsert bool) error {
+	source, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	op := "create"
+	if upsert {
+		op = "index"
+	}
+	var line []byte
+	if fdb.bulk {
+		metadata := map[string]string{"_index": indexName, "_id": document.GetID()}
+		if !fdb.typeless && typeName != "" {
+			metadata["_type"] = typeName
+		}
+		action, err := json.Marshal(map[string]interface{}{op: metadata})
+		if err != nil {
+			return err
+		}
+		line = append(append(action, '\n'), source...)
+	} else {
+		line, err = json.Marshal(fileLine{Op: op, ID: document.GetID(), Doc: source})
+		if err != nil {
+			return err
+		}
+	}
+	writer, err := fdb.openFile(indexName)
+	if err != nil {
+		return err
+	}
+	writer.documents++
+	return writer.write(append(line, '\n'))
+}
+
+// writeQuery records that all documents matching the query params are deleted, or that field is set to value for them.
+// In NDJSON format, it is a line with the operation and the Elasticsearch query. The _bulk format has no such operation,
+// so the request body for _delete_by_query or _update_by_query is appended to the queries file of the current data file,
+// together with the number of actions it follows.
+func (fdb *FileDbController) writeQuery(params QueryParams, op string, field string, value interface{}) error {
+	query, err := esQuery(params).Source()
+	if err != nil {
+		return err
+	}
+	if !fdb.bulk {
+		line := map[string]interface{}{"op": op, "query": query}
+		if op == "update" {
+			line["field"] = field
+			line["value"] = value
+		}
+		encoded, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		writer, err := fdb.openFile(params.IndexName)
+		if err != nil {
+			return err
+		}
+		return writer.write(append(encoded, '\n'))
+	}
+
+	body := map[string]interface{}{"query": query}
+	if op == "update" {
+		body["script"] = map[string]interface{}{
+			"source": "ctx._source[params.field] = params.value",
+			"params": map[string]interface{}{"field": field, "value": value},
+		}
+	}
+	writer, err := fdb.openFile(params.IndexName)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(fileQueryLine{After: writer.documents, Op: op + "_by_query", Body: body})
+	if err != nil {
+		return err
+	}
+	return writer.writeQuery(append(encoded, '\n'))
+}
+
+// typeOf returns the document type of an index, or typeName if the index is unknown
+func (fdb *FileDbController) typeOf(indexName string, typeName string) string {
+	if documentType, ok := fdb.types[indexName]; ok {
+		return documentType
+	}
+	return typeName
+}
+
+// isStateType returns whether documents of typeName are kept in the state
+func isStateType(typeName string) bool {
+	return containsString(fileStateTypes, typeName)
+}
+
+// insert writes a document to the state or a data file, depending on its type
+func (fdb *FileDbController) insert(ctx context.Context, document doc.DocType, params UpdateParams) error {
+	typeName := fdb.typeOf(params.IndexName, params.TypeName)
+	switch {
+	case isStateType(typeName):
+		fdb.types[params.IndexName] = typeName
+		_, err := fdb.state.Insert(ctx, document, params)
+		return err
+	case typeName == "block":
+		fdb.types[params.IndexName] = typeName
+		return fdb.insertBlock(document, params)
+	}
+	return fdb.writeDocument(params.IndexName, typeName, document, params.Upsert)
+}
+
+// insertBlock writes a block document, records its number, and keeps it as one of the recent blocks.
+// It fails with a conflict if the block was written already and upsert is not set
+func (fdb *FileDbController) insertBlock(document doc.DocType, params UpdateParams) error {
+	fields, err := toMemoryDocument(document)
+	if err != nil {
+		return err
+	}
+	blockNo, ok := memoryBlockNo(fields)
+	if !ok {
+		return fmt.Errorf("block [%s] has no block number", document.GetID())
+	}
+	ranges := fdb.blocks[params.IndexName]
+	if containsBlock(ranges, blockNo) && !params.Upsert {
+		return newError(KindConflict, fmt.Errorf("block [%d] already exists in [%s]", blockNo, params.IndexName))
+	}
+	if err := fdb.writeDocument(params.IndexName, "block", document, params.Upsert); err != nil {
+		return err
+	}
+	fdb.blocks[params.IndexName] = addBlock(ranges, blockNo)
+
+	fdb.state.mutex.Lock()
+	defer fdb.state.mutex.Unlock()
+	index := fdb.state.getOrCreateIndex(params.IndexName)
+	index[document.GetID()] = fields
+	for len(index) > fileRecentBlocks {
+		oldestID, oldestNo := "", blockNo
+		for id, fields := range index {
+			if no, _ := memoryBlockNo(fields); no <= oldestNo {
+				oldestID, oldestNo = id, no
+			}
+		}
+		delete(index, oldestID)
+	}
+	return nil
+}
+
+// memoryBlockNo returns the block number of a stored block document
+func memoryBlockNo(fields memoryDocument) (uint64, bool) {
+	blockNo, err := strconv.ParseUint(fmt.Sprint(fields["no"]), 10, 64)
+	return blockNo, err == nil
+}
+
+// fileErrorKind classifies errors of the file system
+func fileErrorKind(err error) ErrorKind {
+	if os.IsNotExist(err) {
+		return KindNotFound
+	}
+	return KindPermanent
+}
+
+// wrapError classifies an error of the file system
+func (fdb *FileDbController) wrapError(err error) error {
+	return wrapError(err, fileErrorKind)
+}
+
+// NewLock creates a file lock in the data directory, as only instances on the same host can write to it
+func (fdb *FileDbController) NewLock(name string) Locker {
+	return NewFileLock(filepath.Join(fdb.dir, name+".lock"))
+}
+
+// Insert inserts a single document using the updata params
+// It returns the number of inserted documents (1) or an error
+func (fdb *FileDbController) Insert(ctx context.Context, document doc.DocType, params UpdateParams) (uint64, error) {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	if err := fdb.insert(ctx, document, params); err != nil {
+		return 0, fdb.wrapError(err)
+	}
+	fdb.stateDirty = true
+	return 1, nil
+}
+
+// InsertBulk inserts documents arriving in documentChannel in bulk using the updata params
+// Conflicting blocks don't stop the other documents from being inserted, but the first conflict is returned
+// It returns the number of inserted documents or an error
+func (fdb *FileDbController) InsertBulk(ctx context.Context, documentChannel chan doc.DocType, params UpdateParams) (uint64, error) {
+	var total uint64
+	var firstErr error
+	for d := range documentChannel {
+		fdb.mutex.Lock()
+		err := fdb.insert(ctx, d, params)
+		fdb.stateDirty = true
+		fdb.mutex.Unlock()
+		if err != nil {
+			if !IsConflict(err) {
+				return total, fdb.wrapError(err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			total++
+		}
+
+		select {
+		default:
+		case <-ctx.Done():
+			return total, fdb.wrapError(ctx.Err())
+		}
+	}
+	return total, firstErr
+}
+
+// Delete removes documents specified by the query params
+// Documents in data files are not removed, but a tombstone is written. Only deleted block numbers and state documents are counted
+func (fdb *FileDbController) Delete(ctx context.Context, params QueryParams) (uint64, error) {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	typeName := fdb.typeOf(params.IndexName, params.TypeName)
+	if isStateType(typeName) {
+		deleted, err := fdb.state.Delete(ctx, params)
+		if err != nil {
+			return 0, fdb.wrapError(err)
+		}
+		fdb.stateDirty = true
+		return deleted, nil
+	}
+	if err := fdb.writeQuery(params, "delete", "", nil); err != nil {
+		return 0, fdb.wrapError(err)
+	}
+	var deleted uint64
+	if typeName == "block" {
+		blockRange := params.IntegerRange
+		if blockRange != nil && blockRange.Field == "no" && params.StringMatch == nil && params.Filter == nil {
+			fdb.blocks[params.IndexName], deleted = removeBlocks(fdb.blocks[params.IndexName], blockRange.Min, blockRange.Max)
+		}
+		if _, err := fdb.state.Delete(ctx, params); err != nil {
+			return 0, fdb.wrapError(err)
+		}
+	}
+	fdb.stateDirty = true
+	return deleted, nil
+}
+
+// UpdateField sets field to value in all documents specified by the query params that don't have this value yet
+// For data files, the update is recorded like a tombstone. Only updated state documents and recent blocks are counted
+func (fdb *FileDbController) UpdateField(ctx context.Context, params QueryParams, field string, value interface{}) (uint64, error) {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	typeName := fdb.typeOf(params.IndexName, params.TypeName)
+	if isStateType(typeName) {
+		updated, err := fdb.state.UpdateField(ctx, params, field, value)
+		if err != nil {
+			return 0, fdb.wrapError(err)
+		}
+		fdb.stateDirty = true
+		return updated, nil
+	}
+	if err := fdb.writeQuery(params, "update", field, value); err != nil {
+		return 0, fdb.wrapError(err)
+	}
+	var updated uint64
+	if typeName == "block" {
+		var err error
+		if updated, err = fdb.state.UpdateField(ctx, params, field, value); err != nil {
+			return 0, fdb.wrapError(err)
+		}
+	}
+	fdb.stateDirty = true
+	return updated, nil
+}
+
+// Count returns the number of documents matching the query params
+// Blocks are counted by their numbers if the only condition is an IntegerRange on no, otherwise only recent blocks are counted.
+// Documents of other data files cannot be counted
+func (fdb *FileDbController) Count(ctx context.Context, params QueryParams) (int64, error) {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	typeName := fdb.typeOf(params.IndexName, params.TypeName)
+	if typeName == "block" && params.StringMatch == nil && params.Filter == nil && (params.IntegerRange == nil || params.IntegerRange.Field == "no") {
+		return int64(countBlocks(clipBlocks(fdb.blocks[params.IndexName], params.IntegerRange))), nil
+	}
+	if isStateType(typeName) || typeName == "block" {
+		return fdb.state.Count(ctx, params)
+	}
+	return 0, newError(KindPermanent, fmt.Errorf("documents of [%s] are written to files and cannot be counted", params.IndexName))
+}
+
+// SelectOne selects a single document
+// Blocks can only be selected among the recent blocks. Documents of other data files cannot be selected
+func (fdb *FileDbController) SelectOne(ctx context.Context, params QueryParams, createDocument CreateDocFunction) (doc.DocType, error) {
+	fdb.mutex.Lock()
+	typeName := fdb.typeOf(params.IndexName, params.TypeName)
+	fdb.mutex.Unlock()
+	if isStateType(typeName) || typeName == "block" {
+		return fdb.state.SelectOne(ctx, params, createDocument)
+	}
+	return nil, newError(KindPermanent, fmt.Errorf("documents of [%s] are written to files and cannot be queried", params.IndexName))
+}
+
+// UpdateAlias updates an alias with a new index name
+func (fdb *FileDbController) UpdateAlias(ctx context.Context, aliasName string, indexName string) error {
+	return fdb.UpdateAliases(ctx, map[string]string{aliasName: indexName})
+}
+
+// UpdateAliases updates several aliases with new index names at once.
+// The state of the indices they pointed to is removed and their data files are completed, but kept
+func (fdb *FileDbController) UpdateAliases(ctx context.Context, aliases map[string]string) error {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	fdb.state.mutex.RLock()
+	previous := make(map[string]string, len(aliases))
+	for aliasName := range aliases {
+		previous[aliasName] = fdb.state.aliases[aliasName]
+	}
+	fdb.state.mutex.RUnlock()
+
+	if err := fdb.state.UpdateAliases(ctx, aliases); err != nil {
+		return fdb.wrapError(err)
+	}
+	for aliasName, indexName := range aliases {
+		if oldIndexName := previous[aliasName]; oldIndexName != "" && oldIndexName != indexName {
+			delete(fdb.types, oldIndexName)
+			delete(fdb.blocks, oldIndexName)
+			if err := fdb.closeFile(oldIndexName); err != nil {
+				return fdb.wrapError(err)
+			}
+		}
+	}
+	return fdb.wrapError(fdb.saveState())
+}
+
+// GetExistingIndexPrefix checks for existing indices and returns the prefix, if any
+func (fdb *FileDbController) GetExistingIndexPrefix(ctx context.Context, aliasName string, documentType string) (bool, string, error) {
+	return fdb.state.GetExistingIndexPrefix(ctx, aliasName, documentType)
+}
+
+// CreateIndex creates an index for documentType. Documents of data indices are written to a directory named after the index
+func (fdb *FileDbController) CreateIndex(ctx context.Context, indexName string, documentType string) error {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	if err := fdb.state.CreateIndex(ctx, indexName, documentType); err != nil {
+		return fdb.wrapError(err)
+	}
+	fdb.types[indexName] = documentType
+	if !isStateType(documentType) {
+		if err := os.MkdirAll(filepath.Join(fdb.dir, indexName), 0755); err != nil {
+			return fdb.wrapError(err)
+		}
+	}
+	return fdb.wrapError(fdb.saveState())
+}
+
+// MigrateIndex records the schema version of an existing index. Documents are written schemaless, so new fields need no changes
+func (fdb *FileDbController) MigrateIndex(ctx context.Context, indexName string, documentType string) error {
+	fdb.mutex.Lock()
+	defer fdb.mutex.Unlock()
+	if err := fdb.state.MigrateIndex(ctx, indexName, documentType); err != nil {
+		return fdb.wrapError(err)
+	}
+	return fdb.wrapError(fdb.saveState())
+}
+
+// Scroll creates a new scroll instance with the specified query and unmarshal function
+// Scrolling blocks returns the numbers of all written blocks. Documents of other data files cannot be scrolled
+func (fdb *FileDbController) Scroll(ctx context.Context, params QueryParams, createDocument CreateDocFunction) ScrollInstance {
+	fdb.mutex.Lock()
+	typeName := fdb.typeOf(params.IndexName, params.TypeName)
+	fdb.mutex.Unlock()
+	switch {
+	case isStateType(typeName):
+		return fdb.state.Scroll(ctx, params, createDocument)
+	case typeName == "block":
+		return &FileBlockScrollInstance{
+			db:             fdb,
+			params:         params,
+			createDocument: createDocument,
+		}
+	}
+	return &fileErrorScrollInstance{err: newError(KindPermanent, fmt.Errorf("documents of [%s] are written to files and cannot be queried", params.IndexName))}
+}
+
+// FileBlockScrollInstance is an instance of a scroll over the numbers of blocks written by FileDbController.
+// Documents only contain the block number. Of the query params, only an IntegerRange on no and SortAsc are applied
+type FileBlockScrollInstance struct {
+	db             *FileDbController
+	params         QueryParams
+	createDocument CreateDocFunction
+	ranges         []blockRange
+	next           uint64
+	started        bool
+}
+
+// Next returns the next document of a scroll or io.EOF
+func (scroll *FileBlockScrollInstance) Next() (doc.DocType, error) {
+	if !scroll.started {
+		scroll.db.mutex.Lock()
+		scroll.ranges = clipBlocks(scroll.db.blocks[scroll.params.IndexName], scroll.params.IntegerRange)
+		scroll.db.mutex.Unlock()
+		if !scroll.params.SortAsc {
+			for i, j := 0, len(scroll.ranges)-1; i < j; i, j = i+1, j-1 {
+				scroll.ranges[i], scroll.ranges[j] = scroll.ranges[j], scroll.ranges[i]
+			}
+		}
+		if len(scroll.ranges) > 0 {
+			scroll.next = scroll.first()
+		}
+		scroll.started = true
+	}
+	if len(scroll.ranges) == 0 {
+		return nil, io.EOF
+	}
+	blockNo := scroll.next
+	switch {
+	case scroll.params.SortAsc && blockNo < scroll.ranges[0].To:
+		scroll.next++
+	case !scroll.params.SortAsc && blockNo > scroll.ranges[0].From:
+		scroll.next--
+	default:
+		scroll.ranges = scroll.ranges[1:]
+		if len(scroll.ranges) > 0 {
+			scroll.next = scroll.first()
+		}
+	}
+	fields := memoryDocument{"no": json.Number(strconv.FormatUint(blockNo, 10))}
+	return toDocType("", fields, nil, scroll.createDocument)
+}
+
+// first returns the first block number of the next range in scroll order
+func (scroll *FileBlockScrollInstance) first() uint64 {
+	if scroll.params.SortAsc {
+		return scroll.ranges[0].From
+	}
+	return scroll.ranges[0].To
+}
+
+// fileErrorScrollInstance is a scroll that fails with err
+type fileErrorScrollInstance struct {
+	err error
+}
+
+// Next returns the error of the scroll
+func (scroll *fileErrorScrollInstance) Next() (doc.DocType, error) {
+	return nil, scroll.err
+}
+
+// fileWriter writes to a gzip compressed data file, which has the .part suffix until it is complete
+type fileWriter struct {
+	path      string
+	file      *os.File
+	gzip      *gzip.Writer
+	size      int64    // uncompressed bytes written
+	documents int      // number of documents written
+	queries   *os.File // queries file of a _bulk data file, created with the first query
+}
+
+// createFileWriter creates a data file to be completed at path
+func createFileWriter(path string) (*fileWriter, error) {
+	file, err := os.OpenFile(path+filePartSuffix, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{path: path, file: file, gzip: gzip.NewWriter(file)}, nil
+}
+
+func (writer *fileWriter) write(data []byte) error {
+	n, err := writer.gzip.Write(data)
+	writer.size += int64(n)
+	return err
+}
+
+// queriesPath returns the path of the queries file of a _bulk data file
+func (writer *fileWriter) queriesPath() string {
+	return strings.TrimSuffix(writer.path, fileBulkExtension) + fileQueriesExtension
+}
+
+// writeQuery appends a line to the queries file, creating it if needed
+func (writer *fileWriter) writeQuery(line []byte) error {
+	if writer.queries == nil {
+		file, err := os.OpenFile(writer.queriesPath()+filePartSuffix, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		writer.queries = file
+	}
+	_, err := writer.queries.Write(line)
+	return err
+}
+
+// flush writes all data to disk, so that it can be recovered if the file is not completed
+func (writer *fileWriter) flush() error {
+	if err := writer.gzip.Flush(); err != nil {
+		return err
+	}
+	if writer.queries != nil {
+		if err := writer.queries.Sync(); err != nil {
+			return err
+		}
+	}
+	return writer.file.Sync()
+}
+
+// close completes the file and its queries file, and removes their .part suffix
+func (writer *fileWriter) close() error {
+	if writer.queries != nil {
+		if err := writer.queries.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(writer.queriesPath()+filePartSuffix, writer.queriesPath()); err != nil {
+			return err
+		}
+	}
+	if err := writer.gzip.Close(); err != nil {
+		writer.file.Close()
+		return err
+	}
+	if err := writer.file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(writer.path+filePartSuffix, writer.path)
+}
+
+// blockRange is a range of consecutive block numbers [From, To]
+type blockRange struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// containsBlock returns whether blockNo is within one of the sorted ranges
+func containsBlock(ranges []blockRange, blockNo uint64) bool {
+	for _, r := range ranges {
+		if r.From <= blockNo && blockNo <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// addBlock adds blockNo to the sorted ranges, merging adjacent ranges
+func addBlock(ranges []blockRange, blockNo uint64) []blockRange {
+	i := 0
+	for i < len(ranges) && ranges[i].To+1 < blockNo {
+		i++
+	}
+	switch {
+	case i == len(ranges) || ranges[i].From > blockNo+1:
+		ranges = append(ranges, blockRange{})
+		copy(ranges[i+1:], ranges[i:])
+		ranges[i] = blockRange{From: blockNo, To: blockNo}
+	case ranges[i].From == blockNo+1:
+		ranges[i].From = blockNo
+	case ranges[i].To+1 == blockNo:
+		ranges[i].To = blockNo
+		if i+1 < len(ranges) && ranges[i+1].From == blockNo+1 {
+			ranges[i].To = ranges[i+1].To
+			ranges = append(ranges[:i+1], ranges[i+2:]...)
+		}
+	}
+	return ranges
+}
+
+// removeBlocks removes the block numbers in [from, to] from the sorted ranges and returns how many were removed
+func removeBlocks(ranges []blockRange, from uint64, to uint64) ([]blockRange, uint64) {
+	remaining := make([]blockRange, 0, len(ranges)+1)
+	var removed uint64
+	for _, r := range ranges {
+		if r.To < from || r.From > to {
+			remaining = append(remaining, r)
+			continue
+		}
+		overlap := blockRange{From: r.From, To: r.To}
+		if r.From < from {
+			remaining = append(remaining, blockRange{From: r.From, To: from - 1})
+			overlap.From = from
+		}
+		if r.To > to {
+			remaining = append(remaining, blockRange{From: to + 1, To: r.To})
+			overlap.To = to
+		}
+		removed += overlap.To - overlap.From + 1
+	}
+	return remaining, removed
+}
+
+// clipBlocks returns a copy of the sorted ranges limited to an IntegerRange on no
+func clipBlocks(ranges []blockRange, limit *IntegerRangeQuery) []blockRange {
+	clipped := make([]blockRange, 0, len(ranges))
+	for _, r := range ranges {
+		if limit != nil && limit.Field == "no" {
+			if r.To < limit.Min || r.From > limit.Max {
+				continue
+			}
+			if r.From < limit.Min {
+				r.From = limit.Min
+			}
+			if r.To > limit.Max {
+				r.To = limit.Max
+			}
+		}
+		clipped = append(clipped, r)
+	}
+	return clipped
+}
+
+// countBlocks returns the number of block numbers in ranges
+func countBlocks(ranges []blockRange) uint64 {
+	var count uint64
+	for _, r := range ranges {
+		count += r.To - r.From + 1
+	}
+	return count
+}
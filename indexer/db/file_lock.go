@@ -0,0 +1,87 @@
+//go:build !windows
+// +build !windows
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FileLock is a lock for instances running on the same host, based on flock.
+// The operating system releases it when the process exits, so it does not expire and needs no keepalive.
+type FileLock struct {
+	path  string
+	owner string
+	file  *os.File
+	mutex sync.Mutex
+}
+
+// NewFileLock creates a lock using the file at path, which is created if it does not exist
+func NewFileLock(path string) Locker {
+	hostname, _ := os.Hostname()
+	return &FileLock{
+		path:  path,
+		owner: fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+	}
+}
+
+// Acquire takes the lock, or fails if another process holds it. ttl is ignored
+func (lock *FileLock) Acquire(ctx context.Context, ttl time.Duration) error {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+	if lock.file != nil {
+		return nil
+	}
+	file, err := os.OpenFile(lock.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		owner, _ := ioutil.ReadAll(file)
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("lock %s is held by %s", lock.path, owner)
+		}
+		return err
+	}
+	// Record the owner for other processes' error messages
+	file.Truncate(0)
+	file.WriteAt([]byte(lock.owner), 0)
+	lock.file = file
+	return nil
+}
+
+// KeepAlive does nothing, as a file lock is held until it is released or the process exits
+func (lock *FileLock) KeepAlive(ctx context.Context, interval time.Duration) {
+}
+
+// Release gives up the lock, failing if it was not held
+func (lock *FileLock) Release() error {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+	if lock.file == nil {
+		return fmt.Errorf("lock %s was not held", lock.path)
+	}
+	err := syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN)
+	lock.file.Close()
+	lock.file = nil
+	return err
+}
+
+// IsAcquired returns whether the lock is held
+func (lock *FileLock) IsAcquired() bool {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+	return lock.file != nil
+}
+
+// Owner returns the unique name of this lock instance
+func (lock *FileLock) Owner() string {
+	return lock.owner
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// FileLock is not supported on windows. Acquiring it always fails
+type FileLock struct{}
+
+// NewFileLock creates a lock that cannot be acquired
+func NewFileLock(path string) Locker {
+	return &FileLock{}
+}
+
+// Acquire always fails
+func (lock *FileLock) Acquire(ctx context.Context, ttl time.Duration) error {
+	return errors.New("file locks are not supported on windows")
+}
+
+// KeepAlive does nothing
+func (lock *FileLock) KeepAlive(ctx context.Context, interval time.Duration) {
+}
+
+// Release always fails
+func (lock *FileLock) Release() error {
+	return errors.New("file locks are not supported on windows")
+}
+
+// IsAcquired always returns false
+func (lock *FileLock) IsAcquired() bool {
+	return false
+}
+
+// Owner returns an empty string
+func (lock *FileLock) Owner() string {
+	return ""
+}
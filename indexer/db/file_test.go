@@ -0,0 +1,278 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddBlock(t *testing.T) {
+	cases := []struct {
+		name    string
+		ranges  []blockRange
+		blockNo uint64
+		want    []blockRange
+	}{
+		{"Empty", nil, 5, []blockRange{{5, 5}}},
+		{"Before", []blockRange{{5, 7}}, 2, []blockRange{{2, 2}, {5, 7}}},
+		{"After", []blockRange{{5, 7}}, 9, []blockRange{{5, 7}, {9, 9}}},
+		{"Between", []blockRange{{1, 2}, {8, 9}}, 5, []blockRange{{1, 2}, {5, 5}, {8, 9}}},
+		{"ExtendsStart", []blockRange{{5, 7}}, 4, []blockRange{{4, 7}}},
+		{"ExtendsEnd", []blockRange{{5, 7}}, 8, []blockRange{{5, 8}}},
+		{"MergesAdjacent", []blockRange{{1, 3}, {5, 7}}, 4, []blockRange{{1, 7}}},
+		{"Contained", []blockRange{{1, 3}, {5, 7}}, 6, []blockRange{{1, 3}, {5, 7}}},
+		{"Zero", []blockRange{{1, 3}}, 0, []blockRange{{0, 3}}},
+	}
+	for _, c := range cases {
+		if got := addBlock(append([]blockRange(nil), c.ranges...), c.blockNo); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestRemoveBlocks(t *testing.T) {
+	cases := []struct {
+		name     string
+		ranges   []blockRange
+		from, to uint64
+		want     []blockRange
+		removed  uint64
+	}{
+		{"Outside", []blockRange{{5, 7}}, 1, 4, []blockRange{{5, 7}}, 0},
+		{"Whole", []blockRange{{5, 7}}, 5, 7, []blockRange{}, 3},
+		{"Splits", []blockRange{{1, 10}}, 4, 6, []blockRange{{1, 3}, {7, 10}}, 3},
+		{"Start", []blockRange{{1, 10}}, 0, 3, []blockRange{{4, 10}}, 3},
+		{"End", []blockRange{{1, 10}}, 8, 20, []blockRange{{1, 7}}, 3},
+		{"AcrossRanges", []blockRange{{1, 3}, {5, 7}, {9, 12}}, 2, 10, []blockRange{{1, 1}, {11, 12}}, 7},
+	}
+	for _, c := range cases {
+		got, removed := removeBlocks(c.ranges, c.from, c.to)
+		if fmt.Sprint(got) != fmt.Sprint(c.want) || removed != c.removed {
+			t.Errorf("%s: expected %v with %d removed, got %v with %d removed", c.name, c.want, c.removed, got, removed)
+		}
+	}
+}
+
+func TestClipBlocks(t *testing.T) {
+	ranges := []blockRange{{1, 3}, {5, 7}, {9, 12}}
+	cases := []struct {
+		name  string
+		limit *IntegerRangeQuery
+		want  []blockRange
+		count uint64
+	}{
+		{"NoLimit", nil, []blockRange{{1, 3}, {5, 7}, {9, 12}}, 10},
+		{"OtherField", &IntegerRangeQuery{Field: "blockno", Min: 2, Max: 2}, []blockRange{{1, 3}, {5, 7}, {9, 12}}, 10},
+		{"Inside", &IntegerRangeQuery{Field: "no", Min: 6, Max: 6}, []blockRange{{6, 6}}, 1},
+		{"Across", &IntegerRangeQuery{Field: "no", Min: 2, Max: 10}, []blockRange{{2, 3}, {5, 7}, {9, 10}}, 7},
+		{"Gap", &IntegerRangeQuery{Field: "no", Min: 4, Max: 4}, []blockRange{}, 0},
+	}
+	for _, c := range cases {
+		got := clipBlocks(ranges, c.limit)
+		if fmt.Sprint(got) != fmt.Sprint(c.want) || countBlocks(got) != c.count {
+			t.Errorf("%s: expected %v (%d blocks), got %v (%d blocks)", c.name, c.want, c.count, got, countBlocks(got))
+		}
+	}
+	if fmt.Sprint(ranges) != "[{1 3} {5 7} {9 12}]" {
+		t.Errorf("expected ranges to be left unchanged, got %v", ranges)
+	}
+}
+
+// newTestFileDbController creates a FileDbController in a new temporary directory
+func newTestFileDbController(t *testing.T, options string) (*FileDbController, string) {
+	dir, err := ioutil.TempDir("", "indexer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller, err := NewFileDbController(dir + options)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return controller, dir
+}
+
+// readDataFile returns the lines of a complete data file
+func readDataFile(t *testing.T, path string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestFileDbControllerStateRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	controller, dir := newTestFileDbController(t, "")
+	defer os.RemoveAll(dir)
+
+	indexName := createTestIndex(t, controller, "test_", 8)
+	if _, err := controller.Delete(ctx, QueryParams{IndexName: indexName, IntegerRange: &IntegerRangeQuery{Field: "no", Min: 4, Max: 5}}); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := controller.UpdateAliases(ctx, map[string]string{"test_alias_block": indexName}); err != nil {
+		t.Fatalf("UpdateAliases: %v", err)
+	}
+	if err := controller.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reopened, err := NewFileDbController(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	got := scrollBlockNumbers(t, reopened.Scroll(ctx, QueryParams{IndexName: indexName, SortAsc: true}, createTestBlock))
+	if want := []uint64{1, 2, 3, 6, 7, 8}; !equalBlockNumbers(got, want) {
+		t.Fatalf("expected blocks %v after reopening, got %v", want, got)
+	}
+	document, err := reopened.SelectOne(ctx, QueryParams{IndexName: indexName, SortField: "no"}, createTestBlock)
+	if err != nil || document == nil || document.GetID() != "test_8" {
+		t.Fatalf("expected best block test_8 after reopening, got %v (%v)", document, err)
+	}
+	if exists, indexPrefix, err := reopened.GetExistingIndexPrefix(ctx, "test_alias_block", "block"); err != nil || !exists || indexPrefix != "test_" {
+		t.Fatalf("expected alias to be restored, got %v %s (%v)", exists, indexPrefix, err)
+	}
+
+	// Files are numbered after the existing ones
+	if _, err := reopened.Insert(ctx, testBlock("test_9", 9, "odd"), UpdateParams{IndexName: indexName, TypeName: "block"}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if writer := reopened.files[indexName]; writer == nil || filepath.Base(writer.path) != "000000000002.ndjson.gz" {
+		t.Fatalf("expected a second data file, got %+v", writer)
+	}
+}
+
+func TestFileDbControllerRecoversTruncatedFile(t *testing.T) {
+	ctx := context.Background()
+	controller, dir := newTestFileDbController(t, "")
+	defer os.RemoveAll(dir)
+
+	indexName := createTestIndex(t, controller, "test_", 3)
+	controller.mutex.Lock()
+	if err := controller.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	path := controller.files[indexName].path
+	info, err := os.Stat(path + filePartSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller.mutex.Unlock()
+	for blockNo := uint64(4); blockNo <= 6; blockNo++ {
+		if _, err := controller.Insert(ctx, testBlock(fmt.Sprintf("test_%d", blockNo), blockNo, "late"), UpdateParams{IndexName: indexName, TypeName: "block"}); err != nil {
+			t.Fatalf("Insert(%d): %v", blockNo, err)
+		}
+	}
+	controller.mutex.Lock()
+	if err := controller.files[indexName].flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Crash in the middle of writing what was flushed last
+	close(controller.done)
+	controller.files[indexName].file.Close()
+	controller.mutex.Unlock()
+	if err := os.Truncate(path+filePartSuffix, info.Size()+5); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := NewFileDbController(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	if _, err := os.Stat(path + filePartSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expected incomplete file to be completed, got %v", err)
+	}
+	lines := readDataFile(t, path)
+	if len(lines) != 3 {
+		t.Fatalf("expected the 3 documents flushed with the state, got %v", lines)
+	}
+	for _, line := range lines {
+		var decoded fileLine
+		if err := json.Unmarshal([]byte(line), &decoded); err != nil || decoded.Op != "create" {
+			t.Fatalf("expected complete document lines, got %s (%v)", line, err)
+		}
+	}
+}
+
+func TestFileDbControllerBulkQueries(t *testing.T) {
+	ctx := context.Background()
+	controller, dir := newTestFileDbController(t, "?format=bulk")
+	defer os.RemoveAll(dir)
+
+	indexName := createTestIndex(t, controller, "test_", 2)
+	for i := 0; i < 2; i++ {
+		if _, err := controller.UpdateField(ctx, QueryParams{IndexName: indexName, IntegerRange: &IntegerRangeQuery{Field: "no", Min: 1, Max: 1}}, "confirmed", true); err != nil {
+			t.Fatalf("UpdateField: %v", err)
+		}
+	}
+	if _, err := controller.Delete(ctx, QueryParams{IndexName: indexName, IntegerRange: &IntegerRangeQuery{Field: "no", Min: 2, Max: 2}}); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := controller.Insert(ctx, testBlock("test_2b", 2, "even"), UpdateParams{IndexName: indexName, TypeName: "block"}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if err := controller.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, indexName, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataPath := filepath.Join(dir, indexName, "000000000001"+fileBulkExtension)
+	queriesPath := filepath.Join(dir, indexName, "000000000001"+fileQueriesExtension)
+	if fmt.Sprint(files) != fmt.Sprint([]string{dataPath, queriesPath}) {
+		t.Fatalf("expected one data file and its queries file, got %v", files)
+	}
+	if lines := readDataFile(t, dataPath); len(lines) != 6 {
+		t.Fatalf("expected 3 actions with their sources, got %v", lines)
+	}
+
+	content, err := ioutil.ReadFile(queriesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries []fileQueryLine
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		var query fileQueryLine
+		if err := json.Unmarshal(scanner.Bytes(), &query); err != nil {
+			t.Fatalf("invalid query line %s: %v", scanner.Text(), err)
+		}
+		queries = append(queries, query)
+	}
+	want := []struct {
+		after int
+		op    string
+	}{{2, "update_by_query"}, {2, "update_by_query"}, {2, "delete_by_query"}}
+	if len(queries) != len(want) {
+		t.Fatalf("expected %d queries, got %+v", len(want), queries)
+	}
+	for i, query := range queries {
+		if query.After != want[i].after || query.Op != want[i].op || query.Body["query"] == nil {
+			t.Errorf("expected %s after %d actions, got %+v", want[i].op, want[i].after, query)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package db
+
+// Filter is a condition on documents that every DbController translates into its own query language.
+// Filters are built with And, Or, Not, Term, Terms, and Range, and can be nested.
+type Filter interface {
+	isFilter()
+}
+
+// AndFilter matches documents matching all of its filters. Without filters, it matches all documents
+type AndFilter struct {
+	Filters []Filter
+}
+
+// OrFilter matches documents matching any of its filters. Without filters, it matches no documents
+type OrFilter struct {
+	Filters []Filter
+}
+
+// NotFilter matches documents not matching its filter
+type NotFilter struct {
+	Filter Filter
+}
+
+// TermFilter matches documents whose field equals value
+type TermFilter struct {
+	Field string
+	Value interface{}
+}
+
+// TermsFilter matches documents whose field equals any of values
+type TermsFilter struct {
+	Field  string
+	Values []interface{}
+}
+
+// RangeFilter matches documents whose field is within [Min, Max]. A nil bound is open
+type RangeFilter struct {
+	Field string
+	Min   interface{}
+	Max   interface{}
+}
+
+func (AndFilter) isFilter()   {}
+func (OrFilter) isFilter()    {}
+func (NotFilter) isFilter()   {}
+func (TermFilter) isFilter()  {}
+func (TermsFilter) isFilter() {}
+func (RangeFilter) isFilter() {}
+
+// And combines filters that all have to match
+func And(filters ...Filter) Filter {
+	return AndFilter{Filters: filters}
+}
+
+// Or combines filters of which any has to match
+func Or(filters ...Filter) Filter {
+	return OrFilter{Filters: filters}
+}
+
+// Not negates a filter
+func Not(filter Filter) Filter {
+	return NotFilter{Filter: filter}
+}
+
+// Term matches documents whose field equals value
+func Term(field string, value interface{}) Filter {
+	return TermFilter{Field: field, Value: value}
+}
+
+// Terms matches documents whose field equals any of values
+func Terms(field string, values ...interface{}) Filter {
+	return TermsFilter{Field: field, Values: values}
+}
+
+// Range matches documents whose field is within [min, max]. Pass nil for an open bound
+func Range(field string, min interface{}, max interface{}) Filter {
+	return RangeFilter{Field: field, Min: min, Max: max}
+}
+
+// filter returns the conditions of the query params combined into one filter, or nil if there are none.
+// IntegerRange and StringMatch are shorthands for a Range and a Term filter.
+func (params QueryParams) filter() Filter {
+	filters := make([]Filter, 0)
+	if params.IntegerRange != nil {
+		filters = append(filters, Range(params.IntegerRange.Field, params.IntegerRange.Min, params.IntegerRange.Max))
+	}
+	if params.StringMatch != nil {
+		filters = append(filters, Term(params.StringMatch.Field, params.StringMatch.Value))
+	}
+	if params.Filter != nil {
+		filters = append(filters, params.Filter)
+	}
+	switch len(filters) {
+	case 0:
+		return nil
+	case 1:
+		return filters[0]
+	}
+	return And(filters...)
+}
@@ -3,25 +3,62 @@ package db
 import (
 	"context"
 	"database/sql"
-	"errors"
+	"database/sql/driver"
 	"fmt"
 	"io"
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	doc "github.com/aergoio/aergo-indexer/indexer/documents"
 
-	// import mysql driver
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 )
 
+const (
+	// mariaAliasTable records which table each view pointed to over time. The latest entry of a view is its current table
+	mariaAliasTable  = "indexer_aliases"
+	mariaAliasSchema = `
+		CREATE TABLE IF NOT EXISTS ` + "`" + mariaAliasTable + "`" + ` (
+			alias_name VARCHAR(128) NOT NULL,
+			index_name VARCHAR(128) NOT NULL,
+			swapped_at DATETIME(6) NOT NULL,
+			PRIMARY KEY (alias_name, index_name)
+		);`
+	// mysqlErrDupEntry is the error number of a duplicate key
+	mysqlErrDupEntry = 1062
+	// mysqlErrNoSuchTable is the error number of a missing table or view
+	mysqlErrNoSuchTable = 1146
+	// mysqlErrTooManyConnections is the error number of a server that is out of connections
+	mysqlErrTooManyConnections = 1040
+	// mysqlErrLockWaitTimeout and mysqlErrLockDeadlock are the error numbers of transactions aborted due to lock contention
+	mysqlErrLockWaitTimeout = 1205
+	mysqlErrLockDeadlock    = 1213
+	// retainedGenerations is the number of previous tables kept per view after swapping, so a reindex can be rolled back manually
+	retainedGenerations = 1
+)
+
+// mariaSchemaDialect contains the queries for migrating MariaDB tables
+var mariaSchemaDialect = sqlSchemaDialect{
+	columnsQuery:      "SELECT column_name FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ?",
+	indexesQuery:      "SELECT DISTINCT index_name FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ?",
+	storeVersionQuery: "INSERT INTO " + schemaVersionTable + " (index_name, version) VALUES (?, ?) ON DUPLICATE KEY UPDATE version = VALUES(version)",
+}
+
+// mariaViewSourcePattern matches the table name in a view definition
+var mariaViewSourcePattern = regexp.MustCompile("from `[^`]*`\\.`([^`]*)`")
+
 // MariaDbController implements DbController
 type MariaDbController struct {
 	Client *sqlx.DB
+
+	partitioning    *Partitioning
+	partitionBounds map[string]uint64 // upper bound of the last partition before the catch-all partition by table
+	partitionMutex  sync.Mutex
 }
 
 // NewMariaDbController creates a new instance of ElasticsearchDbController
@@ -30,6 +67,15 @@ func NewMariaDbController(dbURL string) (*MariaDbController, error) {
 	if err != nil {
 		return nil, err
 	}
+	if _, err := client.Exec(mariaAliasSchema); err != nil {
+		return nil, err
+	}
+	if _, err := client.Exec(mariaLockSchema); err != nil {
+		return nil, err
+	}
+	if _, err := client.Exec(schemaVersionSchema); err != nil {
+		return nil, err
+	}
 	return &MariaDbController{
 		Client: client,
 	}, nil
@@ -72,32 +118,57 @@ func booleanSortOrderToSql(orderAsc bool) string {
 	return sortOrder
 }
 
-// IsConflict returns if error is due to a conflict
-func (mdb *MariaDbController) IsConflict(err interface{}) bool {
-	return false // TODO: Not implemented
+func quoteMariaIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// mariaErrorKind classifies errors of the MySQL driver. Duplicate keys are conflicts, i.e. a document with the same id was inserted by another instance,
+// and transactions aborted due to lock contention can be retried
+func mariaErrorKind(err error) ErrorKind {
+	if err == driver.ErrBadConn || err == mysql.ErrInvalidConn {
+		return KindTransient
+	}
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	if !ok {
+		return KindPermanent
+	}
+	switch mysqlErr.Number {
+	case mysqlErrDupEntry:
+		return KindConflict
+	case mysqlErrNoSuchTable:
+		return KindNotFound
+	case mysqlErrLockDeadlock, mysqlErrLockWaitTimeout, mysqlErrTooManyConnections:
+		return KindTransient
+	}
+	return KindPermanent
+}
+
+// wrapError classifies an error of the MySQL driver
+func (mdb *MariaDbController) wrapError(err error) error {
+	return wrapError(err, mariaErrorKind)
 }
 
 // Insert inserts a single document using the updata params
 // It returns the number of inserted documents (1) or an error
-func (mdb MariaDbController) Insert(document doc.DocType, params UpdateParams) (uint64, error) {
+func (mdb *MariaDbController) Insert(ctx context.Context, document doc.DocType, params UpdateParams) (uint64, error) {
 	fields, binds := prepareFieldsAndBinds(document)
 	method := "INSERT"
 	if params.Upsert {
 		method = "REPLACE"
 	}
 	query := fmt.Sprintf("%s INTO `%s` (%s) VALUES (%s)", method, params.IndexName, strings.Join(fields, ","), strings.Join(binds, ","))
-	result, err := mdb.Client.NamedExec(query, document)
+	result, err := mdb.insertDocuments(ctx, query, []doc.DocType{document}, params)
 	if err != nil {
-		return 0, err
+		return 0, mdb.wrapError(err)
 	}
 	rowsAffected, _ := result.RowsAffected()
 	return uint64(rowsAffected), nil
 }
 
 // InsertBulk inserts documents arriving in documentChannel in bulk using the updata params
+// It commits all documents until documentChannel is closed, unless ctx is cancelled
 // It returns the number of inserted documents or an error
-func (mdb MariaDbController) InsertBulk(documentChannel chan doc.DocType, params UpdateParams) (uint64, error) {
-	ctx := context.Background()
+func (mdb *MariaDbController) InsertBulk(ctx context.Context, documentChannel chan doc.DocType, params UpdateParams) (uint64, error) {
 	var fields []string
 	var binds []string
 	method := "INSERT"
@@ -113,10 +184,10 @@ func (mdb MariaDbController) InsertBulk(documentChannel chan doc.DocType, params
 		if len(bulk) == 0 {
 			return nil
 		}
-		result, err := mdb.Client.NamedExec(query, bulk)
+		result, err := mdb.insertDocuments(ctx, query, bulk, params)
 		if err != nil {
 			logger.Error().Err(err).Int("chunkSize", params.Size).Str("indexName", params.IndexName).Msg("Error while committing bulk")
-			return err
+			return mdb.wrapError(err)
 		}
 		rowsAffected, _ := result.RowsAffected()
 		atomic.AddUint64(&total, uint64(rowsAffected))
@@ -142,7 +213,7 @@ func (mdb MariaDbController) InsertBulk(documentChannel chan doc.DocType, params
 		select {
 		default:
 		case <-ctx.Done():
-			return total, ctx.Err()
+			return total, mdb.wrapError(ctx.Err())
 		}
 	}
 	// Commit the final batch before exiting
@@ -152,106 +223,237 @@ func (mdb MariaDbController) InsertBulk(documentChannel chan doc.DocType, params
 	return total, nil
 }
 
-// Delete removes documents specified by the query params
-func (mdb *MariaDbController) Delete(params QueryParams) (uint64, error) {
-	where := ""
-	if params.IntegerRange != nil {
-		where = fmt.Sprintf(
-			"WHERE `%s` >= %d AND `%s` <= %d",
-			params.IntegerRange.Field, params.IntegerRange.Min,
-			params.IntegerRange.Field, params.IntegerRange.Max,
-		)
+// WriteBatch writes the documents of all batch items in a single transaction, retrying on transient errors like deadlocks
+func (mdb *MariaDbController) WriteBatch(ctx context.Context, batch []BatchItem) error {
+	// Adding partitions implicitly commits, so it has to happen before the transaction
+	for _, item := range batch {
+		if err := mdb.ensureDocumentPartitions(ctx, item.Documents, item.Params); err != nil {
+			return err
+		}
 	}
-	if params.StringMatch != nil {
-		return 0, errors.New("Delete is not imlemented for string matches")
+	return retryTransient(ctx, mdb.wrapError, func() error {
+		txn, err := mdb.Client.BeginTxx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer txn.Rollback()
+		for _, item := range batch {
+			if len(item.Documents) == 0 {
+				continue
+			}
+			fields, binds := prepareFieldsAndBinds(item.Documents[0])
+			method := "INSERT IGNORE"
+			if item.Params.Upsert {
+				method = "REPLACE"
+			} else if item.FailOnConflict {
+				method = "INSERT"
+			}
+			query := fmt.Sprintf("%s INTO `%s` (%s) VALUES (%s)", method, item.Params.IndexName, strings.Join(fields, ","), strings.Join(binds, ","))
+			if mdb.isPartitioned(item.Params.TypeName) {
+				if err := deleteDocumentIds(ctx, txn, item.Params.IndexName, item.Documents); err != nil {
+					return err
+				}
+			}
+			if _, err := txn.NamedExecContext(ctx, query, item.Documents); err != nil {
+				return err
+			}
+		}
+		return txn.Commit()
+	})
+}
+
+// Delete removes documents specified by the query params
+func (mdb *MariaDbController) Delete(ctx context.Context, params QueryParams) (uint64, error) {
+	conditions, args := filterConditions(params, quoteMariaIdentifier)
+	query := fmt.Sprintf("DELETE FROM `%s` %s", params.IndexName, whereToSql(conditions))
+	result, err := mdb.Client.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, mdb.wrapError(err)
 	}
+	rowsAffected, _ := result.RowsAffected()
+	return uint64(rowsAffected), nil
+}
 
-	query := fmt.Sprintf("DELETE FROM `%s` %s", params.IndexName, where)
-	result, err := mdb.Client.Exec(query)
+// UpdateField sets field to value in all documents specified by the query params that don't have this value yet
+func (mdb *MariaDbController) UpdateField(ctx context.Context, params QueryParams, field string, value interface{}) (uint64, error) {
+	conditions, filterArgs := filterConditions(params, quoteMariaIdentifier)
+	conditions = append(conditions, quoteMariaIdentifier(field)+" <> ?")
+	args := append(append([]interface{}{value}, filterArgs...), value)
+	query := fmt.Sprintf("UPDATE `%s` SET `%s` = ? %s", params.IndexName, field, whereToSql(conditions))
+	result, err := mdb.Client.ExecContext(ctx, query, args...)
 	if err != nil {
-		return 0, err
+		return 0, mdb.wrapError(err)
 	}
 	rowsAffected, _ := result.RowsAffected()
 	return uint64(rowsAffected), nil
 }
 
-// Count returns the number of indexed documents
-func (mdb *MariaDbController) Count(params QueryParams) (int64, error) {
+// Count returns the number of documents matching the query params
+func (mdb *MariaDbController) Count(ctx context.Context, params QueryParams) (int64, error) {
 	var count int64
-	query := fmt.Sprintf("SELECT count(*) FROM `%s`", params.IndexName)
-	err := mdb.Client.Get(&count, query)
+	conditions, args := filterConditions(params, quoteMariaIdentifier)
+	query := fmt.Sprintf("SELECT count(*) FROM `%s` %s", params.IndexName, whereToSql(conditions))
+	err := mdb.Client.GetContext(ctx, &count, query, args...)
 	if err != nil {
-		return 0, err
+		return 0, mdb.wrapError(err)
 	}
 	return count, nil
 }
 
 // SelectOne selects a single document
-func (mdb *MariaDbController) SelectOne(params QueryParams, createDocument CreateDocFunction) (doc.DocType, error) {
+func (mdb *MariaDbController) SelectOne(ctx context.Context, params QueryParams, createDocument CreateDocFunction) (doc.DocType, error) {
+	conditions, args := filterConditions(params, quoteMariaIdentifier)
 	query := fmt.Sprintf(
-		"SELECT %s FROM `%s` ORDER BY `%s` %s LIMIT 1",
+		"SELECT %s FROM `%s` %s ORDER BY `%s` %s LIMIT %d, 1",
 		prepareSelectFields(params.SelectFields),
 		params.IndexName,
+		whereToSql(conditions),
 		params.SortField,
 		booleanSortOrderToSql(params.SortAsc),
+		params.From,
 	)
 	document := createDocument()
-	err := mdb.Client.Get(document, query)
+	err := mdb.Client.GetContext(ctx, document, query, args...)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
-		return nil, err
+		return nil, mdb.wrapError(err)
 	}
 	return document, nil
 }
 
-// UpdateAlias updates an alias with a new index name and delete stale indices
-func (mdb *MariaDbController) UpdateAlias(aliasName string, indexName string) error {
-	query := fmt.Sprintf("CREATE OR REPLACE VIEW `%s` AS SELECT * FROM `%s`;", aliasName, indexName)
-	_, err := mdb.Client.Exec(query)
-	// TODO: Delete old tables
-	return err
+// UpdateAlias updates an alias with a new index name and drops stale tables
+func (mdb *MariaDbController) UpdateAlias(ctx context.Context, aliasName string, indexName string) error {
+	return mdb.UpdateAliases(ctx, map[string]string{aliasName: indexName})
+}
+
+// viewExists returns whether a view exists in the current database
+func (mdb *MariaDbController) viewExists(ctx context.Context, viewName string) (bool, error) {
+	var count int
+	err := mdb.Client.GetContext(ctx, &count, "SELECT count(*) FROM information_schema.views WHERE table_schema = DATABASE() AND table_name = ?", viewName)
+	return count > 0, err
+}
+
+// UpdateAliases points several aliases to new index names at once and drops stale tables.
+// The new views are created next to the current ones and swapped in with a single RENAME, which is atomic,
+// so readers either see all old or all new tables.
+func (mdb *MariaDbController) UpdateAliases(ctx context.Context, aliases map[string]string) error {
+	renames := make([]string, 0)
+	oldViews := make([]string, 0)
+	for aliasName, indexName := range aliases {
+		newView, oldView := aliasName+"__new", aliasName+"__old"
+		if _, err := mdb.Client.ExecContext(ctx, fmt.Sprintf("DROP VIEW IF EXISTS `%s`", oldView)); err != nil {
+			return mdb.wrapError(err)
+		}
+		if _, err := mdb.Client.ExecContext(ctx, fmt.Sprintf("CREATE OR REPLACE VIEW `%s` AS SELECT * FROM `%s`", newView, indexName)); err != nil {
+			return mdb.wrapError(err)
+		}
+		exists, err := mdb.viewExists(ctx, aliasName)
+		if err != nil {
+			return mdb.wrapError(err)
+		}
+		if exists {
+			renames = append(renames, fmt.Sprintf("`%s` TO `%s`", aliasName, oldView))
+			oldViews = append(oldViews, "`"+oldView+"`")
+		}
+		renames = append(renames, fmt.Sprintf("`%s` TO `%s`", newView, aliasName))
+	}
+	if _, err := mdb.Client.ExecContext(ctx, "RENAME TABLE "+strings.Join(renames, ", ")); err != nil {
+		return mdb.wrapError(err)
+	}
+	if len(oldViews) > 0 {
+		if _, err := mdb.Client.ExecContext(ctx, "DROP VIEW IF EXISTS "+strings.Join(oldViews, ", ")); err != nil {
+			logger.Warn().Err(err).Msg("Failed to drop previous views")
+		}
+	}
+
+	swappedAt := time.Now().UTC()
+	for aliasName, indexName := range aliases {
+		query := fmt.Sprintf("INSERT INTO `%s` (alias_name, index_name, swapped_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE swapped_at = VALUES(swapped_at)", mariaAliasTable)
+		if _, err := mdb.Client.ExecContext(ctx, query, aliasName, indexName, swappedAt); err != nil {
+			return mdb.wrapError(err)
+		}
+		if err := mdb.dropStaleGenerations(ctx, aliasName); err != nil {
+			logger.Warn().Err(err).Str("aliasName", aliasName).Msg("Failed to drop previous tables")
+		}
+	}
+	return nil
+}
+
+// dropStaleGenerations drops the tables an alias pointed to before, except for the latest retainedGenerations
+func (mdb *MariaDbController) dropStaleGenerations(ctx context.Context, aliasName string) error {
+	var indexNames []string
+	query := fmt.Sprintf("SELECT index_name FROM `%s` WHERE alias_name = ? ORDER BY swapped_at DESC, index_name DESC", mariaAliasTable)
+	if err := mdb.Client.SelectContext(ctx, &indexNames, query, aliasName); err != nil {
+		return err
+	}
+	if len(indexNames) <= 1+retainedGenerations {
+		return nil
+	}
+	for _, indexName := range indexNames[1+retainedGenerations:] {
+		if _, err := mdb.Client.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS `%s`", indexName)); err != nil {
+			return err
+		}
+		query := fmt.Sprintf("DELETE FROM `%s` WHERE alias_name = ? AND index_name = ?", mariaAliasTable)
+		if _, err := mdb.Client.ExecContext(ctx, query, aliasName, indexName); err != nil {
+			return err
+		}
+		logger.Info().Str("aliasName", aliasName).Str("indexName", indexName).Msg("Dropped previous table")
+	}
+	return nil
 }
 
 // GetExistingIndexPrefix checks for existing indices and returns the prefix, if any
-func (mdb *MariaDbController) GetExistingIndexPrefix(aliasName string, documentType string) (bool, string, error) {
-	// Get list of views
+// The current table is read from the alias table. Views created before it existed are looked up by their definition.
+func (mdb *MariaDbController) GetExistingIndexPrefix(ctx context.Context, aliasName string, documentType string) (bool, string, error) {
 	var tableName string
-	query := fmt.Sprintf(`
-		select 
-		case 
-			when view_definition regexp '.*from +.*'
-			then substring_index(substring_index(view_definition, 'from ', -1), ' ', 1)
-		end as 'table_name'
-		from information_schema.views where table_name LIKE "%%_%s"`, documentType)
-	err := mdb.Client.Get(&tableName, query)
+	query := fmt.Sprintf("SELECT index_name FROM `%s` WHERE alias_name = ? ORDER BY swapped_at DESC, index_name DESC LIMIT 1", mariaAliasTable)
+	err := mdb.Client.GetContext(ctx, &tableName, query, aliasName)
 	if err == sql.ErrNoRows {
-		return false, "", nil
-	}
-	if err != nil {
-		return false, "", err
+		var definition string
+		err = mdb.Client.GetContext(ctx, &definition, "SELECT view_definition FROM information_schema.views WHERE table_schema = DATABASE() AND table_name = ?", aliasName)
+		if err == sql.ErrNoRows {
+			return false, "", nil
+		}
+		if err != nil {
+			return false, "", mdb.wrapError(err)
+		}
+		matches := mariaViewSourcePattern.FindStringSubmatch(definition)
+		if len(matches) < 2 {
+			return false, "", fmt.Errorf("could not find table in view definition %s", definition)
+		}
+		tableName = matches[1]
+	} else if err != nil {
+		return false, "", mdb.wrapError(err)
 	}
-	// Extract table name from view definition
-	re := regexp.MustCompile(fmt.Sprintf("\\.`(.*?)%s", documentType))
-	matches := re.FindStringSubmatch(tableName)
-	if len(matches) > 1 {
-		return true, matches[1], nil
+	if !strings.HasSuffix(tableName, documentType) {
+		return false, "", fmt.Errorf("could not match table prefix in %s", tableName)
 	}
-	return false, "", fmt.Errorf("could not match table prefix in %s", tableName)
+	return true, strings.TrimSuffix(tableName, documentType), nil
 }
 
 // CreateIndex creates index according to documentType definition
-func (mdb *MariaDbController) CreateIndex(indexName string, documentType string) error {
+func (mdb *MariaDbController) CreateIndex(ctx context.Context, indexName string, documentType string) error {
 	statement := strings.Replace(doc.SQLSchemas[documentType], "%indexName%", indexName, -1)
-	_, err := mdb.Client.Exec(statement)
-	return err
+	if mdb.isPartitioned(documentType) {
+		statement = mariaPartitionedSchema(statement, mdb.partitioning.Blocks)
+	}
+	if _, err := mdb.Client.ExecContext(ctx, statement); err != nil {
+		return mdb.wrapError(err)
+	}
+	return mdb.wrapError(storeSchemaVersion(ctx, mdb.Client, mariaSchemaDialect, indexName, documentType))
+}
+
+// MigrateIndex adds missing columns and indexes of documentType's schema to an existing table
+func (mdb *MariaDbController) MigrateIndex(ctx context.Context, indexName string, documentType string) error {
+	return mdb.wrapError(migrateTable(ctx, mdb.Client, mariaSchemaDialect, indexName, documentType, doc.SQLSchemas[documentType]))
 }
 
 // Scroll creates a new scroll instance with the specified query and unmarshal function
-func (mdb *MariaDbController) Scroll(params QueryParams, createDocument CreateDocFunction) ScrollInstance {
+func (mdb *MariaDbController) Scroll(ctx context.Context, params QueryParams, createDocument CreateDocFunction) ScrollInstance {
 	return &MariaScrollInstance{
-		ctx:            context.Background(),
+		ctx:            ctx,
 		createDocument: createDocument,
 		client:         mdb.Client,
 		params:         params,
@@ -277,18 +479,20 @@ func (scroll *MariaScrollInstance) Next() (doc.DocType, error) {
 	hasNext := scroll.result != nil && scroll.result.Next()
 	finishedCurrentPage := !hasNext && scroll.current >= scroll.params.Size
 	if scroll.result == nil || finishedCurrentPage {
+		conditions, args := filterConditions(scroll.params, quoteMariaIdentifier)
 		query := fmt.Sprintf(
-			"SELECT %s FROM `%s` ORDER BY `%s` %s LIMIT %d, %d",
+			"SELECT %s FROM `%s` %s ORDER BY `%s` %s LIMIT %d, %d",
 			prepareSelectFields(scroll.params.SelectFields),
 			scroll.params.IndexName,
+			whereToSql(conditions),
 			scroll.params.SortField,
 			booleanSortOrderToSql(scroll.params.SortAsc),
 			scroll.currentFrom,
 			scroll.params.Size,
 		)
-		result, err := scroll.client.Queryx(query)
+		result, err := scroll.client.QueryxContext(scroll.ctx, query, args...)
 		if err != nil {
-			return nil, err
+			return nil, wrapError(err, mariaErrorKind)
 		}
 		scroll.result = result
 		scroll.current = 0
@@ -301,7 +505,7 @@ func (scroll *MariaScrollInstance) Next() (doc.DocType, error) {
 		scroll.current++
 		err := scroll.result.StructScan(doc)
 		if err != nil {
-			return nil, err
+			return nil, wrapError(err, mariaErrorKind)
 		}
 		return doc, nil
 	}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// mariaLockTable holds one lease row per lock
+	mariaLockTable  = "indexer_locks"
+	mariaLockSchema = `
+		CREATE TABLE IF NOT EXISTS ` + "`" + mariaLockTable + "`" + ` (
+			name VARCHAR(128) NOT NULL,
+			owner VARCHAR(128) NOT NULL,
+			expires_at DATETIME(6) NOT NULL,
+			PRIMARY KEY (name)
+		);`
+)
+
+// MariaLock is a distributed lock based on a lease row that expires unless it is kept alive.
+// Expiry is based on the database's clock, so the clocks of the indexer hosts don't matter.
+type MariaLock struct {
+	owner     string
+	name      string
+	client    *sqlx.DB
+	ttl       time.Duration
+	expiresAt time.Time
+	stop      context.CancelFunc
+	mutex     sync.Mutex
+}
+
+// NewLock creates a lock with the given name. Instances using the same name exclude each other
+func (mdb *MariaDbController) NewLock(name string) Locker {
+	hostname, _ := os.Hostname()
+	random := make([]byte, 4)
+	rand.Read(random)
+	return &MariaLock{
+		owner:  fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(random)),
+		name:   name,
+		client: mdb.Client,
+	}
+}
+
+// Acquire takes the lock for ttl, if it is free, expired, or already held by this owner
+func (lock *MariaLock) Acquire(ctx context.Context, ttl time.Duration) error {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+	// Assignments are evaluated in order, so expires_at sees the updated owner
+	query := fmt.Sprintf(`
+		INSERT INTO `+"`%s`"+` (name, owner, expires_at) VALUES (?, ?, NOW(6) + INTERVAL ? MICROSECOND)
+		ON DUPLICATE KEY UPDATE
+			owner = IF(expires_at < NOW(6) OR owner = VALUES(owner), VALUES(owner), owner),
+			expires_at = IF(owner = VALUES(owner), VALUES(expires_at), expires_at)`, mariaLockTable)
+	begin := time.Now()
+	if _, err := lock.client.ExecContext(ctx, query, lock.name, lock.owner, int64(ttl/time.Microsecond)); err != nil {
+		return err
+	}
+	var owner string
+	if err := lock.client.GetContext(ctx, &owner, fmt.Sprintf("SELECT owner FROM `%s` WHERE name = ?", mariaLockTable), lock.name); err != nil {
+		return err
+	}
+	if owner != lock.owner {
+		return fmt.Errorf("lock %s is held by %s", lock.name, owner)
+	}
+	lock.ttl = ttl
+	lock.expiresAt = begin.Add(ttl)
+	return nil
+}
+
+// refresh extends the lease by its ttl. It fails if the lock was lost in the meantime
+func (lock *MariaLock) refresh(ctx context.Context) error {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+	begin := time.Now()
+	query := fmt.Sprintf("UPDATE `%s` SET expires_at = NOW(6) + INTERVAL ? MICROSECOND WHERE name = ? AND owner = ?", mariaLockTable)
+	result, err := lock.client.ExecContext(ctx, query, int64(lock.ttl/time.Microsecond), lock.name, lock.owner)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		lock.expiresAt = time.Time{}
+		return errors.New("lock was taken over")
+	}
+	lock.expiresAt = begin.Add(lock.ttl)
+	return nil
+}
+
+// KeepAlive refreshes the lease every interval in the background until the lock is released, lost, or ctx is cancelled
+func (lock *MariaLock) KeepAlive(ctx context.Context, interval time.Duration) {
+	ctx, cancel := context.WithCancel(ctx)
+	lock.mutex.Lock()
+	if lock.stop != nil {
+		lock.stop()
+	}
+	lock.stop = cancel
+	lock.mutex.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return
+			}
+			if err := lock.refresh(ctx); err != nil {
+				logger.Warn().Err(err).Str("lock", lock.name).Msg("Failed to keep lock alive")
+				if !lock.IsAcquired() {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Owner returns the unique name of this lock instance
+func (lock *MariaLock) Owner() string {
+	return lock.owner
+}
+
+// IsAcquired returns whether the lease is held and has not expired
+func (lock *MariaLock) IsAcquired() bool {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+	return time.Now().Before(lock.expiresAt)
+}
+
+// Release stops keeping the lock alive and releases it. It fails if the lock was not held
+func (lock *MariaLock) Release() error {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+	if lock.stop != nil {
+		lock.stop()
+		lock.stop = nil
+	}
+	lock.expiresAt = time.Time{}
+	query := fmt.Sprintf("DELETE FROM `%s` WHERE name = ? AND owner = ?", mariaLockTable)
+	result, err := lock.client.Exec(query, lock.name, lock.owner)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("lock was not held")
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+	"github.com/jmoiron/sqlx"
+)
+
+// SetPartitioning enables native range partitioning on blockno for the tables of PartitionedTypes.
+// Only block ranges are supported, as the tables are partitioned by block number.
+func (mdb *MariaDbController) SetPartitioning(partitioning *Partitioning) error {
+	if partitioning != nil && partitioning.Monthly {
+		return errors.New("MariaDB tables can only be partitioned by block range")
+	}
+	mdb.partitioning = partitioning
+	return nil
+}
+
+// isPartitioned returns whether the tables of typeName are partitioned
+func (mdb *MariaDbController) isPartitioned(typeName string) bool {
+	return mdb.partitioning != nil && isPartitionedType(typeName)
+}
+
+// mariaPartition returns the definition of the partition of blocks [from, to)
+func mariaPartition(from uint64, to uint64) string {
+	return fmt.Sprintf("PARTITION p%d VALUES LESS THAN (%d)", from, to)
+}
+
+// mariaPartitionedSchema adapts a table schema to range partitioning on blockno.
+// Every unique key of a partitioned table has to include blockno, so the id is only unique together with it.
+// Writes keep ids unique by deleting rows with the same id first, see insertDocuments.
+func mariaPartitionedSchema(statement string, blocks uint64) string {
+	statement = strings.Replace(statement, "NOT NULL UNIQUE", "NOT NULL", 1)
+	statement = strings.Replace(statement, "PRIMARY KEY (id)", "PRIMARY KEY (id, blockno)", 1)
+	statement = strings.TrimSuffix(strings.TrimSpace(statement), ";")
+	return fmt.Sprintf("%s PARTITION BY RANGE (blockno) (%s, PARTITION pmax VALUES LESS THAN MAXVALUE);", statement, mariaPartition(0, blocks))
+}
+
+// ensurePartitions splits the catch-all partition of a table so that blockNo has its own partition.
+// Blocks between the last partition and the one of blockNo share a single partition, as a table can only have 8192 partitions.
+func (mdb *MariaDbController) ensurePartitions(ctx context.Context, tableName string, blockNo uint64) error {
+	mdb.partitionMutex.Lock()
+	defer mdb.partitionMutex.Unlock()
+	bound, ok := mdb.partitionBounds[tableName]
+	if !ok {
+		var description sql.NullInt64
+		query := "SELECT MAX(CAST(partition_description AS UNSIGNED)) FROM information_schema.partitions WHERE table_schema = DATABASE() AND table_name = ? AND partition_description <> 'MAXVALUE'"
+		if err := mdb.Client.GetContext(ctx, &description, query, tableName); err != nil {
+			return mdb.wrapError(err)
+		}
+		bound = math.MaxUint64 // Tables created without partitioning stay unpartitioned
+		if description.Valid {
+			bound = uint64(description.Int64)
+		}
+		if mdb.partitionBounds == nil {
+			mdb.partitionBounds = make(map[string]uint64)
+		}
+		mdb.partitionBounds[tableName] = bound
+	}
+	if blockNo < bound {
+		return nil
+	}
+	partitions := make([]string, 0, 3)
+	from := blockNo / mdb.partitioning.Blocks * mdb.partitioning.Blocks
+	if from > bound {
+		partitions = append(partitions, mariaPartition(bound, from))
+	} else {
+		from = bound
+	}
+	bound = from + mdb.partitioning.Blocks
+	partitions = append(partitions, mariaPartition(from, bound))
+	partitions = append(partitions, "PARTITION pmax VALUES LESS THAN MAXVALUE")
+	query := fmt.Sprintf("ALTER TABLE `%s` REORGANIZE PARTITION pmax INTO (%s)", tableName, strings.Join(partitions, ", "))
+	if _, err := mdb.Client.ExecContext(ctx, query); err != nil {
+		logger.Warn().Err(err).Str("indexName", tableName).Msg("Failed to add partitions")
+		return mdb.wrapError(err)
+	}
+	logger.Info().Str("indexName", tableName).Int("partitions", len(partitions)-1).Uint64("upTo", bound).Msg("Added partitions")
+	mdb.partitionBounds[tableName] = bound
+	return nil
+}
+
+// ensureDocumentPartitions makes sure that the partitions of the given documents exist
+func (mdb *MariaDbController) ensureDocumentPartitions(ctx context.Context, documents []doc.DocType, params UpdateParams) error {
+	if !mdb.isPartitioned(params.TypeName) {
+		return nil
+	}
+	if blockNo, ok := maxBlockNo(documents); ok {
+		return mdb.ensurePartitions(ctx, params.IndexName, blockNo)
+	}
+	return nil
+}
+
+// deleteDocumentIds deletes the rows with the ids of documents from a partitioned table
+func deleteDocumentIds(ctx context.Context, txn *sqlx.Tx, tableName string, documents []doc.DocType) error {
+	ids := make([]interface{}, 0, len(documents))
+	for _, document := range documents {
+		ids = append(ids, document.GetID())
+	}
+	binds := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	_, err := txn.ExecContext(ctx, fmt.Sprintf("DELETE FROM `%s` WHERE id IN (%s)", tableName, binds), ids...)
+	return err
+}
+
+// insertDocuments runs an insert query for documents. On partitioned tables, rows with the same ids are deleted first
+// in the same transaction, so an id stays unique although it is only part of the primary key
+func (mdb *MariaDbController) insertDocuments(ctx context.Context, query string, documents []doc.DocType, params UpdateParams) (sql.Result, error) {
+	if err := mdb.ensureDocumentPartitions(ctx, documents, params); err != nil {
+		return nil, err
+	}
+	if !mdb.isPartitioned(params.TypeName) {
+		return mdb.Client.NamedExecContext(ctx, query, documents)
+	}
+	txn, err := mdb.Client.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+	if err := deleteDocumentIds(ctx, txn, params.IndexName, documents); err != nil {
+		return nil, err
+	}
+	result, err := txn.NamedExecContext(ctx, query, documents)
+	if err != nil {
+		return nil, err
+	}
+	return result, txn.Commit()
+}
@@ -0,0 +1,480 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+)
+
+// memoryDocument holds the fields of a stored document, decoded from its json representation
+type memoryDocument map[string]interface{}
+
+// memoryIndex holds the documents of one index by id
+type memoryIndex map[string]memoryDocument
+
+// MemoryDbController implements DbController by keeping all documents in memory.
+// It behaves like Elasticsearch: indices are created on first insert, and replacing an alias deletes the indices it pointed to.
+type MemoryDbController struct {
+	indices  map[string]memoryIndex
+	aliases  map[string]string
+	versions map[string]int
+	mutex    sync.RWMutex
+}
+
+// NewMemoryDbController creates a new, empty instance of MemoryDbController
+func NewMemoryDbController() *MemoryDbController {
+	return &MemoryDbController{
+		indices:  make(map[string]memoryIndex),
+		aliases:  make(map[string]string),
+		versions: make(map[string]int),
+	}
+}
+
+// toMemoryDocument converts a document to its stored representation
+func toMemoryDocument(document interface{}) (memoryDocument, error) {
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var fields memoryDocument
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// toDocType converts a stored document back into a document created by createDocument, only keeping selectFields if set
+func toDocType(id string, fields memoryDocument, selectFields []string, createDocument CreateDocFunction) (doc.DocType, error) {
+	if selectFields != nil {
+		selected := make(memoryDocument, len(selectFields))
+		for _, field := range selectFields {
+			if value, ok := fields[field]; ok {
+				selected[field] = value
+			}
+		}
+		fields = selected
+	}
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	document := createDocument()
+	if err := json.Unmarshal(encoded, document); err != nil {
+		return nil, err
+	}
+	document.SetID(id)
+	return document, nil
+}
+
+// compareValues orders two field values. Numbers are compared numerically, other values by their string representation
+func compareValues(a interface{}, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		default:
+			return 1
+		}
+	}
+	numberA, okA := a.(json.Number)
+	numberB, okB := b.(json.Number)
+	if okA && okB {
+		uintA, errA := strconv.ParseUint(string(numberA), 10, 64)
+		uintB, errB := strconv.ParseUint(string(numberB), 10, 64)
+		if errA == nil && errB == nil {
+			switch {
+			case uintA < uintB:
+				return -1
+			case uintA > uintB:
+				return 1
+			}
+			return 0
+		}
+		floatA, _ := numberA.Float64()
+		floatB, _ := numberB.Float64()
+		switch {
+		case floatA < floatB:
+			return -1
+		case floatA > floatB:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// toMemoryValue converts a filter value to its stored representation, so that it can be compared to stored values
+func toMemoryValue(value interface{}) interface{} {
+	converted, err := toMemoryDocument(map[string]interface{}{"value": value})
+	if err != nil {
+		return value
+	}
+	return converted["value"]
+}
+
+// field returns the value of a field of the document with the given id. The id is not part of the stored fields
+func (fields memoryDocument) field(id string, field string) (interface{}, bool) {
+	if field == "id" {
+		return id, true
+	}
+	value, ok := fields[field]
+	return value, ok
+}
+
+// matchesFilter returns whether the stored document with the given id satisfies filter
+func (fields memoryDocument) matchesFilter(id string, filter Filter) bool {
+	switch f := filter.(type) {
+	case AndFilter:
+		for _, filter := range f.Filters {
+			if !fields.matchesFilter(id, filter) {
+				return false
+			}
+		}
+		return true
+	case OrFilter:
+		for _, filter := range f.Filters {
+			if fields.matchesFilter(id, filter) {
+				return true
+			}
+		}
+		return false
+	case NotFilter:
+		return !fields.matchesFilter(id, f.Filter)
+	case TermFilter:
+		value, _ := fields.field(id, f.Field)
+		if f.Value == nil {
+			return value == nil
+		}
+		return value != nil && compareValues(value, toMemoryValue(f.Value)) == 0
+	case TermsFilter:
+		for _, term := range f.Values {
+			if fields.matchesFilter(id, Term(f.Field, term)) {
+				return true
+			}
+		}
+		return false
+	case RangeFilter:
+		value, ok := fields.field(id, f.Field)
+		if !ok || value == nil {
+			return false
+		}
+		if f.Min != nil && compareValues(value, toMemoryValue(f.Min)) < 0 {
+			return false
+		}
+		return f.Max == nil || compareValues(value, toMemoryValue(f.Max)) <= 0
+	}
+	return true
+}
+
+// matches returns whether the stored document with the given id satisfies the filters of the query params
+func (fields memoryDocument) matches(id string, params QueryParams) bool {
+	filter := params.filter()
+	return filter == nil || fields.matchesFilter(id, filter)
+}
+
+func (mdb *MemoryDbController) resolveIndex(name string) string {
+	if indexName, ok := mdb.aliases[name]; ok {
+		return indexName
+	}
+	return name
+}
+
+// getIndex returns an existing index by name or alias
+func (mdb *MemoryDbController) getIndex(name string) (memoryIndex, error) {
+	index, ok := mdb.indices[mdb.resolveIndex(name)]
+	if !ok {
+		return nil, newError(KindNotFound, fmt.Errorf("no such index [%s]", name))
+	}
+	return index, nil
+}
+
+// getOrCreateIndex returns an existing index by name or alias, or creates it
+func (mdb *MemoryDbController) getOrCreateIndex(name string) memoryIndex {
+	indexName := mdb.resolveIndex(name)
+	index, ok := mdb.indices[indexName]
+	if !ok {
+		index = make(memoryIndex)
+		mdb.indices[indexName] = index
+	}
+	return index
+}
+
+// query returns the ids of all documents matching the query params, sorted by params.SortField and id
+func (mdb *MemoryDbController) query(index memoryIndex, params QueryParams) []string {
+	ids := make([]string, 0)
+	for id, fields := range index {
+		if fields.matches(id, params) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if params.SortField != "" {
+			order := compareValues(index[ids[i]][params.SortField], index[ids[j]][params.SortField])
+			if !params.SortAsc {
+				order = -order
+			}
+			if order != 0 {
+				return order < 0
+			}
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// insert stores a document, failing with a conflict if it exists already and upsert is not set
+func (mdb *MemoryDbController) insert(index memoryIndex, document doc.DocType, params UpdateParams) error {
+	fields, err := toMemoryDocument(document)
+	if err != nil {
+		return err
+	}
+	id := document.GetID()
+	if _, exists := index[id]; exists && !params.Upsert {
+		return newError(KindConflict, fmt.Errorf("document [%s] already exists in [%s]", id, params.IndexName))
+	}
+	index[id] = fields
+	return nil
+}
+
+// Insert inserts a single document using the updata params
+// With params.Upsert, an existing document with the same id is replaced
+// It returns the number of inserted documents (1) or an error
+func (mdb *MemoryDbController) Insert(ctx context.Context, document doc.DocType, params UpdateParams) (uint64, error) {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+	if err := mdb.insert(mdb.getOrCreateIndex(params.IndexName), document, params); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// InsertBulk inserts documents arriving in documentChannel in bulk using the updata params
+// Like an Elasticsearch bulk, conflicting documents don't stop the other documents from being inserted, but the first conflict is returned
+// It returns the number of inserted documents or an error
+func (mdb *MemoryDbController) InsertBulk(ctx context.Context, documentChannel chan doc.DocType, params UpdateParams) (uint64, error) {
+	var total uint64
+	var firstErr error
+	for d := range documentChannel {
+		mdb.mutex.Lock()
+		err := mdb.insert(mdb.getOrCreateIndex(params.IndexName), d, params)
+		mdb.mutex.Unlock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			total++
+		}
+
+		select {
+		default:
+		case <-ctx.Done():
+			return total, ctx.Err()
+		}
+	}
+	return total, firstErr
+}
+
+// Delete removes documents specified by the query params
+func (mdb *MemoryDbController) Delete(ctx context.Context, params QueryParams) (uint64, error) {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+	index, err := mdb.getIndex(params.IndexName)
+	if err != nil {
+		return 0, err
+	}
+	var deleted uint64
+	for id, fields := range index {
+		if fields.matches(id, params) {
+			delete(index, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// UpdateField sets field to value in all documents specified by the query params that don't have this value yet
+func (mdb *MemoryDbController) UpdateField(ctx context.Context, params QueryParams, field string, value interface{}) (uint64, error) {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+	index, err := mdb.getIndex(params.IndexName)
+	if err != nil {
+		return 0, err
+	}
+	// Store the value the same way as when inserted
+	converted, err := toMemoryDocument(map[string]interface{}{field: value})
+	if err != nil {
+		return 0, err
+	}
+	var updated uint64
+	for id, fields := range index {
+		if fields.matches(id, params) && compareValues(fields[field], converted[field]) != 0 {
+			fields[field] = converted[field]
+			updated++
+		}
+	}
+	return updated, nil
+}
+
+// Count returns the number of documents matching the query params
+func (mdb *MemoryDbController) Count(ctx context.Context, params QueryParams) (int64, error) {
+	mdb.mutex.RLock()
+	defer mdb.mutex.RUnlock()
+	index, err := mdb.getIndex(params.IndexName)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for id, fields := range index {
+		if fields.matches(id, params) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// SelectOne selects a single document
+func (mdb *MemoryDbController) SelectOne(ctx context.Context, params QueryParams, createDocument CreateDocFunction) (doc.DocType, error) {
+	mdb.mutex.RLock()
+	defer mdb.mutex.RUnlock()
+	index, err := mdb.getIndex(params.IndexName)
+	if err != nil {
+		return nil, err
+	}
+	ids := mdb.query(index, params)
+	if params.From >= len(ids) {
+		return nil, nil
+	}
+	id := ids[params.From]
+	return toDocType(id, index[id], params.SelectFields, createDocument)
+}
+
+// UpdateAlias updates an alias with a new index name and delete stale indices
+func (mdb *MemoryDbController) UpdateAlias(ctx context.Context, aliasName string, indexName string) error {
+	return mdb.UpdateAliases(ctx, map[string]string{aliasName: indexName})
+}
+
+// UpdateAliases updates several aliases with new index names at once and delete stale indices
+func (mdb *MemoryDbController) UpdateAliases(ctx context.Context, aliases map[string]string) error {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+	for _, indexName := range aliases {
+		if _, ok := mdb.indices[indexName]; !ok {
+			return newError(KindNotFound, fmt.Errorf("no such index [%s]", indexName))
+		}
+	}
+	for aliasName, indexName := range aliases {
+		oldIndexName, hasOld := mdb.aliases[aliasName]
+		mdb.aliases[aliasName] = indexName
+		if hasOld && oldIndexName != indexName {
+			delete(mdb.indices, oldIndexName)
+			delete(mdb.versions, oldIndexName)
+		}
+	}
+	return nil
+}
+
+// GetExistingIndexPrefix checks for existing indices and returns the prefix, if any
+func (mdb *MemoryDbController) GetExistingIndexPrefix(ctx context.Context, aliasName string, documentType string) (bool, string, error) {
+	mdb.mutex.RLock()
+	defer mdb.mutex.RUnlock()
+	indexName, ok := mdb.aliases[aliasName]
+	if !ok {
+		return false, "", nil
+	}
+	return true, strings.TrimSuffix(indexName, documentType), nil
+}
+
+// CreateIndex creates an empty index. The document type has no mapping in memory
+func (mdb *MemoryDbController) CreateIndex(ctx context.Context, indexName string, documentType string) error {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+	if _, ok := mdb.indices[indexName]; ok {
+		return newError(KindConflict, fmt.Errorf("index [%s] already exists", indexName))
+	}
+	mdb.indices[indexName] = make(memoryIndex)
+	mdb.versions[indexName] = doc.SchemaVersions[documentType].Version
+	return nil
+}
+
+// MigrateIndex records the schema version of an existing index. Documents are stored schemaless, so new fields need no changes
+func (mdb *MemoryDbController) MigrateIndex(ctx context.Context, indexName string, documentType string) error {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+	if _, ok := mdb.indices[indexName]; !ok {
+		return newError(KindNotFound, fmt.Errorf("no such index [%s]", indexName))
+	}
+	stored, ok := mdb.versions[indexName]
+	if !ok {
+		stored = unversionedSchema
+	}
+	if err := checkSchemaVersion(indexName, documentType, stored); err != nil {
+		return err
+	}
+	mdb.versions[indexName] = doc.SchemaVersions[documentType].Version
+	return nil
+}
+
+// Scroll creates a new scroll instance with the specified query and unmarshal function
+// Like an Elasticsearch scroll, it returns the documents matching at the time of the first call to Next
+func (mdb *MemoryDbController) Scroll(ctx context.Context, params QueryParams, createDocument CreateDocFunction) ScrollInstance {
+	return &MemoryScrollInstance{
+		db:             mdb,
+		params:         params,
+		createDocument: createDocument,
+	}
+}
+
+// MemoryScrollInstance is an instance of a scroll for MemoryDbController
+type MemoryScrollInstance struct {
+	db             *MemoryDbController
+	params         QueryParams
+	createDocument CreateDocFunction
+	ids            []string
+	documents      []memoryDocument
+	current        int
+	started        bool
+}
+
+// Next returns the next document of a scroll or io.EOF
+func (scroll *MemoryScrollInstance) Next() (doc.DocType, error) {
+	if !scroll.started {
+		scroll.db.mutex.RLock()
+		index, err := scroll.db.getIndex(scroll.params.IndexName)
+		if err != nil {
+			scroll.db.mutex.RUnlock()
+			return nil, err
+		}
+		scroll.ids = scroll.db.query(index, scroll.params)
+		scroll.documents = make([]memoryDocument, len(scroll.ids))
+		for i, id := range scroll.ids {
+			// Copy, as fields may be updated while scrolling
+			fields := make(memoryDocument, len(index[id]))
+			for field, value := range index[id] {
+				fields[field] = value
+			}
+			scroll.documents[i] = fields
+		}
+		scroll.db.mutex.RUnlock()
+		scroll.current = scroll.params.From
+		scroll.started = true
+	}
+	if scroll.current >= len(scroll.ids) {
+		return nil, io.EOF
+	}
+	id, fields := scroll.ids[scroll.current], scroll.documents[scroll.current]
+	scroll.current++
+	return toDocType(id, fields, scroll.params.SelectFields, scroll.createDocument)
+}
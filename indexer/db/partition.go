@@ -0,0 +1,72 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+)
+
+// partitionSeparator separates an index name from the partition key in the names of partition indices.
+// No document type contains it, so the partitions of one index never match another index.
+const partitionSeparator = "__"
+
+// PartitionedTypes are the high-volume document types that are split into partitions
+var PartitionedTypes = []string{"tx", "token_transfer"}
+
+// Partitioning configures how the indices of high-volume document types are split up
+type Partitioning struct {
+	// Monthly partitions documents by the month of their timestamp
+	Monthly bool
+	// Blocks partitions documents into ranges of this many blocks
+	Blocks uint64
+}
+
+// ParsePartitioning parses a partitioning mode, which is either "month" or a number of blocks.
+// It returns nil if spec is empty or "none".
+func ParsePartitioning(spec string) (*Partitioning, error) {
+	switch spec {
+	case "", "none":
+		return nil, nil
+	case "month":
+		return &Partitioning{Monthly: true}, nil
+	}
+	blocks, err := strconv.ParseUint(spec, 10, 64)
+	if err != nil || blocks == 0 {
+		return nil, fmt.Errorf("invalid partitioning %s, expected month or a number of blocks", spec)
+	}
+	return &Partitioning{Blocks: blocks}, nil
+}
+
+// partitionKey returns the key of the partition containing a document
+func (p *Partitioning) partitionKey(document doc.Partitioned) string {
+	timestamp, blockNo := document.PartitionKey()
+	if p.Monthly {
+		return timestamp.UTC().Format("2006-01")
+	}
+	return fmt.Sprintf("%012d", blockNo/p.Blocks*p.Blocks)
+}
+
+// partitionIndexName returns the name of the partition of indexName containing a document
+func (p *Partitioning) partitionIndexName(indexName string, document doc.Partitioned) string {
+	return indexName + partitionSeparator + p.partitionKey(document)
+}
+
+// isPartitionedType returns whether documents of typeName are partitioned
+func isPartitionedType(typeName string) bool {
+	return containsString(PartitionedTypes, typeName)
+}
+
+// maxBlockNo returns the highest block number of the partitioned documents, or false if there are none
+func maxBlockNo(documents []doc.DocType) (uint64, bool) {
+	var max uint64
+	found := false
+	for _, document := range documents {
+		if partitioned, ok := document.(doc.Partitioned); ok {
+			if _, blockNo := partitioned.PartitionKey(); !found || blockNo > max {
+				max, found = blockNo, true
+			}
+		}
+	}
+	return max, found
+}
@@ -0,0 +1,405 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const (
+	// postgresAliasTable records which table each view pointed to over time. The latest entry of a view is its current table
+	postgresAliasTable  = "indexer_aliases"
+	postgresAliasSchema = `
+		CREATE TABLE IF NOT EXISTS ` + postgresAliasTable + ` (
+			alias_name VARCHAR(128) NOT NULL,
+			index_name VARCHAR(128) NOT NULL,
+			swapped_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (alias_name, index_name)
+		);`
+)
+
+// postgresSchemaDialect contains the queries for migrating PostgreSQL tables
+var postgresSchemaDialect = sqlSchemaDialect{
+	columnsQuery:      "SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ?",
+	indexesQuery:      "SELECT indexname FROM pg_indexes WHERE schemaname = current_schema() AND tablename = ?",
+	storeVersionQuery: "INSERT INTO " + schemaVersionTable + " (index_name, version) VALUES (?, ?) ON CONFLICT (index_name) DO UPDATE SET version = EXCLUDED.version",
+}
+
+// PostgresDbController implements DbController
+type PostgresDbController struct {
+	Client *sqlx.DB
+}
+
+// NewPostgresDbController creates a new instance of PostgresDbController
+func NewPostgresDbController(dbURL string) (*PostgresDbController, error) {
+	client, err := sqlx.Connect("postgres", dbURL)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.Exec(postgresAliasSchema); err != nil {
+		return nil, err
+	}
+	if _, err := client.Exec(schemaVersionSchema); err != nil {
+		return nil, err
+	}
+	return &PostgresDbController{
+		Client: client,
+	}, nil
+}
+
+func placeholders(count int) string {
+	binds := make([]string, 0, count)
+	for i := 1; i <= count; i++ {
+		binds = append(binds, fmt.Sprintf("$%d", i))
+	}
+	return strings.Join(binds, ",")
+}
+
+// postgresErrorKind classifies errors of the PostgreSQL driver by their SQLSTATE code.
+// Deadlocks, serialization failures, lost connections and insufficient resources can be retried
+func postgresErrorKind(err error) ErrorKind {
+	if err == driver.ErrBadConn {
+		return KindTransient
+	}
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return KindPermanent
+	}
+	switch {
+	case pqErr.Code == "23505": // unique_violation
+		return KindConflict
+	case pqErr.Code == "42P01": // undefined_table
+		return KindNotFound
+	case pqErr.Code == "40P01", pqErr.Code == "40001", pqErr.Code.Class() == "08", pqErr.Code.Class() == "53", pqErr.Code == "57P03":
+		return KindTransient
+	}
+	return KindPermanent
+}
+
+// wrapError classifies an error of the PostgreSQL driver
+func (pdb *PostgresDbController) wrapError(err error) error {
+	return wrapError(err, postgresErrorKind)
+}
+
+// Insert inserts a single document using the updata params
+// It returns the number of inserted documents (1) or an error
+func (pdb *PostgresDbController) Insert(ctx context.Context, document doc.DocType, params UpdateParams) (uint64, error) {
+	columns := documentColumns(document)
+	conflict := ""
+	if params.Upsert {
+		conflict = onConflictToSql(columns, true)
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) %s", quoteIdentifier(params.IndexName), quoteColumns(columns), placeholders(len(columns)), conflict)
+	result, err := pdb.Client.ExecContext(ctx, query, documentValues(document)...)
+	if err != nil {
+		return 0, pdb.wrapError(err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return uint64(rowsAffected), nil
+}
+
+// copyBulk inserts documents in a single transaction
+func (pdb *PostgresDbController) copyBulk(ctx context.Context, bulk []doc.DocType, params UpdateParams) (uint64, error) {
+	txn, err := pdb.Client.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer txn.Rollback()
+
+	rowsAffected, err := copyInto(ctx, txn, bulk, params.IndexName, onConflictToSql(documentColumns(bulk[0]), params.Upsert))
+	if err != nil {
+		return 0, err
+	}
+	if err := txn.Commit(); err != nil {
+		return 0, err
+	}
+	return rowsAffected, nil
+}
+
+// copyInto loads documents into a temporary table using COPY and moves them into the index table from there,
+// as COPY cannot skip or replace existing rows. conflict is the ON CONFLICT clause used when moving the rows
+func copyInto(ctx context.Context, txn *sql.Tx, bulk []doc.DocType, indexName string, conflict string) (uint64, error) {
+	columns := documentColumns(bulk[0])
+	// seq numbers the documents in the order they were copied
+	_, err := txn.ExecContext(ctx, fmt.Sprintf("CREATE TEMP TABLE bulk_import (LIKE %s INCLUDING DEFAULTS, seq BIGSERIAL) ON COMMIT DROP", quoteIdentifier(indexName)))
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := txn.PrepareContext(ctx, pq.CopyIn("bulk_import", columns...))
+	if err != nil {
+		return 0, err
+	}
+	for _, document := range bulk {
+		if _, err := stmt.ExecContext(ctx, documentValues(document)...); err != nil {
+			stmt.Close()
+			return 0, err
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return 0, err
+	}
+	if err := stmt.Close(); err != nil {
+		return 0, err
+	}
+
+	// A bulk may contain the same document more than once, which ON CONFLICT cannot handle within one statement.
+	// The last one wins, like on the other databases
+	result, err := txn.ExecContext(ctx, fmt.Sprintf(
+		`INSERT INTO %s (%s) SELECT DISTINCT ON ("id") %s FROM bulk_import ORDER BY "id", seq DESC %s`,
+		quoteIdentifier(indexName), quoteColumns(columns), quoteColumns(columns), conflict,
+	))
+	if err != nil {
+		return 0, err
+	}
+	// Drop the table right away, so another bulk can be copied within the same transaction
+	if _, err := txn.ExecContext(ctx, "DROP TABLE bulk_import"); err != nil {
+		return 0, err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return uint64(rowsAffected), nil
+}
+
+// WriteBatch writes the documents of all batch items in a single transaction, retrying on transient errors like deadlocks
+func (pdb *PostgresDbController) WriteBatch(ctx context.Context, batch []BatchItem) error {
+	return retryTransient(ctx, pdb.wrapError, func() error {
+		txn, err := pdb.Client.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer txn.Rollback()
+		for _, item := range batch {
+			if len(item.Documents) == 0 {
+				continue
+			}
+			conflict := ""
+			if item.Params.Upsert || !item.FailOnConflict {
+				conflict = onConflictToSql(documentColumns(item.Documents[0]), item.Params.Upsert)
+			}
+			if _, err := copyInto(ctx, txn, item.Documents, item.Params.IndexName, conflict); err != nil {
+				return err
+			}
+		}
+		return txn.Commit()
+	})
+}
+
+// InsertBulk inserts documents arriving in documentChannel in bulk using the updata params
+// It commits all documents until documentChannel is closed, unless ctx is cancelled
+// It returns the number of inserted documents or an error
+func (pdb *PostgresDbController) InsertBulk(ctx context.Context, documentChannel chan doc.DocType, params UpdateParams) (uint64, error) {
+	var total uint64
+	var bulk []doc.DocType
+
+	begin := time.Now()
+	commitBulk := func(bulk []doc.DocType) error {
+		if len(bulk) == 0 {
+			return nil
+		}
+		rowsAffected, err := pdb.copyBulk(ctx, bulk, params)
+		if err != nil {
+			logger.Error().Err(err).Int("chunkSize", params.Size).Str("indexName", params.IndexName).Msg("Error while committing bulk")
+			return pdb.wrapError(err)
+		}
+		atomic.AddUint64(&total, rowsAffected)
+		dur := time.Since(begin).Seconds()
+		pps := int64(float64(total) / dur)
+		logger.Info().Int("chunkSize", params.Size).Uint64("total", total).Int64("perSecond", pps).Str("indexName", params.IndexName).Msg("Comitted bulk chunk")
+		return nil
+	}
+
+	for d := range documentChannel {
+		bulk = append(bulk, d)
+		if len(bulk) >= params.Size {
+			if err := commitBulk(bulk); err != nil {
+				return total, err
+			}
+			bulk = nil
+		}
+
+		select {
+		default:
+		case <-ctx.Done():
+			return total, pdb.wrapError(ctx.Err())
+		}
+	}
+	// Commit the final batch before exiting
+	if err := commitBulk(bulk); err != nil {
+		return total, err
+	}
+	return total, nil
+}
+
+// Delete removes documents specified by the query params
+func (pdb *PostgresDbController) Delete(ctx context.Context, params QueryParams) (uint64, error) {
+	conditions, args := filterConditions(params, quoteIdentifier)
+	query := fmt.Sprintf("DELETE FROM %s %s", quoteIdentifier(params.IndexName), whereToSql(conditions))
+	result, err := pdb.Client.ExecContext(ctx, pdb.Client.Rebind(query), args...)
+	if err != nil {
+		return 0, pdb.wrapError(err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return uint64(rowsAffected), nil
+}
+
+// UpdateField sets field to value in all documents specified by the query params that don't have this value yet
+func (pdb *PostgresDbController) UpdateField(ctx context.Context, params QueryParams, field string, value interface{}) (uint64, error) {
+	conditions, filterArgs := filterConditions(params, quoteIdentifier)
+	conditions = append(conditions, quoteIdentifier(field)+" <> ?")
+	args := append(append([]interface{}{value}, filterArgs...), value)
+	query := fmt.Sprintf("UPDATE %s SET %s = ? %s", quoteIdentifier(params.IndexName), quoteIdentifier(field), whereToSql(conditions))
+	result, err := pdb.Client.ExecContext(ctx, pdb.Client.Rebind(query), args...)
+	if err != nil {
+		return 0, pdb.wrapError(err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return uint64(rowsAffected), nil
+}
+
+// Count returns the number of documents matching the query params
+func (pdb *PostgresDbController) Count(ctx context.Context, params QueryParams) (int64, error) {
+	var count int64
+	conditions, args := filterConditions(params, quoteIdentifier)
+	query := fmt.Sprintf("SELECT count(*) FROM %s %s", quoteIdentifier(params.IndexName), whereToSql(conditions))
+	err := pdb.Client.GetContext(ctx, &count, pdb.Client.Rebind(query), args...)
+	if err != nil {
+		return 0, pdb.wrapError(err)
+	}
+	return count, nil
+}
+
+// SelectOne selects a single document
+func (pdb *PostgresDbController) SelectOne(ctx context.Context, params QueryParams, createDocument CreateDocFunction) (doc.DocType, error) {
+	conditions, args := filterConditions(params, quoteIdentifier)
+	query := fmt.Sprintf(
+		"SELECT %s FROM %s %s ORDER BY %s %s LIMIT 1 OFFSET %d",
+		quotedSelectFields(params.SelectFields),
+		quoteIdentifier(params.IndexName),
+		whereToSql(conditions),
+		quoteIdentifier(params.SortField),
+		booleanSortOrderToSql(params.SortAsc),
+		params.From,
+	)
+	document := createDocument()
+	err := pdb.Client.GetContext(ctx, document, pdb.Client.Rebind(query), args...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, pdb.wrapError(err)
+	}
+	return document, nil
+}
+
+// UpdateAlias updates an alias with a new index name
+func (pdb *PostgresDbController) UpdateAlias(ctx context.Context, aliasName string, indexName string) error {
+	return pdb.UpdateAliases(ctx, map[string]string{aliasName: indexName})
+}
+
+// UpdateAliases updates several aliases with new index names in one transaction and drops stale tables.
+// Views are dropped and created again, as CREATE OR REPLACE VIEW fails if the columns of the new table differ.
+func (pdb *PostgresDbController) UpdateAliases(ctx context.Context, aliases map[string]string) error {
+	txn, err := pdb.Client.BeginTx(ctx, nil)
+	if err != nil {
+		return pdb.wrapError(err)
+	}
+	defer txn.Rollback()
+	swappedAt := time.Now().UTC()
+	for aliasName, indexName := range aliases {
+		if _, err := txn.ExecContext(ctx, fmt.Sprintf("DROP VIEW IF EXISTS %s", quoteIdentifier(aliasName))); err != nil {
+			return pdb.wrapError(err)
+		}
+		if _, err := txn.ExecContext(ctx, fmt.Sprintf("CREATE VIEW %s AS SELECT * FROM %s", quoteIdentifier(aliasName), quoteIdentifier(indexName))); err != nil {
+			return pdb.wrapError(err)
+		}
+		query := fmt.Sprintf("INSERT INTO %s (alias_name, index_name, swapped_at) VALUES ($1, $2, $3) ON CONFLICT (alias_name, index_name) DO UPDATE SET swapped_at = EXCLUDED.swapped_at", postgresAliasTable)
+		if _, err := txn.ExecContext(ctx, query, aliasName, indexName, swappedAt); err != nil {
+			return pdb.wrapError(err)
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return pdb.wrapError(err)
+	}
+
+	for aliasName := range aliases {
+		if err := pdb.dropStaleGenerations(ctx, aliasName); err != nil {
+			logger.Warn().Err(err).Str("aliasName", aliasName).Msg("Failed to drop previous tables")
+		}
+	}
+	return nil
+}
+
+// dropStaleGenerations drops the tables an alias pointed to before, except for the latest retainedGenerations
+func (pdb *PostgresDbController) dropStaleGenerations(ctx context.Context, aliasName string) error {
+	var indexNames []string
+	query := fmt.Sprintf("SELECT index_name FROM %s WHERE alias_name = $1 ORDER BY swapped_at DESC, index_name DESC", postgresAliasTable)
+	if err := pdb.Client.SelectContext(ctx, &indexNames, query, aliasName); err != nil {
+		return err
+	}
+	if len(indexNames) <= 1+retainedGenerations {
+		return nil
+	}
+	for _, indexName := range indexNames[1+retainedGenerations:] {
+		if _, err := pdb.Client.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteIdentifier(indexName))); err != nil {
+			return err
+		}
+		query := fmt.Sprintf("DELETE FROM %s WHERE alias_name = $1 AND index_name = $2", postgresAliasTable)
+		if _, err := pdb.Client.ExecContext(ctx, query, aliasName, indexName); err != nil {
+			return err
+		}
+		logger.Info().Str("aliasName", aliasName).Str("indexName", indexName).Msg("Dropped previous table")
+	}
+	return nil
+}
+
+// GetExistingIndexPrefix checks for existing indices and returns the prefix, if any
+func (pdb *PostgresDbController) GetExistingIndexPrefix(ctx context.Context, aliasName string, documentType string) (bool, string, error) {
+	var tableName string
+	err := pdb.Client.GetContext(ctx, &tableName, "SELECT table_name FROM information_schema.view_table_usage WHERE view_schema = current_schema() AND view_name = $1 AND table_schema = current_schema() LIMIT 1", aliasName)
+	if err == sql.ErrNoRows {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", pdb.wrapError(err)
+	}
+	if !strings.HasSuffix(tableName, documentType) {
+		return false, "", fmt.Errorf("could not match table prefix in %s", tableName)
+	}
+	return true, strings.TrimSuffix(tableName, documentType), nil
+}
+
+// CreateIndex creates index according to documentType definition
+func (pdb *PostgresDbController) CreateIndex(ctx context.Context, indexName string, documentType string) error {
+	statement := strings.Replace(doc.PostgresSchemas[documentType], "%indexName%", indexName, -1)
+	if _, err := pdb.Client.ExecContext(ctx, statement); err != nil {
+		return pdb.wrapError(err)
+	}
+	return pdb.wrapError(storeSchemaVersion(ctx, pdb.Client, postgresSchemaDialect, indexName, documentType))
+}
+
+// MigrateIndex adds missing columns and indexes of documentType's schema to an existing table
+func (pdb *PostgresDbController) MigrateIndex(ctx context.Context, indexName string, documentType string) error {
+	return pdb.wrapError(migrateTable(ctx, pdb.Client, postgresSchemaDialect, indexName, documentType, doc.PostgresSchemas[documentType]))
+}
+
+// Scroll creates a new scroll instance with the specified query and unmarshal function
+func (pdb *PostgresDbController) Scroll(ctx context.Context, params QueryParams, createDocument CreateDocFunction) ScrollInstance {
+	if params.Size <= 0 {
+		params.Size = defaultScrollSize
+	}
+	return &KeysetScrollInstance{
+		ctx:            ctx,
+		createDocument: createDocument,
+		client:         pdb.Client,
+		params:         params,
+		wrapError:      pdb.wrapError,
+	}
+}
@@ -0,0 +1,234 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// schemaVersionTable records the schema version of each SQL table
+	schemaVersionTable  = "indexer_schemas"
+	schemaVersionSchema = `
+		CREATE TABLE IF NOT EXISTS ` + schemaVersionTable + ` (
+			index_name VARCHAR(128) NOT NULL,
+			version INTEGER NOT NULL,
+			PRIMARY KEY (index_name)
+		);`
+	// unversionedSchema is the version of indices created before schema versions were recorded
+	unversionedSchema = 1
+)
+
+// checkSchemaVersion returns an error if an index with the stored schema version cannot be migrated to the current version of documentType
+func checkSchemaVersion(indexName string, documentType string, stored int) error {
+	current, ok := doc.SchemaVersions[documentType]
+	if !ok {
+		return fmt.Errorf("unknown document type %s", documentType)
+	}
+	if stored > current.Version {
+		return fmt.Errorf("index %s has schema version %d, which is newer than version %d of this indexer", indexName, stored, current.Version)
+	}
+	if stored < current.MinVersion {
+		return &SchemaReindexError{IndexName: indexName, Reason: fmt.Sprintf("schema version %d cannot be migrated to version %d", stored, current.Version)}
+	}
+	return nil
+}
+
+// tableSchema contains the columns and indexes of a table, parsed from its schema statements
+type tableSchema struct {
+	table           string
+	columns         []string
+	definitions     map[string]string // column definitions by name
+	indexes         []string
+	indexStatements map[string]string // statements creating each index on the existing table
+}
+
+// splitTopLevel splits s at separator, ignoring separators within parentheses or quotes
+func splitTopLevel(s string, separator rune) []string {
+	parts := make([]string, 0)
+	depth, quote, start := 0, rune(0), 0
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == separator && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquoteIdentifier removes backticks or double quotes around a name
+func unquoteIdentifier(name string) string {
+	return strings.Trim(name, "`\"")
+}
+
+// parseTableSchema parses the CREATE TABLE and CREATE INDEX statements of a schema.
+// Indexes defined within CREATE TABLE are added with ALTER TABLE ... ADD, as understood by MariaDB.
+func parseTableSchema(schema string) (*tableSchema, error) {
+	parsed := &tableSchema{
+		definitions:     make(map[string]string),
+		indexStatements: make(map[string]string),
+	}
+	addIndex := func(name string, statement string) {
+		name = unquoteIdentifier(name)
+		parsed.indexes = append(parsed.indexes, name)
+		parsed.indexStatements[name] = statement
+	}
+	for _, statement := range splitTopLevel(schema, ';') {
+		statement = strings.TrimSpace(statement)
+		upper := strings.ToUpper(statement)
+		switch {
+		case strings.HasPrefix(upper, "CREATE TABLE"):
+			open, close := strings.Index(statement, "("), strings.LastIndex(statement, ")")
+			if open < 0 || close < open {
+				return nil, fmt.Errorf("could not parse table schema %s", statement)
+			}
+			header := strings.Fields(statement[:open])
+			parsed.table = header[len(header)-1]
+			for _, definition := range splitTopLevel(statement[open+1:close], ',') {
+				definition = strings.TrimSpace(definition)
+				fields := strings.Fields(definition)
+				if len(fields) < 2 {
+					continue
+				}
+				switch strings.ToUpper(fields[0]) {
+				case "PRIMARY", "UNIQUE", "CHECK", "CONSTRAINT", "FOREIGN":
+				case "INDEX", "KEY":
+					addIndex(fields[1], fmt.Sprintf("ALTER TABLE %s ADD %s", parsed.table, definition))
+				default:
+					column := unquoteIdentifier(fields[0])
+					parsed.columns = append(parsed.columns, column)
+					parsed.definitions[column] = definition
+				}
+			}
+		case strings.HasPrefix(upper, "CREATE INDEX"), strings.HasPrefix(upper, "CREATE UNIQUE INDEX"):
+			fields := strings.Fields(statement)
+			for i, field := range fields {
+				if strings.ToUpper(field) != "INDEX" || i+1 >= len(fields) {
+					continue
+				}
+				name := fields[i+1]
+				if strings.ToUpper(name) == "IF" && i+4 < len(fields) {
+					name = fields[i+4] // IF NOT EXISTS name
+				}
+				addIndex(name, statement)
+				break
+			}
+		}
+	}
+	if parsed.table == "" {
+		return nil, fmt.Errorf("could not find table in schema %s", schema)
+	}
+	return parsed, nil
+}
+
+// requiresReindex returns whether a column cannot be added to a table with existing rows
+func requiresReindex(definition string) bool {
+	upper := strings.ToUpper(definition)
+	return strings.Contains(upper, "PRIMARY KEY") || (strings.Contains(upper, "NOT NULL") && !strings.Contains(upper, "DEFAULT"))
+}
+
+func containsStringFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// sqlSchemaDialect contains the queries for migrating tables that differ between SQL databases.
+// Queries use ? placeholders and are rebound for the database.
+type sqlSchemaDialect struct {
+	// columnsQuery selects the column names of a table
+	columnsQuery string
+	// indexesQuery selects the index names of a table
+	indexesQuery string
+	// storeVersionQuery inserts or replaces the schema version of a table
+	storeVersionQuery string
+}
+
+// getSchemaVersion returns the recorded schema version of a table
+func getSchemaVersion(ctx context.Context, client *sqlx.DB, indexName string) (int, error) {
+	var version int
+	err := client.GetContext(ctx, &version, client.Rebind("SELECT version FROM "+schemaVersionTable+" WHERE index_name = ?"), indexName)
+	if err == sql.ErrNoRows {
+		return unversionedSchema, nil
+	}
+	return version, err
+}
+
+// storeSchemaVersion records the current schema version of documentType for a table
+func storeSchemaVersion(ctx context.Context, client *sqlx.DB, dialect sqlSchemaDialect, indexName string, documentType string) error {
+	_, err := client.ExecContext(ctx, client.Rebind(dialect.storeVersionQuery), indexName, doc.SchemaVersions[documentType].Version)
+	return err
+}
+
+// migrateTable brings an existing table up to schema by adding missing columns and indexes.
+// It returns a *SchemaReindexError if the table cannot be migrated without a full reindex.
+func migrateTable(ctx context.Context, client *sqlx.DB, dialect sqlSchemaDialect, indexName string, documentType string, schema string) error {
+	stored, err := getSchemaVersion(ctx, client, indexName)
+	if err != nil {
+		return err
+	}
+	if err := checkSchemaVersion(indexName, documentType, stored); err != nil {
+		return err
+	}
+	expected, err := parseTableSchema(strings.Replace(schema, "%indexName%", indexName, -1))
+	if err != nil {
+		return err
+	}
+	var columns, indexes []string
+	if err := client.SelectContext(ctx, &columns, client.Rebind(dialect.columnsQuery), indexName); err != nil {
+		return err
+	}
+	if err := client.SelectContext(ctx, &indexes, client.Rebind(dialect.indexesQuery), indexName); err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return newError(KindNotFound, fmt.Errorf("table %s does not exist", indexName))
+	}
+
+	statements := make([]string, 0)
+	for _, column := range expected.columns {
+		if containsStringFold(columns, column) {
+			continue
+		}
+		definition := expected.definitions[column]
+		if requiresReindex(definition) {
+			return &SchemaReindexError{IndexName: indexName, Reason: fmt.Sprintf("column %s cannot be added to existing rows", definition)}
+		}
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", expected.table, definition))
+	}
+	for _, column := range columns {
+		if !containsStringFold(expected.columns, column) {
+			logger.Warn().Str("indexName", indexName).Str("column", column).Msg("Table has a column that is not part of the schema")
+		}
+	}
+	for _, index := range expected.indexes {
+		if !containsStringFold(indexes, index) {
+			statements = append(statements, expected.indexStatements[index])
+		}
+	}
+	for _, statement := range statements {
+		if _, err := client.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+		logger.Info().Str("indexName", indexName).Str("statement", statement).Msg("Migrated table")
+	}
+	return storeSchemaVersion(ctx, client, dialect, indexName, documentType)
+}
@@ -0,0 +1,274 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+	"github.com/jmoiron/sqlx"
+)
+
+// defaultScrollSize is the page size of a scroll if the query params don't specify one
+const defaultScrollSize = 1000
+
+// documentColumns returns the column names of a document in the order of its fields, starting with the id
+func documentColumns(document doc.DocType) []string {
+	t := reflect.Indirect(reflect.ValueOf(document)).Type()
+	columns := []string{"id"}
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("db")
+		if tag == "" {
+			continue
+		}
+		columns = append(columns, tag)
+	}
+	return columns
+}
+
+// documentValues returns the values of a document in the same order as documentColumns
+func documentValues(document doc.DocType) []interface{} {
+	v := reflect.Indirect(reflect.ValueOf(document))
+	t := v.Type()
+	values := []interface{}{document.GetID()}
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("db") == "" {
+			continue
+		}
+		values = append(values, v.Field(i).Interface())
+	}
+	return values
+}
+
+// documentValue returns the value of the field with the given column name
+func documentValue(document doc.DocType, column string) interface{} {
+	if column == "id" {
+		return document.GetID()
+	}
+	v := reflect.Indirect(reflect.ValueOf(document))
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("db") == column {
+			return v.Field(i).Interface()
+		}
+	}
+	return nil
+}
+
+// quoteIdentifier quotes a table or column name for SQL dialects using double quotes
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func quoteColumns(columns []string) string {
+	quoted := make([]string, 0, len(columns))
+	for _, column := range columns {
+		quoted = append(quoted, quoteIdentifier(column))
+	}
+	return strings.Join(quoted, ",")
+}
+
+// onConflictToSql returns the clause replacing existing documents with the same id if upsert is set, or skipping them otherwise
+func onConflictToSql(columns []string, upsert bool) string {
+	if !upsert {
+		return `ON CONFLICT ("id") DO NOTHING`
+	}
+	updates := make([]string, 0, len(columns))
+	for _, column := range columns[1:] {
+		updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", quoteIdentifier(column), quoteIdentifier(column)))
+	}
+	return `ON CONFLICT ("id") DO UPDATE SET ` + strings.Join(updates, ",")
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func quotedSelectFields(fields []string) string {
+	if fields == nil {
+		return "*"
+	}
+	return quoteColumns(fields)
+}
+
+// filterToSql translates a filter into a SQL condition with ? placeholders, quoting field names with quote
+func filterToSql(filter Filter, quote func(string) string) (string, []interface{}) {
+	switch f := filter.(type) {
+	case AndFilter, OrFilter:
+		filters, operator, empty := []Filter(nil), " AND ", "1 = 1"
+		if and, ok := f.(AndFilter); ok {
+			filters = and.Filters
+		} else {
+			filters, operator, empty = f.(OrFilter).Filters, " OR ", "1 = 0"
+		}
+		if len(filters) == 0 {
+			return empty, nil
+		}
+		conditions := make([]string, 0, len(filters))
+		var args []interface{}
+		for _, filter := range filters {
+			condition, filterArgs := filterToSql(filter, quote)
+			conditions = append(conditions, "("+condition+")")
+			args = append(args, filterArgs...)
+		}
+		return strings.Join(conditions, operator), args
+	case NotFilter:
+		condition, args := filterToSql(f.Filter, quote)
+		return "NOT (" + condition + ")", args
+	case TermFilter:
+		if f.Value == nil {
+			return quote(f.Field) + " IS NULL", nil
+		}
+		return quote(f.Field) + " = ?", []interface{}{f.Value}
+	case TermsFilter:
+		if len(f.Values) == 0 {
+			return "1 = 0", nil
+		}
+		return fmt.Sprintf("%s IN (%s)", quote(f.Field), strings.TrimSuffix(strings.Repeat("?,", len(f.Values)), ",")), f.Values
+	case RangeFilter:
+		conditions := make([]string, 0, 2)
+		var args []interface{}
+		if f.Min != nil {
+			conditions = append(conditions, quote(f.Field)+" >= ?")
+			args = append(args, f.Min)
+		}
+		if f.Max != nil {
+			conditions = append(conditions, quote(f.Field)+" <= ?")
+			args = append(args, f.Max)
+		}
+		if len(conditions) == 0 {
+			return "1 = 1", nil
+		}
+		return strings.Join(conditions, " AND "), args
+	}
+	return "1 = 1", nil
+}
+
+// filterConditions returns the filter of the query params as a list of conditions for whereToSql, and their arguments
+func filterConditions(params QueryParams, quote func(string) string) ([]string, []interface{}) {
+	filter := params.filter()
+	if filter == nil {
+		return nil, nil
+	}
+	condition, args := filterToSql(filter, quote)
+	return []string{"(" + condition + ")"}, args
+}
+
+func whereToSql(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(conditions, " AND ")
+}
+
+// KeysetScrollInstance is an instance of a scroll for SQL databases.
+// Pages are queried by the sort field and id of the last document instead of an offset, so they are stable while documents are inserted.
+type KeysetScrollInstance struct {
+	result         *sqlx.Rows
+	current        int
+	started        bool
+	finished       bool
+	lastSortValue  interface{}
+	lastID         string
+	ctx            context.Context
+	createDocument CreateDocFunction
+	client         *sqlx.DB
+	params         QueryParams
+	// wrapError classifies errors of the database driver
+	wrapError func(error) error
+}
+
+// queryPage queries the page following the last returned document
+func (scroll *KeysetScrollInstance) queryPage() (*sqlx.Rows, error) {
+	fields := scroll.params.SelectFields
+	sortFields := []string{"id"}
+	if scroll.params.SortField != "" && scroll.params.SortField != "id" {
+		sortFields = []string{scroll.params.SortField, "id"}
+	}
+	if fields != nil {
+		// The keyset needs the sort fields of every document
+		fields = append([]string{}, fields...)
+		for _, sortField := range sortFields {
+			if !containsString(fields, sortField) {
+				fields = append(fields, sortField)
+			}
+		}
+	}
+
+	sortOrder := booleanSortOrderToSql(scroll.params.SortAsc)
+	conditions, args := filterConditions(scroll.params, quoteIdentifier)
+	if scroll.started {
+		operator := "<"
+		if scroll.params.SortAsc {
+			operator = ">"
+		}
+		if len(sortFields) == 2 {
+			conditions = append(conditions, fmt.Sprintf("(%s) %s (?, ?)", quoteColumns(sortFields), operator))
+			args = append(args, scroll.lastSortValue, scroll.lastID)
+		} else {
+			conditions = append(conditions, fmt.Sprintf(`"id" %s ?`, operator))
+			args = append(args, scroll.lastID)
+		}
+	}
+	orders := make([]string, 0, len(sortFields))
+	for _, field := range sortFields {
+		orders = append(orders, quoteIdentifier(field)+" "+sortOrder)
+	}
+
+	query := fmt.Sprintf(
+		"SELECT %s FROM %s %s ORDER BY %s LIMIT %d",
+		quotedSelectFields(fields),
+		quoteIdentifier(scroll.params.IndexName),
+		whereToSql(conditions),
+		strings.Join(orders, ","),
+		scroll.params.Size,
+	)
+	return scroll.client.QueryxContext(scroll.ctx, scroll.client.Rebind(query), args...)
+}
+
+// Next returns the next document of a scroll or io.EOF
+func (scroll *KeysetScrollInstance) Next() (doc.DocType, error) {
+	for {
+		if scroll.result == nil {
+			if scroll.finished {
+				return nil, io.EOF
+			}
+			result, err := scroll.queryPage()
+			if err != nil {
+				return nil, scroll.wrapError(err)
+			}
+			scroll.result = result
+			scroll.current = 0
+		}
+
+		if scroll.result.Next() {
+			document := scroll.createDocument()
+			if err := scroll.result.StructScan(document); err != nil {
+				return nil, scroll.wrapError(err)
+			}
+			scroll.current++
+			scroll.started = true
+			scroll.lastID = document.GetID()
+			scroll.lastSortValue = documentValue(document, scroll.params.SortField)
+			return document, nil
+		}
+
+		// Current page is exhausted. A page shorter than the page size is the last one
+		err := scroll.result.Err()
+		scroll.result.Close()
+		scroll.result = nil
+		if err != nil {
+			return nil, scroll.wrapError(err)
+		}
+		if scroll.current < scroll.params.Size {
+			scroll.finished = true
+		}
+	}
+}
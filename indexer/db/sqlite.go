@@ -0,0 +1,388 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+// viewSourcePattern matches the table name in a view definition created by UpdateAlias
+var viewSourcePattern = regexp.MustCompile(`FROM "((?:[^"]|"")*)"\s*$`)
+
+const (
+	// sqliteAliasTable records which table each view pointed to over time. The latest entry of a view is its current table
+	sqliteAliasTable = "indexer_aliases"
+	// swapped_at is in unix nanoseconds, as SQLite compares timestamps as text
+	sqliteAliasSchema = `
+		CREATE TABLE IF NOT EXISTS ` + sqliteAliasTable + ` (
+			alias_name TEXT NOT NULL,
+			index_name TEXT NOT NULL,
+			swapped_at INTEGER NOT NULL,
+			PRIMARY KEY (alias_name, index_name)
+		);`
+)
+
+// sqliteSchemaDialect contains the queries for migrating SQLite tables
+var sqliteSchemaDialect = sqlSchemaDialect{
+	columnsQuery:      "SELECT name FROM pragma_table_info(?)",
+	indexesQuery:      "SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ?",
+	storeVersionQuery: "INSERT INTO " + schemaVersionTable + " (index_name, version) VALUES (?, ?) ON CONFLICT (index_name) DO UPDATE SET version = excluded.version",
+}
+
+// SQLiteDbController implements DbController
+type SQLiteDbController struct {
+	Client *sqlx.DB
+}
+
+// NewSQLiteDbController creates a new instance of SQLiteDbController. The database file is created if it does not exist.
+func NewSQLiteDbController(path string) (*SQLiteDbController, error) {
+	// WAL allows reading while a bulk is written. Concurrent writers wait for each other instead of failing
+	client, err := sqlx.Connect("sqlite3", "file:"+path+"?_busy_timeout=30000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.Exec(schemaVersionSchema); err != nil {
+		return nil, err
+	}
+	if _, err := client.Exec(sqliteAliasSchema); err != nil {
+		return nil, err
+	}
+	return &SQLiteDbController{
+		Client: client,
+	}, nil
+}
+
+// sqliteErrorKind classifies errors of the SQLite driver.
+// The database being locked by another connection beyond the busy timeout can be retried
+func sqliteErrorKind(err error) ErrorKind {
+	sqliteErr, ok := err.(sqlite3.Error)
+	if !ok {
+		return KindPermanent
+	}
+	switch {
+	case sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique, sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey:
+		return KindConflict
+	case sqliteErr.Code == sqlite3.ErrError && strings.HasPrefix(sqliteErr.Error(), "no such table"):
+		return KindNotFound
+	case sqliteErr.Code == sqlite3.ErrBusy, sqliteErr.Code == sqlite3.ErrLocked:
+		return KindTransient
+	}
+	return KindPermanent
+}
+
+// wrapError classifies an error of the SQLite driver
+func (sdb *SQLiteDbController) wrapError(err error) error {
+	return wrapError(err, sqliteErrorKind)
+}
+
+// Insert inserts a single document using the updata params
+// It returns the number of inserted documents (1) or an error
+func (sdb *SQLiteDbController) Insert(ctx context.Context, document doc.DocType, params UpdateParams) (uint64, error) {
+	columns := documentColumns(document)
+	conflict := ""
+	if params.Upsert {
+		conflict = onConflictToSql(columns, true)
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) %s", quoteIdentifier(params.IndexName), quoteColumns(columns), sqlitePlaceholders(len(columns)), conflict)
+	result, err := sdb.Client.ExecContext(ctx, query, documentValues(document)...)
+	if err != nil {
+		return 0, sdb.wrapError(err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return uint64(rowsAffected), nil
+}
+
+func sqlitePlaceholders(count int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", count), ",")
+}
+
+// insertBulk inserts documents in a single transaction
+func (sdb *SQLiteDbController) insertBulk(ctx context.Context, bulk []doc.DocType, params UpdateParams) (uint64, error) {
+	txn, err := sdb.Client.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer txn.Rollback()
+
+	total, err := sqliteInsertInto(ctx, txn, bulk, params.IndexName, onConflictToSql(documentColumns(bulk[0]), params.Upsert))
+	if err != nil {
+		return 0, err
+	}
+	if err := txn.Commit(); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// sqliteInsertInto inserts documents within a transaction. conflict is the ON CONFLICT clause of the insert
+func sqliteInsertInto(ctx context.Context, txn *sql.Tx, bulk []doc.DocType, indexName string, conflict string) (uint64, error) {
+	columns := documentColumns(bulk[0])
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (%s) %s",
+		quoteIdentifier(indexName), quoteColumns(columns), sqlitePlaceholders(len(columns)), conflict,
+	)
+	stmt, err := txn.PrepareContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	var total uint64
+	for _, document := range bulk {
+		result, err := stmt.ExecContext(ctx, documentValues(document)...)
+		if err != nil {
+			return 0, err
+		}
+		rowsAffected, _ := result.RowsAffected()
+		total += uint64(rowsAffected)
+	}
+	return total, nil
+}
+
+// WriteBatch writes the documents of all batch items in a single transaction, retrying while the database is locked
+func (sdb *SQLiteDbController) WriteBatch(ctx context.Context, batch []BatchItem) error {
+	return retryTransient(ctx, sdb.wrapError, func() error {
+		txn, err := sdb.Client.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer txn.Rollback()
+		for _, item := range batch {
+			if len(item.Documents) == 0 {
+				continue
+			}
+			conflict := ""
+			if item.Params.Upsert || !item.FailOnConflict {
+				conflict = onConflictToSql(documentColumns(item.Documents[0]), item.Params.Upsert)
+			}
+			if _, err := sqliteInsertInto(ctx, txn, item.Documents, item.Params.IndexName, conflict); err != nil {
+				return err
+			}
+		}
+		return txn.Commit()
+	})
+}
+
+// InsertBulk inserts documents arriving in documentChannel in bulk using the updata params
+// It commits all documents until documentChannel is closed, unless ctx is cancelled
+// It returns the number of inserted documents or an error
+func (sdb *SQLiteDbController) InsertBulk(ctx context.Context, documentChannel chan doc.DocType, params UpdateParams) (uint64, error) {
+	var total uint64
+	var bulk []doc.DocType
+
+	begin := time.Now()
+	commitBulk := func(bulk []doc.DocType) error {
+		if len(bulk) == 0 {
+			return nil
+		}
+		rowsAffected, err := sdb.insertBulk(ctx, bulk, params)
+		if err != nil {
+			logger.Error().Err(err).Int("chunkSize", params.Size).Str("indexName", params.IndexName).Msg("Error while committing bulk")
+			return sdb.wrapError(err)
+		}
+		atomic.AddUint64(&total, rowsAffected)
+		dur := time.Since(begin).Seconds()
+		pps := int64(float64(total) / dur)
+		logger.Info().Int("chunkSize", params.Size).Uint64("total", total).Int64("perSecond", pps).Str("indexName", params.IndexName).Msg("Comitted bulk chunk")
+		return nil
+	}
+
+	for d := range documentChannel {
+		bulk = append(bulk, d)
+		if len(bulk) >= params.Size {
+			if err := commitBulk(bulk); err != nil {
+				return total, err
+			}
+			bulk = nil
+		}
+
+		select {
+		default:
+		case <-ctx.Done():
+			return total, sdb.wrapError(ctx.Err())
+		}
+	}
+	// Commit the final batch before exiting
+	if err := commitBulk(bulk); err != nil {
+		return total, err
+	}
+	return total, nil
+}
+
+// Delete removes documents specified by the query params
+func (sdb *SQLiteDbController) Delete(ctx context.Context, params QueryParams) (uint64, error) {
+	conditions, args := filterConditions(params, quoteIdentifier)
+	query := fmt.Sprintf("DELETE FROM %s %s", quoteIdentifier(params.IndexName), whereToSql(conditions))
+	result, err := sdb.Client.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, sdb.wrapError(err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return uint64(rowsAffected), nil
+}
+
+// UpdateField sets field to value in all documents specified by the query params that don't have this value yet
+func (sdb *SQLiteDbController) UpdateField(ctx context.Context, params QueryParams, field string, value interface{}) (uint64, error) {
+	conditions, filterArgs := filterConditions(params, quoteIdentifier)
+	conditions = append(conditions, quoteIdentifier(field)+" <> ?")
+	args := append(append([]interface{}{value}, filterArgs...), value)
+	query := fmt.Sprintf("UPDATE %s SET %s = ? %s", quoteIdentifier(params.IndexName), quoteIdentifier(field), whereToSql(conditions))
+	result, err := sdb.Client.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, sdb.wrapError(err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return uint64(rowsAffected), nil
+}
+
+// Count returns the number of documents matching the query params
+func (sdb *SQLiteDbController) Count(ctx context.Context, params QueryParams) (int64, error) {
+	var count int64
+	conditions, args := filterConditions(params, quoteIdentifier)
+	query := fmt.Sprintf("SELECT count(*) FROM %s %s", quoteIdentifier(params.IndexName), whereToSql(conditions))
+	err := sdb.Client.GetContext(ctx, &count, query, args...)
+	if err != nil {
+		return 0, sdb.wrapError(err)
+	}
+	return count, nil
+}
+
+// SelectOne selects a single document
+func (sdb *SQLiteDbController) SelectOne(ctx context.Context, params QueryParams, createDocument CreateDocFunction) (doc.DocType, error) {
+	conditions, args := filterConditions(params, quoteIdentifier)
+	query := fmt.Sprintf(
+		"SELECT %s FROM %s %s ORDER BY %s %s LIMIT 1 OFFSET %d",
+		quotedSelectFields(params.SelectFields),
+		quoteIdentifier(params.IndexName),
+		whereToSql(conditions),
+		quoteIdentifier(params.SortField),
+		booleanSortOrderToSql(params.SortAsc),
+		params.From,
+	)
+	document := createDocument()
+	err := sdb.Client.GetContext(ctx, document, query, args...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, sdb.wrapError(err)
+	}
+	return document, nil
+}
+
+// UpdateAlias updates an alias with a new index name
+func (sdb *SQLiteDbController) UpdateAlias(ctx context.Context, aliasName string, indexName string) error {
+	return sdb.UpdateAliases(ctx, map[string]string{aliasName: indexName})
+}
+
+// UpdateAliases updates several aliases with new index names in one transaction and drops stale tables.
+// SQLite cannot replace views, so each view is dropped and created again.
+func (sdb *SQLiteDbController) UpdateAliases(ctx context.Context, aliases map[string]string) error {
+	txn, err := sdb.Client.BeginTx(ctx, nil)
+	if err != nil {
+		return sdb.wrapError(err)
+	}
+	defer txn.Rollback()
+	swappedAt := time.Now().UnixNano()
+	for aliasName, indexName := range aliases {
+		if _, err := txn.ExecContext(ctx, fmt.Sprintf("DROP VIEW IF EXISTS %s", quoteIdentifier(aliasName))); err != nil {
+			return sdb.wrapError(err)
+		}
+		if _, err := txn.ExecContext(ctx, fmt.Sprintf("CREATE VIEW %s AS SELECT * FROM %s", quoteIdentifier(aliasName), quoteIdentifier(indexName))); err != nil {
+			return sdb.wrapError(err)
+		}
+		query := fmt.Sprintf("INSERT INTO %s (alias_name, index_name, swapped_at) VALUES (?, ?, ?) ON CONFLICT (alias_name, index_name) DO UPDATE SET swapped_at = excluded.swapped_at", sqliteAliasTable)
+		if _, err := txn.ExecContext(ctx, query, aliasName, indexName, swappedAt); err != nil {
+			return sdb.wrapError(err)
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return sdb.wrapError(err)
+	}
+
+	for aliasName := range aliases {
+		if err := sdb.dropStaleGenerations(ctx, aliasName); err != nil {
+			logger.Warn().Err(err).Str("aliasName", aliasName).Msg("Failed to drop previous tables")
+		}
+	}
+	return nil
+}
+
+// dropStaleGenerations drops the tables an alias pointed to before, except for the latest retainedGenerations
+func (sdb *SQLiteDbController) dropStaleGenerations(ctx context.Context, aliasName string) error {
+	var indexNames []string
+	query := fmt.Sprintf("SELECT index_name FROM %s WHERE alias_name = ? ORDER BY swapped_at DESC, index_name DESC", sqliteAliasTable)
+	if err := sdb.Client.SelectContext(ctx, &indexNames, query, aliasName); err != nil {
+		return err
+	}
+	if len(indexNames) <= 1+retainedGenerations {
+		return nil
+	}
+	for _, indexName := range indexNames[1+retainedGenerations:] {
+		if _, err := sdb.Client.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteIdentifier(indexName))); err != nil {
+			return err
+		}
+		query := fmt.Sprintf("DELETE FROM %s WHERE alias_name = ? AND index_name = ?", sqliteAliasTable)
+		if _, err := sdb.Client.ExecContext(ctx, query, aliasName, indexName); err != nil {
+			return err
+		}
+		logger.Info().Str("aliasName", aliasName).Str("indexName", indexName).Msg("Dropped previous table")
+	}
+	return nil
+}
+
+// GetExistingIndexPrefix checks for existing indices and returns the prefix, if any
+func (sdb *SQLiteDbController) GetExistingIndexPrefix(ctx context.Context, aliasName string, documentType string) (bool, string, error) {
+	var definition string
+	err := sdb.Client.GetContext(ctx, &definition, "SELECT sql FROM sqlite_master WHERE type = 'view' AND name = ?", aliasName)
+	if err == sql.ErrNoRows {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", sdb.wrapError(err)
+	}
+	matches := viewSourcePattern.FindStringSubmatch(definition)
+	if len(matches) < 2 {
+		return false, "", fmt.Errorf("could not find table in view definition %s", definition)
+	}
+	tableName := strings.Replace(matches[1], `""`, `"`, -1)
+	if !strings.HasSuffix(tableName, documentType) {
+		return false, "", fmt.Errorf("could not match table prefix in %s", tableName)
+	}
+	return true, strings.TrimSuffix(tableName, documentType), nil
+}
+
+// CreateIndex creates index according to documentType definition
+func (sdb *SQLiteDbController) CreateIndex(ctx context.Context, indexName string, documentType string) error {
+	statement := strings.Replace(doc.SQLiteSchemas[documentType], "%indexName%", indexName, -1)
+	if _, err := sdb.Client.ExecContext(ctx, statement); err != nil {
+		return sdb.wrapError(err)
+	}
+	return sdb.wrapError(storeSchemaVersion(ctx, sdb.Client, sqliteSchemaDialect, indexName, documentType))
+}
+
+// MigrateIndex adds missing columns and indexes of documentType's schema to an existing table
+func (sdb *SQLiteDbController) MigrateIndex(ctx context.Context, indexName string, documentType string) error {
+	return sdb.wrapError(migrateTable(ctx, sdb.Client, sqliteSchemaDialect, indexName, documentType, doc.SQLiteSchemas[documentType]))
+}
+
+// Scroll creates a new scroll instance with the specified query and unmarshal function
+func (sdb *SQLiteDbController) Scroll(ctx context.Context, params QueryParams, createDocument CreateDocFunction) ScrollInstance {
+	if params.Size <= 0 {
+		params.Size = defaultScrollSize
+	}
+	return &KeysetScrollInstance{
+		ctx:            ctx,
+		createDocument: createDocument,
+		client:         sdb.Client,
+		params:         params,
+		wrapError:      sdb.wrapError,
+	}
+}
@@ -14,6 +14,12 @@ type DocType interface {
 	SetID(string)
 }
 
+// Partitioned is implemented by documents of high-volume types, which can be split into partitions by time or block range
+type Partitioned interface {
+	DocType
+	PartitionKey() (time.Time, uint64)
+}
+
 // BaseEsType implements DocType and contains the document's id
 type BaseEsType struct {
 	Id string `json:"-" db:"id"`
@@ -25,7 +31,7 @@ func (m BaseEsType) GetID() string {
 }
 
 // SetID sets the document's id
-func (m BaseEsType) SetID(id string) {
+func (m *BaseEsType) SetID(id string) {
 	m.Id = id
 }
 
@@ -38,6 +44,7 @@ type EsBlock struct {
 	Size          int64     `json:"size" db:"size"`
 	RewardAccount string    `json:"reward_account" db:"reward_account"`
 	RewardAmount  string    `json:"reward_amount" db:"reward_amount"`
+	Confirmed     bool      `json:"confirmed" db:"confirmed"`
 }
 
 // EsTx is a transaction stored in the database
@@ -51,6 +58,12 @@ type EsTx struct {
 	AmountFloat float32             `json:"amount_float" db:"amount_float"` // float for sorting
 	Type        string              `json:"type" db:"type"`
 	Category    category.TxCategory `json:"category" db:"category"`
+	Confirmed   bool                `json:"confirmed" db:"confirmed"`
+}
+
+// PartitionKey returns the timestamp and block number of the transaction
+func (m EsTx) PartitionKey() (time.Time, uint64) {
+	return m.Timestamp, m.BlockNo
 }
 
 // EsName is a name-address mapping stored in the database
@@ -76,6 +89,11 @@ type EsTokenTransfer struct {
 	TokenId      string    `json:"token_id" db:"token_id"`
 }
 
+// PartitionKey returns the timestamp and block number of the token transfer
+func (m EsTokenTransfer) PartitionKey() (time.Time, uint64) {
+	return m.Timestamp, m.BlockNo
+}
+
 // EsToken is meta data of a token. The id is the contract address.
 type EsToken struct {
 	*BaseEsType
@@ -88,6 +106,58 @@ type EsToken struct {
 	Supply      string             `json:"supply" db:"supply"`
 }
 
+// EsCheckpoint is the persisted sync position of one alias prefix. The id is the alias prefix.
+type EsCheckpoint struct {
+	*BaseEsType
+	Timestamp     time.Time `json:"ts" db:"ts"`
+	BlockNo       uint64    `json:"blockno" db:"blockno"`               // last block up to which all blocks are committed
+	BlockHash     string    `json:"hash" db:"hash"`                     // hash of that block
+	IndexPrefix   string    `json:"index_prefix" db:"index_prefix"`     // prefix of the current index generation
+	Reindexing    bool      `json:"reindexing" db:"reindexing"`         // true while a reindex has not been swapped in yet
+	ReindexTarget uint64    `json:"reindex_target" db:"reindex_target"` // node height when the reindex was started
+	Confirmed     uint64    `json:"confirmed" db:"confirmed"`           // last block up to which all blocks are marked as confirmed
+	Completed     string    `json:"completed" db:"completed"`           // ranges of committed blocks above blockno, like 120-150,200-230
+}
+
+// EsFailedBlock is a block that could not be indexed completely. The id is the index prefix and block number.
+type EsFailedBlock struct {
+	*BaseEsType
+	Timestamp   time.Time `json:"ts" db:"ts"`
+	BlockNo     uint64    `json:"blockno" db:"blockno"`
+	IndexPrefix string    `json:"index_prefix" db:"index_prefix"`
+	Error       string    `json:"error" db:"error"`
+}
+
+// EsDeadLetter is a document that could not be written to its index. The id is the index name and document id.
+type EsDeadLetter struct {
+	*BaseEsType
+	Timestamp  time.Time `json:"ts" db:"ts"`
+	IndexName  string    `json:"index_name" db:"index_name"`
+	DocumentID string    `json:"document_id" db:"document_id"`
+	Error      string    `json:"error" db:"error"`
+	Source     string    `json:"source" db:"source"`
+}
+
+// SchemaVersion is the version of a document type's mapping and SQL schemas. Increment Version whenever they change.
+// New fields, columns, and indexes are added to existing indices automatically. For any other change, also raise
+// MinVersion to the new Version, so that older indices are rejected as requiring a full reindex.
+type SchemaVersion struct {
+	Version    int
+	MinVersion int
+}
+
+// SchemaVersions contains the current schema version of each document type
+var SchemaVersions = map[string]SchemaVersion{
+	"tx":             {Version: 1, MinVersion: 1},
+	"block":          {Version: 1, MinVersion: 1},
+	"name":           {Version: 1, MinVersion: 1},
+	"token_transfer": {Version: 1, MinVersion: 1},
+	"token":          {Version: 1, MinVersion: 1},
+	"checkpoint":     {Version: 2, MinVersion: 1},
+	"failed_block":   {Version: 1, MinVersion: 1},
+	"dead_letter":    {Version: 1, MinVersion: 1},
+}
+
 // EsMappings contains the elasticsearch mappings
 var EsMappings = map[string]string{
 	"tx": `{
@@ -117,6 +187,9 @@ var EsMappings = map[string]string{
 					},
 					"category": {
 						"type": "keyword"
+					},
+					"confirmed": {
+						"type": "boolean"
 					}
 				}
 			}
@@ -143,6 +216,9 @@ var EsMappings = map[string]string{
 					},
 					"reward_amount": {
 						"enabled": false
+					},
+					"confirmed": {
+						"type": "boolean"
 					}
 				}
 			}
@@ -229,6 +305,83 @@ var EsMappings = map[string]string{
 			}
 		}
 	}`,
+	"checkpoint": `{
+		"mappings":{
+			"checkpoint":{
+				"properties":{
+					"ts": {
+						"type": "date"
+					},
+					"blockno": {
+						"type": "long"
+					},
+					"hash": {
+						"type": "keyword"
+					},
+					"index_prefix": {
+						"type": "keyword"
+					},
+					"reindexing": {
+						"type": "boolean"
+					},
+					"reindex_target": {
+						"type": "long"
+					},
+					"confirmed": {
+						"type": "long"
+					},
+					"completed": {
+						"type": "keyword",
+						"index": false
+					}
+				}
+			}
+		}
+	}`,
+	"failed_block": `{
+		"mappings":{
+			"failed_block":{
+				"properties":{
+					"ts": {
+						"type": "date"
+					},
+					"blockno": {
+						"type": "long"
+					},
+					"index_prefix": {
+						"type": "keyword"
+					},
+					"error": {
+						"type": "text"
+					}
+				}
+			}
+		}
+	}`,
+	"dead_letter": `{
+		"mappings":{
+			"dead_letter":{
+				"properties":{
+					"ts": {
+						"type": "date"
+					},
+					"index_name": {
+						"type": "keyword"
+					},
+					"document_id": {
+						"type": "keyword"
+					},
+					"error": {
+						"type": "text"
+					},
+					"source": {
+						"type": "text",
+						"index": false
+					}
+				}
+			}
+		}
+	}`,
 }
 
 func mapCategoriesToStr(categories []category.TxCategory) []string {
@@ -254,6 +407,7 @@ var SQLSchemas = map[string]string{
 			amount_float FLOAT(23) NOT NULL,
 			type CHAR(1) NOT NULL,
 			category ENUM(` + categories + `) NOT NULL,
+			confirmed BOOLEAN NOT NULL DEFAULT 1,
 			PRIMARY KEY (id),
 			INDEX tx_from (` + "`" + `from` + "`" + `(10)),
 			INDEX tx_to (` + "`" + `to` + "`" + `(10)),
@@ -269,6 +423,7 @@ var SQLSchemas = map[string]string{
 			size MEDIUMINT UNSIGNED NOT NULL,
 			reward_account VARCHAR(52),
 			reward_amount VARCHAR(30),
+			confirmed BOOLEAN NOT NULL DEFAULT 1,
 			PRIMARY KEY (id),
 			INDEX block_no (no),
 			INDEX reward_account (no)
@@ -316,4 +471,132 @@ var SQLSchemas = map[string]string{
 			INDEX name_name (name),
 			INDEX name_address (tx_id)
 		);`,
+	"checkpoint": `
+		CREATE TABLE IF NOT EXISTS ` + "`" + `%indexName%` + "`" + ` (
+			id VARCHAR(64) NOT NULL UNIQUE,
+			ts DATETIME NOT NULL,
+			blockno BIGINT UNSIGNED NOT NULL,
+			hash VARCHAR(52) NOT NULL,
+			index_prefix VARCHAR(128) NOT NULL,
+			reindexing BOOLEAN NOT NULL,
+			reindex_target BIGINT UNSIGNED NOT NULL,
+			confirmed BIGINT UNSIGNED NOT NULL,
+			completed TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (id)
+		);`,
+	"failed_block": `
+		CREATE TABLE IF NOT EXISTS ` + "`" + `%indexName%` + "`" + ` (
+			id VARCHAR(150) NOT NULL UNIQUE,
+			ts DATETIME NOT NULL,
+			blockno BIGINT UNSIGNED NOT NULL,
+			index_prefix VARCHAR(128) NOT NULL,
+			error TEXT NOT NULL,
+			PRIMARY KEY (id),
+			INDEX failed_block_blockno (blockno)
+		);`,
 }
+
+// PostgresSchemas contains schema for PostgreSQL. Index names include the table name, as they have to be unique per schema.
+var PostgresSchemas = map[string]string{
+	"tx": `
+		CREATE TABLE "%indexName%" (
+			id CHAR(44) NOT NULL,
+			ts TIMESTAMP NOT NULL,
+			blockno BIGINT NOT NULL,
+			"from" VARCHAR(52) NOT NULL,
+			"to" VARCHAR(52),
+			amount VARCHAR(30) NOT NULL,
+			amount_float REAL NOT NULL,
+			type CHAR(1) NOT NULL,
+			category VARCHAR(20) NOT NULL CHECK (category IN (` + categories + `)),
+			confirmed BOOLEAN NOT NULL DEFAULT TRUE,
+			PRIMARY KEY (id)
+		);
+		CREATE INDEX "%indexName%_from" ON "%indexName%" ("from");
+		CREATE INDEX "%indexName%_to" ON "%indexName%" ("to");
+		CREATE INDEX "%indexName%_category" ON "%indexName%" (category);
+		CREATE INDEX "%indexName%_blockno" ON "%indexName%" (blockno);`,
+	"block": `
+		CREATE TABLE "%indexName%" (
+			id CHAR(44) NOT NULL,
+			ts TIMESTAMP NOT NULL,
+			no BIGINT NOT NULL,
+			txs INTEGER NOT NULL,
+			size INTEGER NOT NULL,
+			reward_account VARCHAR(52),
+			reward_amount VARCHAR(30),
+			confirmed BOOLEAN NOT NULL DEFAULT TRUE,
+			PRIMARY KEY (id)
+		);
+		CREATE INDEX "%indexName%_no" ON "%indexName%" (no);
+		CREATE INDEX "%indexName%_reward_account" ON "%indexName%" (reward_account);`,
+	"name": `
+		CREATE TABLE "%indexName%" (
+			id VARCHAR(60) NOT NULL,
+			name VARCHAR(12) NOT NULL,
+			address VARCHAR(52) NOT NULL,
+			blockno BIGINT NOT NULL,
+			tx CHAR(44) NOT NULL,
+			PRIMARY KEY (id)
+		);
+		CREATE INDEX "%indexName%_name" ON "%indexName%" (name);
+		CREATE INDEX "%indexName%_address" ON "%indexName%" (address);`,
+	"token_transfer": `
+		CREATE TABLE "%indexName%" (
+			id VARCHAR(60) NOT NULL,
+			tx_id CHAR(44) NOT NULL,
+			address VARCHAR(52) NOT NULL,
+			token_id VARCHAR(255) NULL,
+			ts TIMESTAMP NOT NULL,
+			blockno BIGINT NOT NULL,
+			"from" VARCHAR(52) NOT NULL,
+			"to" VARCHAR(52),
+			amount VARCHAR(30) NOT NULL,
+			amount_float REAL NOT NULL,
+			PRIMARY KEY (id)
+		);
+		CREATE INDEX "%indexName%_from" ON "%indexName%" ("from");
+		CREATE INDEX "%indexName%_to" ON "%indexName%" ("to");
+		CREATE INDEX "%indexName%_address" ON "%indexName%" (address);
+		CREATE INDEX "%indexName%_blockno" ON "%indexName%" (blockno);`,
+	"token": `
+		CREATE TABLE "%indexName%" (
+			id VARCHAR(52) NOT NULL,
+			tx_id CHAR(44) NOT NULL,
+			blockno BIGINT NOT NULL,
+			type VARCHAR(4) NOT NULL CHECK (type IN ('ARC1', 'ARC2')),
+			name VARCHAR(12) NOT NULL,
+			symbol VARCHAR(12) NOT NULL,
+			decimals SMALLINT NOT NULL,
+			supply VARCHAR(30) NOT NULL,
+			PRIMARY KEY (id)
+		);
+		CREATE INDEX "%indexName%_name" ON "%indexName%" (name);
+		CREATE INDEX "%indexName%_tx_id" ON "%indexName%" (tx_id);`,
+	"checkpoint": `
+		CREATE TABLE IF NOT EXISTS "%indexName%" (
+			id VARCHAR(64) NOT NULL,
+			ts TIMESTAMP NOT NULL,
+			blockno BIGINT NOT NULL,
+			hash VARCHAR(52) NOT NULL,
+			index_prefix VARCHAR(128) NOT NULL,
+			reindexing BOOLEAN NOT NULL,
+			reindex_target BIGINT NOT NULL,
+			confirmed BIGINT NOT NULL,
+			completed TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (id)
+		);`,
+	"failed_block": `
+		CREATE TABLE IF NOT EXISTS "%indexName%" (
+			id VARCHAR(150) NOT NULL,
+			ts TIMESTAMP NOT NULL,
+			blockno BIGINT NOT NULL,
+			index_prefix VARCHAR(128) NOT NULL,
+			error TEXT NOT NULL,
+			PRIMARY KEY (id)
+		);
+		CREATE INDEX IF NOT EXISTS "%indexName%_blockno" ON "%indexName%" (blockno);`,
+}
+
+// SQLiteSchemas contains schema for SQLite, which understands the PostgreSQL schemas
+var SQLiteSchemas = PostgresSchemas
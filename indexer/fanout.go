@@ -0,0 +1,170 @@
+package indexer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aergoio/aergo-indexer/indexer/db"
+)
+
+// backendCatchUpInterval is the interval in which failed backends are caught up in the background
+const backendCatchUpInterval = time.Minute
+
+// newFanOutDbController creates a db.FanOutDbController from a list of backends like
+// elastic=http://localhost:9200;mariadb=user:password@tcp(localhost:3306)/aergo. The first backend is the primary
+func newFanOutDbController(dbURL string) (db.DbController, error) {
+	backends := make([]*db.FanOutBackend, 0)
+	for _, backend := range strings.Split(dbURL, ";") {
+		parts := strings.SplitN(backend, "=", 2)
+		if len(parts) != 2 || parts[0] == "fanout" {
+			return nil, fmt.Errorf("invalid backend %s, expected dbtype=dburl", backend)
+		}
+		dbController, err := newDbController(parts[0], parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %s", parts[0], err)
+		}
+		backends = append(backends, &db.FanOutBackend{Name: fmt.Sprintf("%d-%s", len(backends), parts[0]), Controller: dbController})
+	}
+	return db.NewFanOutDbController(backends)
+}
+
+// fanOut returns the database as a db.FanOutDbController if several backends are written
+func (ns *Indexer) fanOut() (*db.FanOutDbController, bool) {
+	fanOut, ok := ns.db.(*db.FanOutDbController)
+	return fanOut, ok
+}
+
+// checkBackends marks secondary backends whose checkpoint is behind the primary's as failed.
+// This keeps their checkpoint from advancing past the blocks they are missing until they are caught up.
+func (ns *Indexer) checkBackends() {
+	fanOut, ok := ns.fanOut()
+	if !ok {
+		return
+	}
+	primary, err := ns.loadCheckpointFrom(fanOut.Primary())
+	if err != nil || primary == nil {
+		return
+	}
+	for _, backend := range fanOut.Secondaries() {
+		checkpoint, err := ns.loadCheckpointFrom(backend.Controller)
+		switch {
+		case err != nil:
+			fanOut.Fail(backend, err)
+		case checkpoint == nil || checkpoint.IndexPrefix != primary.IndexPrefix || checkpoint.BlockNo < primary.BlockNo:
+			fanOut.Fail(backend, errors.New("checkpoint is behind the primary"))
+		}
+	}
+}
+
+// ensureIndices creates the current indices and their aliases in dbController if they don't exist yet, or migrates them
+func (ns *Indexer) ensureIndices(dbController db.DbController) error {
+	for _, documentType := range []string{"tx", "block", "name", "token", "token_transfer"} {
+		aliasName := ns.aliasNamePrefix + documentType
+		indexName := ns.indexNamePrefix + documentType
+		exists, indexNamePrefix, err := dbController.GetExistingIndexPrefix(ns.writeCtx, aliasName, documentType)
+		if err != nil {
+			return err
+		}
+		if !exists || indexNamePrefix != ns.indexNamePrefix {
+			// The index may exist without the alias, e.g. while reindexing
+			if err := dbController.CreateIndex(ns.writeCtx, indexName, documentType); err != nil && dbController.MigrateIndex(ns.writeCtx, indexName, documentType) != nil {
+				return err
+			}
+			if !ns.reindexing {
+				if err := dbController.UpdateAlias(ns.writeCtx, aliasName, indexName); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := dbController.MigrateIndex(ns.writeCtx, indexName, documentType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// catchUpBackend indexes the blocks a failed backend missed, starting from its own checkpoint, while the other backends continue.
+// If the chain was reorganized below the checkpoint meanwhile, it starts after the last block the backend shares with the canonical chain.
+// New blocks are written to the backend as soon as the catch up begins, so it only needs the blocks up to the position at that moment.
+func (ns *Indexer) catchUpBackend(fanOut *db.FanOutDbController, backend *db.FanOutBackend) {
+	if err := ns.ensureIndices(backend.Controller); err != nil {
+		ns.log.Warn().Err(err).Str("backend", backend.Name).Msg("Failed to prepare indices of backend")
+		return
+	}
+	checkpoint, err := ns.loadCheckpointFrom(backend.Controller)
+	if err != nil {
+		ns.log.Warn().Err(err).Str("backend", backend.Name).Msg("Failed to load checkpoint of backend")
+		return
+	}
+	fromBlockHeight := uint64(0)
+	if checkpoint != nil && checkpoint.IndexPrefix == ns.indexNamePrefix {
+		// Blocks up to the checkpoint may have been replaced by a fork while the backend was skipped
+		ancestor, found, err := ns.findCommonAncestorIn(backend.Controller, checkpoint.BlockNo)
+		if err != nil {
+			ns.log.Warn().Err(err).Str("backend", backend.Name).Msg("Failed to find common ancestor of backend")
+			return
+		}
+		if found {
+			fromBlockHeight = ancestor + 1
+		}
+	}
+
+	// New blocks are committed together with the sync position under checkpointMutex, so each of them is either
+	// below the position read here, or committed after the backend receives writes again
+	ns.checkpointMutex.Lock()
+	fanOut.BeginCatchUp(backend)
+	toBlockHeight, _ := ns.getLastBlock()
+	ns.checkpointMutex.Unlock()
+	if fromBlockHeight <= toBlockHeight {
+		ns.log.Info().Str("backend", backend.Name).Uint64("from", fromBlockHeight).Uint64("to", toBlockHeight).Msg("Catching up backend")
+		// Blocks written after the checkpoint may be incomplete
+		ns.deleteBlocksInRangeFrom(backend.Controller, fromBlockHeight, toBlockHeight)
+		err = ns.fetchChunksInRange(ns.ctx, fromBlockHeight, toBlockHeight, func(chunk []*blockDocuments) error {
+			return db.WriteBatch(ns.writeCtx, backend.Controller, ns.blockBatchItems(chunk, false))
+		})
+		if err != nil {
+			fanOut.Fail(backend, err)
+			return
+		}
+	}
+	if fanOut.EndCatchUp(backend) {
+		ns.log.Info().Str("backend", backend.Name).Uint64("blockNo", toBlockHeight).Msg("Caught up backend")
+		ns.WriteCheckpoint()
+	}
+}
+
+// CatchUpBackends catches up all failed secondary backends one after another
+func (ns *Indexer) CatchUpBackends() {
+	fanOut, ok := ns.fanOut()
+	if !ok {
+		return
+	}
+	ns.backfills.Add(1)
+	defer ns.backfills.Done()
+	if ns.GetState() == StateIdle || ns.ctx.Err() != nil {
+		return
+	}
+	for _, backend := range fanOut.Secondaries() {
+		if ns.ctx.Err() != nil {
+			return
+		}
+		if state, _ := fanOut.State(backend); state == db.BackendFailed {
+			ns.catchUpBackend(fanOut, backend)
+		}
+	}
+}
+
+// CatchUpBackendsPeriodically calls CatchUpBackends in the background until the indexer is shut down
+func (ns *Indexer) CatchUpBackendsPeriodically() {
+	for {
+		ns.CatchUpBackends()
+		select {
+		case <-time.After(backendCatchUpInterval):
+		case <-ns.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/aergoio/aergo-indexer/indexer/db"
+	"github.com/aergoio/aergo-indexer/types"
+)
+
+// Finality modes
+const (
+	// FinalityNone indexes blocks as soon as they arrive
+	FinalityNone = ""
+	// FinalityDelay only indexes blocks once they are final
+	FinalityDelay = "delay"
+	// FinalityMark indexes blocks as soon as they arrive and marks them as confirmed once they are final
+	FinalityMark = "mark"
+)
+
+// errNoLastIrreversibleBlock is returned if the consensus of the chain does not have a last irreversible block
+var errNoLastIrreversibleBlock = errors.New("consensus does not report a last irreversible block")
+
+// consensusLib is the part of the consensus info containing the last irreversible block
+type consensusLib struct {
+	LibNo *uint64 `json:"LibNo"`
+}
+
+// GetLastIrreversibleBlock queries the node for the last irreversible block
+func (ns *Indexer) GetLastIrreversibleBlock() (uint64, error) {
+	consensusInfo, err := ns.client().GetConsensusInfo(context.Background(), &types.Empty{})
+	if err != nil {
+		return 0, err
+	}
+	var lib consensusLib
+	if err := json.Unmarshal([]byte(consensusInfo.Info), &lib); err != nil {
+		return 0, err
+	}
+	if lib.LibNo == nil {
+		return 0, errNoLastIrreversibleBlock
+	}
+	return *lib.LibNo, nil
+}
+
+// updateFinalHeight calculates the highest final block given the best known block height.
+// With ns.confirmations set, a block is final when it is that many blocks deep.
+// Otherwise, the last irreversible block reported by the consensus is used. If it cannot be queried, the final height is kept.
+func (ns *Indexer) updateFinalHeight(bestHeight uint64) uint64 {
+	finalHeight := bestHeight
+	if ns.confirmations > 0 {
+		finalHeight = 0
+		if bestHeight >= ns.confirmations {
+			finalHeight = bestHeight - ns.confirmations
+		}
+	} else {
+		lib, err := ns.GetLastIrreversibleBlock()
+		if err != nil {
+			ns.log.Warn().Err(err).Msg("Failed to query last irreversible block, keeping final height")
+			return atomic.LoadUint64(&ns.finalHeight)
+		}
+		if lib < bestHeight {
+			finalHeight = lib
+		}
+	}
+	atomic.StoreUint64(&ns.finalHeight, finalHeight)
+	return finalHeight
+}
+
+// checkFinality returns an error if blocks can never become final in the finality mode, because neither confirmations are
+// configured nor does the consensus report a last irreversible block
+func (ns *Indexer) checkFinality() error {
+	if ns.finalityMode == FinalityNone || ns.confirmations > 0 {
+		return nil
+	}
+	_, err := ns.GetLastIrreversibleBlock()
+	if err == errNoLastIrreversibleBlock {
+		return fmt.Errorf("finality mode %s requires confirmations, as the %s", ns.finalityMode, err)
+	}
+	if err != nil {
+		ns.log.Warn().Err(err).Msg("Failed to query last irreversible block")
+	}
+	return nil
+}
+
+// isConfirmed returns whether documents of blockNo are stored as confirmed
+func (ns *Indexer) isConfirmed(blockNo uint64) bool {
+	return ns.finalityMode != FinalityMark || blockNo <= atomic.LoadUint64(&ns.finalHeight)
+}
+
+// processBlock passes a streamed block on to SyncBlock according to the finality mode
+func (ns *Indexer) processBlock(block *types.Block) {
+	switch ns.finalityMode {
+	case FinalityDelay:
+		ns.delayBlock(block)
+	case FinalityMark:
+		ns.updateFinalHeight(block.Header.BlockNo)
+		ns.SyncBlock(block)
+		ns.confirmBlocks()
+	default:
+		ns.SyncBlock(block)
+	}
+}
+
+// delayBlock holds back a block until it is final, and syncs all held back blocks that have become final
+func (ns *Indexer) delayBlock(block *types.Block) {
+	newHeight := block.Header.BlockNo
+	// A block at or below a held back height replaces the held back fork
+	for i, unconfirmed := range ns.unconfirmedBlocks {
+		if unconfirmed.Header.BlockNo >= newHeight {
+			ns.unconfirmedBlocks = ns.unconfirmedBlocks[:i]
+			break
+		}
+	}
+	ns.unconfirmedBlocks = append(ns.unconfirmedBlocks, block)
+
+	finalHeight := ns.updateFinalHeight(newHeight)
+	for len(ns.unconfirmedBlocks) > 0 && ns.unconfirmedBlocks[0].Header.BlockNo <= finalHeight && ns.ctx.Err() == nil {
+		ns.SyncBlock(ns.unconfirmedBlocks[0])
+		ns.unconfirmedBlocks = ns.unconfirmedBlocks[1:]
+	}
+}
+
+// confirmBlocks marks blocks and txs as confirmed that have become final since the last call.
+// Only blocks below the checkpoint are considered, so blocks that are still being backfilled are not skipped.
+func (ns *Indexer) confirmBlocks() {
+	confirmed := atomic.LoadUint64(&ns.confirmedHeight)
+	target := atomic.LoadUint64(&ns.finalHeight)
+	if contiguous, _ := ns.getContiguousBlock(); contiguous < target {
+		target = contiguous
+	}
+	if target <= confirmed {
+		return
+	}
+	for _, typeName := range []string{"block", "tx"} {
+		field := "blockno"
+		if typeName == "block" {
+			field = "no"
+		}
+		err := ns.withDbRetry(ns.writeCtx, func() error {
+			_, err := ns.db.UpdateField(ns.writeCtx, db.QueryParams{
+				IndexName:    ns.indexNamePrefix + typeName,
+				TypeName:     typeName,
+				IntegerRange: &db.IntegerRangeQuery{Field: field, Min: confirmed + 1, Max: target},
+			}, "confirmed", true)
+			return err
+		})
+		if err != nil {
+			ns.log.Warn().Err(err).Str("typeName", typeName).Uint64("from", confirmed+1).Uint64("to", target).Msg("Failed to mark documents as confirmed")
+			return
+		}
+	}
+	atomic.StoreUint64(&ns.confirmedHeight, target)
+}
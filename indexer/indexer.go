@@ -2,7 +2,6 @@ package indexer
 
 import (
 	"context"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,86 +16,141 @@ import (
 	"github.com/aergoio/aergo-indexer/types"
 	"github.com/aergoio/aergo-lib/log"
 	"github.com/mr-tron/base58/base58"
-
-	distributedLock "github.com/graup/es-distributed-lock"
 )
 
 // Indexer hold all state information
 type Indexer struct {
-	db              db.DbController
-	grpcClient      types.AergoRPCServiceClient
-	aliasNamePrefix string
-	indexNamePrefix string
-	lastBlockHeight uint64
-	lastBlockHash   string
-	log             *log.Logger
-	reindexing      bool
-	exitOnComplete  bool
-	State           string
-	BulkState       string
-	stream          types.AergoRPCService_ListBlockStreamClient
-	startFrom       int64
-	stopAt          int64
-	idleOnConflict  int32
-	esLock          *distributedLock.Lock
+	db                db.DbController
+	nodes             *NodePool
+	aliasNamePrefix   string
+	indexNamePrefix   string
+	lastBlockHeight   uint64
+	lastBlockHash     string
+	lastBlockMutex    sync.RWMutex
+	blockQueue        chan *types.Block
+	checkpointMutex   sync.Mutex
+	chainMutex        sync.Mutex
+	pendingBackfills  map[*backfill]bool
+	reindexTarget     uint64
+	log               *log.Logger
+	reindexing        bool
+	exitOnComplete    bool
+	state             State
+	runningBulks      int
+	stateMutex        sync.Mutex
+	stateSubscribers  []chan StateChange
+	finished          chan struct{}
+	isFinished        bool
+	stream            types.AergoRPCService_ListBlockStreamClient
+	cancelStream      context.CancelFunc
+	streamMutex       sync.Mutex
+	startFrom         int64
+	stopAt            int64
+	idleOnConflict    int32
+	workers           int
+	retries           int
+	finalityMode      string
+	confirmations     uint64
+	finalHeight       uint64
+	confirmedHeight   uint64
+	unconfirmedBlocks []*types.Block
+	ctx               context.Context
+	cancel            context.CancelFunc
+	writeCtx          context.Context
+	cancelWrites      context.CancelFunc
+	sequencerDone     chan struct{}
+	backfills         sync.WaitGroup
+	shutdownOnce      sync.Once
+	shutdownErr       error
+	lock              db.Locker
+	lockTTL           time.Duration
+	lockKeepAlive     time.Duration
 }
 
 // NewIndexer creates new Indexer instance
 func NewIndexer(logger *log.Logger, dbType string, dbURL string, namePrefix string) (*Indexer, error) {
 	aliasNamePrefix := namePrefix
-	var dbController db.DbController
-	var err error
-	switch dbType {
-	case "elastic":
-		dbController, err = db.NewElasticsearchDbController(dbURL)
-	case "mariadb":
-		dbController, err = db.NewMariaDbController(dbURL)
-	default:
-		return nil, fmt.Errorf("Invalid database type: %s", dbType)
-	}
+	dbController, err := newDbController(dbType, dbURL)
 	if err != nil {
 		return nil, err
 	}
 	logger.Info().Str("dbType", dbType).Str("dbURL", dbURL).Msg("Initialized database connection")
 	svc := &Indexer{
-		db:              dbController,
-		aliasNamePrefix: aliasNamePrefix,
-		indexNamePrefix: generateIndexPrefix(aliasNamePrefix),
-		lastBlockHeight: 0,
-		lastBlockHash:   "",
-		State:           "booting",
-		BulkState:       "finished",
-		log:             logger,
-		reindexing:      false,
-		exitOnComplete:  false,
-		startFrom:       0,
-		stopAt:          -1,
-	}
-	if dbType == "elastic" {
-		elasticClient := dbController.(*db.ElasticsearchDbController).Client
-		svc.esLock = distributedLock.NewLock(elasticClient, aliasNamePrefix)
-		svc.log.Info().Str("client", svc.esLock.Owner).Msg("Initialized lock")
+		db:               dbController,
+		aliasNamePrefix:  aliasNamePrefix,
+		indexNamePrefix:  generateIndexPrefix(aliasNamePrefix),
+		lastBlockHeight:  0,
+		lastBlockHash:    "",
+		pendingBackfills: make(map[*backfill]bool),
+		state:            StateBooting,
+		finished:         make(chan struct{}),
+		log:              logger,
+		reindexing:       false,
+		exitOnComplete:   false,
+		startFrom:        0,
+		stopAt:           -1,
+		workers:          1,
+		lockTTL:          20 * time.Second,
+		lockKeepAlive:    2 * time.Second,
+	}
+	// ctx is cancelled to stop receiving and fetching blocks. Writes use writeCtx, which is only cancelled when draining times out
+	svc.ctx, svc.cancel = context.WithCancel(context.Background())
+	svc.writeCtx, svc.cancelWrites = context.WithCancel(context.Background())
+	lockDb := dbController
+	if fanOut, ok := dbController.(*db.FanOutDbController); ok {
+		lockDb = fanOut.Primary()
+	}
+	if lockProvider, ok := lockDb.(db.LockProvider); ok {
+		svc.lock = lockProvider.NewLock(aliasNamePrefix)
+		svc.log.Info().Str("client", svc.lock.Owner()).Msg("Initialized lock")
 	}
 	return svc, nil
 }
 
+// newDbController connects to the database of dbType
+func newDbController(dbType string, dbURL string) (db.DbController, error) {
+	switch dbType {
+	case "elastic":
+		return db.NewElasticsearchDbController(dbURL)
+	case "mariadb":
+		return db.NewMariaDbController(dbURL)
+	case "postgres":
+		return db.NewPostgresDbController(dbURL)
+	case "sqlite":
+		return db.NewSQLiteDbController(dbURL)
+	case "memory":
+		return db.NewMemoryDbController(), nil
+	case "file":
+		return db.NewFileDbController(dbURL)
+	case "fanout":
+		return newFanOutDbController(dbURL)
+	}
+	return nil, fmt.Errorf("Invalid database type: %s", dbType)
+}
+
 func generateIndexPrefix(aliasNamePrefix string) string {
 	return fmt.Sprintf("%s%s_", aliasNamePrefix, time.Now().UTC().Format("2006-01-02_15-04-05"))
 }
 
-// CreateIndexIfNotExists creates the indices and aliases in ES
-func (ns *Indexer) CreateIndexIfNotExists(documentType string) {
+// CreateIndexIfNotExists creates the indices and aliases in ES, or migrates existing indices to the current schema.
+// It fails if an existing index requires a full reindex.
+func (ns *Indexer) CreateIndexIfNotExists(documentType string) error {
 	initialized := true
 	aliasName := ns.aliasNamePrefix + documentType
 	// Check for existing index to find out current indexNamePrefix
 	if !ns.reindexing {
-		exists, indexNamePrefix, err := ns.db.GetExistingIndexPrefix(aliasName, documentType)
+		exists, indexNamePrefix, err := ns.db.GetExistingIndexPrefix(ns.writeCtx, aliasName, documentType)
 		if err != nil {
 			ns.log.Error().Err(err).Msg("Error when checking for alias")
 		}
 		if exists {
 			ns.log.Info().Str("aliasName", aliasName).Str("indexNamePrefix", indexNamePrefix).Msg("Alias found")
 			ns.indexNamePrefix = indexNamePrefix
+			indexName := indexNamePrefix + documentType
+			if err := ns.db.MigrateIndex(ns.writeCtx, indexName, documentType); err != nil {
+				ns.log.Error().Err(err).Str("indexName", indexName).Msg("Error when migrating index")
+				return err
+			}
 		} else {
 			initialized = false
 			ns.reindexing = false
@@ -106,7 +160,7 @@ func (ns *Indexer) CreateIndexIfNotExists(documentType string) {
 	if ns.reindexing || !initialized {
 		indexName := ns.indexNamePrefix + documentType
 
-		err := ns.db.CreateIndex(indexName, documentType)
+		err := ns.db.CreateIndex(ns.writeCtx, indexName, documentType)
 		if err != nil {
 			ns.log.Error().Err(err).Str("indexName", indexName).Msg("Error when creating index")
 		} else {
@@ -114,7 +168,7 @@ func (ns *Indexer) CreateIndexIfNotExists(documentType string) {
 		}
 		// Update alias, only when initializing and not reindexing
 		if !ns.reindexing {
-			err = ns.db.UpdateAlias(aliasName, indexName)
+			err = ns.db.UpdateAlias(ns.writeCtx, aliasName, indexName)
 			if err != nil {
 				ns.log.Error().Err(err).Str("aliasName", aliasName).Str("indexName", indexName).Msg("Error when updating alias")
 			} else {
@@ -122,17 +176,20 @@ func (ns *Indexer) CreateIndexIfNotExists(documentType string) {
 			}
 		}
 	}
+	return nil
 }
 
-// UpdateAliasForType updates aliases
-func (ns *Indexer) UpdateAliasForType(documentType string) {
-	aliasName := ns.aliasNamePrefix + documentType
-	indexName := ns.indexNamePrefix + documentType
-	err := ns.db.UpdateAlias(aliasName, indexName)
+// UpdateAliasesForTypes points the aliases of all documentTypes to the current indices at once
+func (ns *Indexer) UpdateAliasesForTypes(documentTypes ...string) {
+	aliases := make(map[string]string, len(documentTypes))
+	for _, documentType := range documentTypes {
+		aliases[ns.aliasNamePrefix+documentType] = ns.indexNamePrefix + documentType
+	}
+	err := ns.db.UpdateAliases(ns.writeCtx, aliases)
 	if err != nil {
-		ns.log.Warn().Err(err).Str("aliasName", aliasName).Str("indexName", indexName).Msg("Error when updating alias")
+		ns.log.Warn().Err(err).Str("indexNamePrefix", ns.indexNamePrefix).Msg("Error when updating aliases")
 	} else {
-		ns.log.Info().Err(err).Str("aliasName", aliasName).Str("indexName", indexName).Msg("Updated alias")
+		ns.log.Info().Str("aliasNamePrefix", ns.aliasNamePrefix).Str("indexNamePrefix", ns.indexNamePrefix).Msg("Updated aliases")
 	}
 }
 
@@ -140,11 +197,8 @@ func (ns *Indexer) UpdateAliasForType(documentType string) {
 func (ns *Indexer) OnSyncComplete() {
 	if ns.reindexing {
 		ns.reindexing = false
-		ns.UpdateAliasForType("tx")
-		ns.UpdateAliasForType("block")
-		ns.UpdateAliasForType("name")
-		ns.UpdateAliasForType("token")
-		ns.UpdateAliasForType("token_transfer")
+		ns.UpdateAliasesForTypes("tx", "block", "name", "token", "token_transfer")
+		ns.WriteCheckpoint()
 	}
 	ns.log.Info().Msg("Initial sync complete")
 	if ns.exitOnComplete {
@@ -153,20 +207,50 @@ func (ns *Indexer) OnSyncComplete() {
 }
 
 // Start setups the indexer
-func (ns *Indexer) Start(grpcClient types.AergoRPCServiceClient, reindex bool, exitOnComplete bool, startFrom int64, stopAt int64, idleOnConflict int32) error {
-	ns.grpcClient = grpcClient
+func (ns *Indexer) Start(nodes *NodePool, reindex bool, exitOnComplete bool, startFrom int64, stopAt int64, idleOnConflict int32, workers int, finalityMode string, confirmations uint64, retries int) error {
+	ns.nodes = nodes
+
+	switch finalityMode {
+	case FinalityNone, FinalityDelay, FinalityMark:
+	default:
+		return fmt.Errorf("Invalid finality mode: %s", finalityMode)
+	}
+	ns.finalityMode = finalityMode
+	ns.confirmations = confirmations
+	if err := ns.checkFinality(); err != nil {
+		return err
+	}
+	if finalityMode != FinalityNone {
+		ns.log.Info().Str("finalityMode", finalityMode).Uint64("confirmations", confirmations).Msg("Only treating blocks as final once confirmed")
+	}
 
-	if reindex {
+	checkpoint, err := ns.LoadCheckpoint()
+	if err != nil {
+		ns.log.Warn().Err(err).Msg("Failed to load checkpoint")
+	}
+	resumeReindex := checkpoint != nil && checkpoint.Reindexing
+	// Backends that are behind must not receive writes before they are caught up
+	ns.checkBackends()
+	if resumeReindex {
+		ns.log.Warn().Str("indexNamePrefix", checkpoint.IndexPrefix).Uint64("checkpoint", checkpoint.BlockNo).Uint64("target", checkpoint.ReindexTarget).Msg("Resuming interrupted reindex. Will replace index aliases when caught up")
+		ns.reindexing = true
+		ns.exitOnComplete = exitOnComplete
+		ns.indexNamePrefix = checkpoint.IndexPrefix
+		ns.reindexTarget = checkpoint.ReindexTarget
+	} else if reindex {
 		ns.log.Warn().Msg("Reindexing database. Will sync from scratch and replace index aliases when caught up")
 		ns.reindexing = true
 		ns.exitOnComplete = exitOnComplete
 	}
 
-	ns.CreateIndexIfNotExists("tx")
-	ns.CreateIndexIfNotExists("block")
-	ns.CreateIndexIfNotExists("name")
-	ns.CreateIndexIfNotExists("token")
-	ns.CreateIndexIfNotExists("token_transfer")
+	// Indices of an interrupted reindex already exist
+	if !resumeReindex {
+		for _, documentType := range []string{"tx", "block", "name", "token", "token_transfer"} {
+			if err := ns.CreateIndexIfNotExists(documentType); err != nil {
+				return err
+			}
+		}
+	}
 
 	ns.startFrom = startFrom
 	ns.stopAt = stopAt
@@ -175,13 +259,16 @@ func (ns *Indexer) Start(grpcClient types.AergoRPCServiceClient, reindex bool, e
 	}
 
 	ns.idleOnConflict = idleOnConflict
+	ns.workers = workers
+	ns.retries = retries
 
-	if ns.reindexing {
+	if ns.reindexing && !resumeReindex {
 		// Don't wait for sync to start when blockchain is booting from genesis
 		nodeBlockheight, err := ns.GetNodeBlockHeight()
 		if err != nil {
 			ns.log.Warn().Err(err).Msg("Failed to query node's block height")
 		} else {
+			ns.reindexTarget = nodeBlockheight
 			if nodeBlockheight == 0 {
 				ns.OnSyncComplete()
 			}
@@ -191,15 +278,34 @@ func (ns *Indexer) Start(grpcClient types.AergoRPCServiceClient, reindex bool, e
 	// Initially, wait for a lock
 	ns.WaitForLock()
 
-	// Get ready to start
-	ns.UpdateLastBlockHeightFromDb()
-	ns.log.Info().Uint64("last block height", ns.lastBlockHeight).Msg("Started Indexer")
+	// Get ready to start. The checkpoint is read again as another instance may have advanced it while we were waiting
+	ns.checkBackends()
+	ns.RestorePosition()
+	ns.WriteCheckpoint()
+	lastBlockHeight, _ := ns.getLastBlock()
+	ns.log.Info().Uint64("last block height", lastBlockHeight).Msg("Started Indexer")
+	failedBlocks, err := ns.GetFailedBlocks()
+	if err != nil {
+		ns.log.Warn().Err(err).Msg("Failed to query failed blocks")
+	} else if len(failedBlocks) > 0 {
+		ns.log.Warn().Int("failedBlocks", len(failedBlocks)).Uint64("lowest", failedBlocks[0]).Msg("Index is incomplete, will retry failed blocks")
+	}
+	ns.startSequencer()
+	go ns.RetryFailedBlocksPeriodically()
+	go ns.CatchUpBackendsPeriodically()
+	if nodes.Len() > 1 {
+		go ns.monitorNodes()
+	}
 
 	if !ns.reindexing {
-		go ns.CheckConsistency()
+		ns.backfills.Add(1)
+		go func() {
+			defer ns.backfills.Done()
+			ns.CheckConsistency()
+		}()
 	}
 
-	err := ns.StartStream()
+	err = ns.StartStream()
 	if err != nil {
 		ns.log.Error().Err(err).Msg("Failed to start stream")
 		ns.RestartStream()
@@ -207,14 +313,42 @@ func (ns *Indexer) Start(grpcClient types.AergoRPCServiceClient, reindex bool, e
 	return nil
 }
 
-// WaitForLock repeatedly tries to acquire lock, indefinitely
+// ConfigurePartitioning splits the indices of high-volume document types by month or into block ranges, as parsed by db.ParsePartitioning.
+// Partitioning has to be configured the same way for all runs using the same indices.
+func (ns *Indexer) ConfigurePartitioning(spec string) error {
+	partitioning, err := db.ParsePartitioning(spec)
+	if err != nil || partitioning == nil {
+		return err
+	}
+	partitionable, ok := ns.db.(db.Partitionable)
+	if !ok {
+		return errors.New("partitioning is only supported by Elasticsearch and MariaDB")
+	}
+	return partitionable.SetPartitioning(partitioning)
+}
+
+// ConfigureLock sets the lease ttl and keepalive interval of the lock.
+// If lockFile is set, a file lock is used instead of the database's lock, e.g. for databases that cannot provide one.
+func (ns *Indexer) ConfigureLock(lockFile string, ttl time.Duration, keepAlive time.Duration) {
+	ns.lockTTL = ttl
+	ns.lockKeepAlive = keepAlive
+	if lockFile != "" {
+		ns.lock = db.NewFileLock(lockFile)
+		ns.log.Info().Str("client", ns.lock.Owner()).Str("lockFile", lockFile).Msg("Initialized file lock")
+	}
+}
+
+// WaitForLock repeatedly tries to acquire lock, until it succeeds or the indexer is shut down
 func (ns *Indexer) WaitForLock() error {
-	if ns.esLock == nil {
+	if ns.lock == nil {
 		return nil
 	}
 	err := ns.AcquireLock()
 	retry := 0
 	for err != nil {
+		if ns.ctx.Err() != nil {
+			return ns.ctx.Err()
+		}
 		if retry%6 == 0 {
 			ns.log.Info().Err(err).Msg("Waiting for lock...")
 		}
@@ -227,21 +361,21 @@ func (ns *Indexer) WaitForLock() error {
 
 // AcquireLock uses distributed lock (if available) to acquire a lock
 func (ns *Indexer) AcquireLock() error {
-	if ns.esLock != nil {
+	if ns.lock != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5)*time.Second)
 		defer cancel()
-		if err := ns.esLock.Acquire(ctx, 20*time.Second); err != nil {
+		if err := ns.lock.Acquire(ctx, ns.lockTTL); err != nil {
 			return err
 		}
 		ns.log.Info().Msg("Acquired lock")
-		ns.esLock.KeepAlive(context.Background(), 2*time.Second)
+		ns.lock.KeepAlive(context.Background(), ns.lockKeepAlive)
 	}
 	return nil
 }
 
-// StartStream starts the block stream and calls SyncBlock
+// StartStream starts the block stream and queues received blocks for SyncBlock
 func (ns *Indexer) StartStream() error {
-	if ns.esLock != nil && !ns.esLock.IsAcquired() {
+	if ns.lock != nil && !ns.lock.IsAcquired() {
 		ns.log.Warn().Msg("did not acquire lock before starting")
 		// Don't error, instead try to restart the stream
 		ns.RestartStream()
@@ -249,19 +383,22 @@ func (ns *Indexer) StartStream() error {
 	}
 
 	// Connect to GRPC stream
-	var err error
-	ns.stream, err = ns.grpcClient.ListBlockStream(context.Background(), &types.Empty{})
+	stream, err := ns.openStream()
 	if err != nil {
 		return err
 	}
-	ns.State = "running"
+	if !ns.setState(StateRunning) {
+		// Stopped in the meantime
+		ns.closeStream()
+		return nil
+	}
 	go func() {
 		for {
-			if ns.State == "stopped" || ns.State == "idle" {
+			block, err := stream.Recv()
+			if ns.ctx.Err() != nil || !ns.isCurrentStream(stream) {
 				ns.log.Info().Msg("Stream was stopped")
 				return
 			}
-			block, err := ns.stream.Recv()
 			if err == io.EOF {
 				ns.log.Warn().Msg("Stream ended")
 				ns.RestartStream()
@@ -272,31 +409,79 @@ func (ns *Indexer) StartStream() error {
 				ns.RestartStream()
 				return
 			}
-			go ns.SyncBlock(block)
+			ns.enqueueBlock(block)
 		}
 	}()
 	return nil
 }
 
-// RestartStream restarts the streem after a few seconds and keeps trying to start
-// This happens when the stream stopped during operation
-func (ns *Indexer) RestartStream() {
+// openStream connects to the block stream and makes it the current stream
+func (ns *Indexer) openStream() (types.AergoRPCService_ListBlockStreamClient, error) {
+	ctx, cancel := context.WithCancel(ns.ctx)
+	stream, err := ns.client().ListBlockStream(ctx, &types.Empty{})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	ns.streamMutex.Lock()
+	defer ns.streamMutex.Unlock()
+	ns.stream = stream
+	ns.cancelStream = cancel
+	return stream, nil
+}
+
+// closeStream closes the current block stream, if any
+func (ns *Indexer) closeStream() {
+	ns.streamMutex.Lock()
+	defer ns.streamMutex.Unlock()
 	if ns.stream != nil {
-		ns.stream.CloseSend()
+		ns.cancelStream()
 		ns.stream = nil
+		ns.cancelStream = nil
 	}
-	if ns.esLock != nil {
-		// Release lock to give other instances a chance to take over
-		if err := ns.esLock.MustRelease(); err != nil {
+}
+
+// isCurrentStream returns whether stream has not been closed or replaced
+func (ns *Indexer) isCurrentStream(stream types.AergoRPCService_ListBlockStreamClient) bool {
+	ns.streamMutex.Lock()
+	defer ns.streamMutex.Unlock()
+	return ns.stream == stream
+}
+
+// releaseLock releases the distributed lock, if any
+func (ns *Indexer) releaseLock() {
+	if ns.lock != nil {
+		if err := ns.lock.Release(); err != nil {
 			ns.log.Warn().Err(err).Msg("Failed to release lock")
 		} else {
 			ns.log.Info().Msg("Released lock")
 		}
 	}
+}
+
+// RestartStream restarts the streem after a few seconds and keeps trying to start
+// This happens when the stream stopped during operation
+func (ns *Indexer) RestartStream() {
+	if !ns.setState(StateRestarting) {
+		// Stopped in the meantime
+		return
+	}
+	ns.closeStream()
+	// Release lock to give other instances a chance to take over
+	ns.releaseLock()
 	ns.log.Info().Msg("Restarting stream in 6 seconds")
-	ns.State = "restarting"
-	time.Sleep(6 * time.Second)
-	ns.WaitForLock()
+	select {
+	case <-time.After(6 * time.Second):
+	case <-ns.ctx.Done():
+		return
+	}
+	if err := ns.WaitForLock(); err != nil {
+		return
+	}
+	// The stream may have failed because the node is down, so continue with the best reachable node
+	if _, err := ns.nodes.SelectBest(ns.ctx, 0); err != nil {
+		ns.log.Warn().Err(err).Msg("Failed to check aergo servers")
+	}
 	err := ns.StartStream()
 	if err != nil {
 		ns.log.Error().Err(err).Msg("Failed to restart stream")
@@ -304,19 +489,63 @@ func (ns *Indexer) RestartStream() {
 	}
 }
 
-// Stop stops the indexer
+// Stop stops the indexer. A stopped indexer cannot be started again
 func (ns *Indexer) Stop() {
-	if ns.esLock != nil {
-		if err := ns.esLock.MustRelease(); err != nil {
-			ns.log.Warn().Err(err).Msg("Failed to release lock")
-		} else {
-			ns.log.Info().Msg("Released lock")
+	ns.setState(StateStopped)
+	ns.releaseLock()
+	ns.closeStream()
+}
+
+// Shutdown stops receiving and fetching blocks, and waits until the block being synced and all fetched documents are committed.
+// Then, it writes the checkpoint, completes the output of databases that buffer writes, and releases the lock.
+// If draining takes longer than timeout, pending writes are aborted and the checkpoint is not updated.
+// If the indexer already stopped by itself, it only waits for the remaining goroutines, as the lock has been released.
+// Only the first call shuts down the indexer, later calls wait for it and return the same result.
+func (ns *Indexer) Shutdown(timeout time.Duration) error {
+	ns.shutdownOnce.Do(func() {
+		ns.shutdownErr = ns.shutdown(timeout)
+	})
+	return ns.shutdownErr
+}
+
+func (ns *Indexer) shutdown(timeout time.Duration) error {
+	stopped := ns.GetState() == StateStopped
+	ns.log.Info().Dur("timeout", timeout).Msg("Draining indexer")
+	ns.cancel()
+
+	drained := make(chan struct{})
+	go func() {
+		if ns.sequencerDone != nil {
+			<-ns.sequencerDone
+		}
+		ns.backfills.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+		if !stopped {
+			ns.WriteCheckpoint()
 		}
+		ns.closeDb()
+		ns.log.Info().Msg("Drained indexer")
+	case <-time.After(timeout):
+		ns.cancelWrites()
+		err = errors.New("timed out waiting for pending writes")
 	}
-	if ns.stream != nil {
-		ns.stream.CloseSend()
-		ns.stream = nil
-		ns.State = "stopped"
+	if !stopped {
+		ns.Stop()
+	}
+	return err
+}
+
+// closeDb completes the output of databases that buffer writes, like the file database
+func (ns *Indexer) closeDb() {
+	if closer, ok := ns.db.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			ns.log.Warn().Err(err).Msg("Failed to close database")
+		}
 	}
 }
 
@@ -324,42 +553,52 @@ func (ns *Indexer) Stop() {
 func (ns *Indexer) SyncBlock(block *types.Block) {
 	newHash := base58.Encode(block.Hash)
 	newHeight := block.Header.BlockNo
+	prevHash := base58.Encode(block.Header.PrevBlockHash)
+	lastBlockHeight, lastBlockHash := ns.getLastBlock()
 
 	// Check out-of-sync cases
-	if ns.lastBlockHeight == 0 && newHeight > 0 { // Initial sync
+	if lastBlockHeight == 0 && newHeight > 0 { // Initial sync
 		// Add missing blocks asynchronously
-		go ns.IndexBlocksInRange(0, newHeight-1)
-	} else if newHeight > ns.lastBlockHeight+1 { // Skipped 1 or more blocks
+		ns.backfillAsync(0, newHeight-1)
+	} else if newHeight > lastBlockHeight+1 { // Skipped 1 or more blocks
 		// Add missing blocks asynchronously
-		go ns.IndexBlocksInRange(ns.lastBlockHeight+1, newHeight-1)
-	} else if newHeight <= ns.lastBlockHeight { // Rewound 1 or more blocks
+		ns.backfillAsync(lastBlockHeight+1, newHeight-1)
+	} else if newHeight <= lastBlockHeight || (lastBlockHash != "" && prevHash != lastBlockHash) { // Rewound 1 or more blocks, or forked
 		// This needs to be syncronous, otherwise it may
 		// delete the block we are just about to add
-		ns.DeleteBlocksInRange(newHeight, ns.lastBlockHeight)
+		if !ns.handleReorg(newHeight, lastBlockHeight) {
+			// Interrupted by shutdown. The new block is left out, so the sync position does not advance past blocks that were not indexed again
+			return
+		}
 	}
 
-	// Update state
-	ns.lastBlockHash = newHash
-	ns.lastBlockHeight = newHeight
-
 	// Check specified sync range
 	if newHeight < uint64(ns.startFrom) {
 		ns.log.Info().Uint64("blockNumber", newHeight).Int64("startFrom", ns.startFrom).Msg("Skipping block before specified sync range")
+		ns.setLastBlock(newHeight, newHash)
 		return
 	}
 	if ns.stopAt != -1 && newHeight > uint64(ns.stopAt) {
 		ns.log.Info().Uint64("blockNumber", newHeight).Int64("stopAt", ns.stopAt).Msg("Reached end of specified sync range")
+		ns.setLastBlock(newHeight, newHash)
 		ns.Stop()
 		return
 	}
 
-	// Index new block
+	if writer, ok := ns.batchWriter(); ok {
+		ns.syncBlockInTransaction(writer, block)
+		return
+	}
+
+	// Index new block. State is only updated afterwards, so the checkpoint never includes a block that is still being written
 	ns.IndexBlock(block)
+	ns.setLastBlock(newHeight, newHash)
+	ns.WriteCheckpoint()
 }
 
 // GetBestBlockFromDb retrieves the current best block from the db
 func (ns *Indexer) GetBestBlockFromDb() (*doc.EsBlock, error) {
-	block, err := ns.db.SelectOne(db.QueryParams{
+	block, err := ns.db.SelectOne(ns.writeCtx, db.QueryParams{
 		IndexName: ns.indexNamePrefix + "block",
 		SortField: "no",
 		SortAsc:   false,
@@ -385,13 +624,12 @@ func (ns *Indexer) UpdateLastBlockHeightFromDb() {
 		ns.log.Warn().Err(err).Msg("Failed to update best block")
 		return
 	}
-	ns.lastBlockHeight = bestBlock.BlockNo
-	ns.lastBlockHash = bestBlock.GetID()
+	ns.setLastBlock(bestBlock.BlockNo, bestBlock.GetID())
 }
 
 // GetNodeBlockHeight updates state from db
 func (ns *Indexer) GetNodeBlockHeight() (uint64, error) {
-	blockchain, err := ns.grpcClient.Blockchain(context.Background(), &types.Empty{})
+	blockchain, err := ns.client().Blockchain(context.Background(), &types.Empty{})
 	if err != nil {
 		return 0, err
 	}
@@ -400,38 +638,41 @@ func (ns *Indexer) GetNodeBlockHeight() (uint64, error) {
 
 // IdleFor sets the indexer into idle mode and restarts after {idleSeconds}
 func (ns *Indexer) IdleFor(idleSeconds int32) {
-	if ns.State == "idle" {
+	if !ns.setState(StateIdle) {
+		// Already idle or stopped
 		return
 	}
 	ns.log.Info().Int32("second", idleSeconds).Msg("Going into idle mode")
-	ns.Stop()
-	ns.State = "idle"
+	ns.closeStream()
+	ns.releaseLock()
 	dur := time.Duration(int64(time.Second) * int64(idleSeconds))
 	time.AfterFunc(dur, func() {
+		if ns.GetState() != StateIdle {
+			return
+		}
 		ns.log.Info().Msg("Done with idling")
 		ns.WaitForLock()
 		ns.StartStream()
 	})
 }
 
-// IndexBlock indexes one block
-func (ns *Indexer) IndexBlock(block *types.Block) {
-	if ns.State == "idle" {
-		return
+// IndexBlock indexes one block. It returns an error if the block could not be indexed completely
+func (ns *Indexer) IndexBlock(block *types.Block) error {
+	if ns.GetState() == StateIdle {
+		return errors.New("indexer is idle")
+	}
+	if writer, ok := ns.batchWriter(); ok {
+		return ns.indexBlockInTransaction(writer, block)
 	}
-	ctx := context.Background()
+	ctx := ns.writeCtx
 	blockDocument := ns.ConvBlock(block)
-	_, err := ns.db.Insert(blockDocument, db.UpdateParams{IndexName: ns.indexNamePrefix + "block", TypeName: "block"})
+	err := ns.withDbRetry(ctx, func() error {
+		_, err := ns.db.Insert(ctx, blockDocument, db.UpdateParams{IndexName: ns.indexNamePrefix + "block", TypeName: "block"})
+		return err
+	})
 	if err != nil {
-		if ns.db.IsConflict(err) {
-			ns.log.Warn().Err(err).Msg("Detected conflict")
-			if ns.idleOnConflict > 0 {
-				ns.IdleFor(ns.idleOnConflict)
-			}
-			return
-		}
-		ns.log.Warn().Err(err).Msg("Failed to index block")
-		return
+		ns.handleIndexBlockError(block.Header.BlockNo, err)
+		return err
 	}
 
 	// Index one block's transactions
@@ -442,49 +683,74 @@ func (ns *Indexer) IndexBlock(block *types.Block) {
 		tokenTxChannel := make(chan doc.DocType)
 		done := make(chan struct{})
 
+		// All bulk indexers are waited for, so the block is completely written when this returns
+		var wg sync.WaitGroup
+		var nameErr, tokenErr, tokenTxErr, convErr error
+
 		waitForNames := func() error {
 			defer close(nameChannel)
 			<-done
 			return nil
 		}
-		go BulkIndexer(ctx, ns.log, ns.db, nameChannel, waitForNames, ns.indexNamePrefix+"name", "name", 2500, true)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nameErr = BulkIndexer(ctx, ns.log, ns.db, nameChannel, waitForNames, ns.indexNamePrefix+"name", "name", 2500, true, ns.deadLetterIndexName(), 1)
+		}()
 
 		waitForTokens := func() error {
 			defer close(tokenChannel)
 			<-done
 			return nil
 		}
-		go BulkIndexer(ctx, ns.log, ns.db, tokenChannel, waitForTokens, ns.indexNamePrefix+"token", "token", 2500, true)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokenErr = BulkIndexer(ctx, ns.log, ns.db, tokenChannel, waitForTokens, ns.indexNamePrefix+"token", "token", 2500, true, ns.deadLetterIndexName(), 1)
+		}()
 
 		waitForTokenTx := func() error {
 			defer close(tokenTxChannel)
 			<-done
 			return nil
 		}
-		go BulkIndexer(ctx, ns.log, ns.db, tokenTxChannel, waitForTokenTx, ns.indexNamePrefix+"token_transfer", "token_transfer", 2500, true)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokenTxErr = BulkIndexer(ctx, ns.log, ns.db, tokenTxChannel, waitForTokenTx, ns.indexNamePrefix+"token_transfer", "token_transfer", 2500, true, ns.deadLetterIndexName(), 1)
+		}()
 
 		generator := func() error {
 			defer close(txChannel)
 			defer close(done)
-			ns.IndexTxs(block, block.Body.Txs, txChannel, nameChannel, tokenChannel, tokenTxChannel)
+			convErr = ns.IndexTxs(block, block.Body.Txs, txChannel, nameChannel, tokenChannel, tokenTxChannel)
 			return nil
 		}
-		BulkIndexer(ctx, ns.log, ns.db, txChannel, generator, ns.indexNamePrefix+"tx", "tx", 2000, false)
+		txErr := BulkIndexer(ctx, ns.log, ns.db, txChannel, generator, ns.indexNamePrefix+"tx", "tx", 2000, false, ns.deadLetterIndexName(), 1)
+		wg.Wait()
+		for _, err := range []error{txErr, nameErr, tokenErr, tokenTxErr, convErr} {
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	ns.log.Info().Uint64("no", block.Header.BlockNo).Int("txs", len(block.Body.Txs)).Str("hash", blockDocument.GetID()).Msg("Indexed block")
+	return nil
 }
 
 // IndexBlocksInRange indexes blocks in the range of [fromBlockheight, toBlockHeight]
 func (ns *Indexer) IndexBlocksInRange(fromBlockHeight uint64, toBlockHeight uint64) {
-	ns.BulkState = "running"
-	ctx := context.Background()
-	channel := make(chan doc.DocType, 1000)
-	done := make(chan struct{})
-	txChannel := make(chan doc.DocType, 20000)
-	nameChannel := make(chan doc.DocType, 5000)
-	tokenChannel := make(chan doc.DocType, 5000)
-	tokenTxChannel := make(chan doc.DocType, 5000)
+	ns.indexBlocksInRange(fromBlockHeight, toBlockHeight, nil)
+	if ns.ctx.Err() == nil {
+		ns.OnSyncComplete()
+	}
+}
+
+// indexBlocksInRange indexes blocks in the range of [fromBlockheight, toBlockHeight].
+// If progress is set, it is called with the height up to which all blocks of the range are committed whenever it advances.
+func (ns *Indexer) indexBlocksInRange(fromBlockHeight uint64, toBlockHeight uint64, progress func(uint64)) {
+	ns.beginBulk()
 
 	if fromBlockHeight < uint64(ns.startFrom) {
 		fromBlockHeight = uint64(ns.startFrom)
@@ -493,6 +759,45 @@ func (ns *Indexer) IndexBlocksInRange(fromBlockHeight uint64, toBlockHeight uint
 		toBlockHeight = uint64(ns.stopAt)
 	}
 
+	if writer, ok := ns.batchWriter(); ok {
+		ns.indexBlocksInRangeInTransactions(writer, fromBlockHeight, toBlockHeight, progress)
+	} else {
+		ns.log.Info().Msg(fmt.Sprintf("Indexing %d missing blocks [%d..%d]", (1 + toBlockHeight - fromBlockHeight), fromBlockHeight, toBlockHeight))
+		// Without transactions, blocks are only known to be committed once the bulk indexers are done, so progress is made in segments
+		for segmentFrom := fromBlockHeight; segmentFrom <= toBlockHeight; segmentFrom += backfillSegmentSize {
+			segmentTo := toBlockHeight
+			if toBlockHeight-segmentFrom >= backfillSegmentSize {
+				segmentTo = segmentFrom + backfillSegmentSize - 1
+			}
+			ns.bulkIndexBlocksInRange(segmentFrom, segmentTo)
+			if ns.ctx.Err() != nil {
+				break
+			}
+			if progress != nil {
+				progress(segmentTo)
+				ns.WriteCheckpoint()
+			}
+			if segmentTo == toBlockHeight {
+				break
+			}
+		}
+	}
+	ns.endBulk()
+	if ns.ctx.Err() != nil {
+		ns.log.Info().Uint64("from", fromBlockHeight).Uint64("to", toBlockHeight).Msg("Stopped indexing missing blocks")
+	}
+}
+
+// bulkIndexBlocksInRange indexes blocks in the range of [fromBlockheight, toBlockHeight] using one bulk indexer per document type
+func (ns *Indexer) bulkIndexBlocksInRange(fromBlockHeight uint64, toBlockHeight uint64) {
+	ctx := ns.writeCtx
+	channel := make(chan doc.DocType, 1000)
+	done := make(chan struct{})
+	txChannel := make(chan doc.DocType, 20000)
+	nameChannel := make(chan doc.DocType, 5000)
+	tokenChannel := make(chan doc.DocType, 5000)
+	tokenTxChannel := make(chan doc.DocType, 5000)
+
 	var wg sync.WaitGroup
 
 	waitForTx := func() error {
@@ -502,7 +807,7 @@ func (ns *Indexer) IndexBlocksInRange(fromBlockHeight uint64, toBlockHeight uint
 	}
 	go func() {
 		defer wg.Done()
-		BulkIndexer(ctx, ns.log, ns.db, txChannel, waitForTx, ns.indexNamePrefix+"tx", "tx", 2000, false)
+		BulkIndexer(ctx, ns.log, ns.db, txChannel, waitForTx, ns.indexNamePrefix+"tx", "tx", 2000, false, ns.deadLetterIndexName(), 1)
 	}()
 	wg.Add(1)
 
@@ -513,7 +818,7 @@ func (ns *Indexer) IndexBlocksInRange(fromBlockHeight uint64, toBlockHeight uint
 	}
 	go func() {
 		defer wg.Done()
-		BulkIndexer(ctx, ns.log, ns.db, nameChannel, waitForNames, ns.indexNamePrefix+"name", "name", 2500, true)
+		BulkIndexer(ctx, ns.log, ns.db, nameChannel, waitForNames, ns.indexNamePrefix+"name", "name", 2500, true, ns.deadLetterIndexName(), 1)
 	}()
 	wg.Add(1)
 
@@ -524,7 +829,7 @@ func (ns *Indexer) IndexBlocksInRange(fromBlockHeight uint64, toBlockHeight uint
 	}
 	go func() {
 		defer wg.Done()
-		BulkIndexer(ctx, ns.log, ns.db, tokenChannel, waitForTokens, ns.indexNamePrefix+"token", "token", 2500, true)
+		BulkIndexer(ctx, ns.log, ns.db, tokenChannel, waitForTokens, ns.indexNamePrefix+"token", "token", 2500, true, ns.deadLetterIndexName(), 1)
 	}()
 	wg.Add(1)
 
@@ -535,43 +840,36 @@ func (ns *Indexer) IndexBlocksInRange(fromBlockHeight uint64, toBlockHeight uint
 	}
 	go func() {
 		defer wg.Done()
-		BulkIndexer(ctx, ns.log, ns.db, tokenTxChannel, waitForTokenTx, ns.indexNamePrefix+"token_transfer", "token_transfer", 2500, true)
+		BulkIndexer(ctx, ns.log, ns.db, tokenTxChannel, waitForTokenTx, ns.indexNamePrefix+"token_transfer", "token_transfer", 2500, true, ns.deadLetterIndexName(), 1)
 	}()
 	wg.Add(1)
 
 	generator := func() error {
 		defer close(channel)
 		defer close(done)
-		ns.log.Info().Msg(fmt.Sprintf("Indexing %d missing blocks [%d..%d]", (1 + toBlockHeight - fromBlockHeight), fromBlockHeight, toBlockHeight))
-		for blockHeight := fromBlockHeight; blockHeight <= toBlockHeight; blockHeight++ {
-			blockQuery := make([]byte, 8)
-			binary.LittleEndian.PutUint64(blockQuery, uint64(blockHeight))
-			block, err := ns.grpcClient.GetBlock(context.Background(), &types.SingleBytes{Value: blockQuery})
-			if err != nil {
-				ns.log.Warn().Uint64("blockHeight", blockHeight).Err(err).Msg("Failed to get block")
-				continue
-			}
-			if len(block.Body.Txs) > 0 {
-				ns.IndexTxs(block, block.Body.Txs, txChannel, nameChannel, tokenChannel, tokenTxChannel)
-			}
-			d := ns.ConvBlock(block)
+		err := ns.fetchBlocksInRange(ns.ctx, fromBlockHeight, toBlockHeight, func(docs *blockDocuments) error {
+			docs.sendTxs(txChannel, nameChannel, tokenChannel, tokenTxChannel)
 			select {
-			case channel <- d:
+			case channel <- docs.block:
 			case <-ctx.Done():
 				return ctx.Err()
 			}
+			return nil
+		})
+		if err != nil && ns.ctx.Err() != nil {
+			// Stopped by shutdown, commit what has been fetched so far
+			return nil
 		}
-		return nil
+		return err
 	}
-	BulkIndexer(ctx, ns.log, ns.db, channel, generator, ns.indexNamePrefix+"block", "block", 500, false)
+	BulkIndexer(ctx, ns.log, ns.db, channel, generator, ns.indexNamePrefix+"block", "block", 500, false, ns.deadLetterIndexName(), ns.workers)
 
 	// Wait for tx and name goroutines
 	wg.Wait()
-	ns.BulkState = "finished"
-	ns.OnSyncComplete()
 }
 
 // IndexTxs indexes a list of transactions in bulk
+// It returns an error if some documents could not be converted. The block has been recorded as failed in that case
 func (ns *Indexer) IndexTxs(
 	block *types.Block,
 	txs []*types.Tx,
@@ -579,8 +877,21 @@ func (ns *Indexer) IndexTxs(
 	nameChannel chan doc.DocType,
 	tokenChannel chan doc.DocType,
 	tokenTxChannel chan doc.DocType,
-) {
+) error {
 	// This simply pushes all Txs to the channel to be consumed elsewhere
+	docs := new(blockDocuments)
+	err := ns.convTxs(block, txs, docs)
+	if err != nil {
+		ns.recordFailedBlock(block.Header.BlockNo, err)
+	}
+	docs.sendTxs(channel, nameChannel, tokenChannel, tokenTxChannel)
+	return err
+}
+
+// convTxs converts a list of transactions and adds the resulting tx, name, token and token transfer documents to docs
+// If a receipt or events could not be fetched, the remaining documents are still converted and the last error is returned
+func (ns *Indexer) convTxs(block *types.Block, txs []*types.Tx, docs *blockDocuments) error {
+	var convErr error
 	blockTs := time.Unix(0, block.Header.Timestamp)
 	for _, tx := range txs {
 		d := ns.ConvTx(tx, block.Header.BlockNo)
@@ -591,7 +902,7 @@ func (ns *Indexer) IndexTxs(
 		if tx.GetBody().GetType() == types.TxType_GOVERNANCE && string(tx.GetBody().GetRecipient()) == "aergo.name" {
 			nameDoc := ns.ConvNameTx(tx, d.BlockNo)
 			nameDoc.UpdateBlock = d.BlockNo
-			nameChannel <- nameDoc
+			docs.names = append(docs.names, nameDoc)
 		}
 
 		// Process token creation transactions
@@ -599,12 +910,15 @@ func (ns *Indexer) IndexTxs(
 		contractAddress := tx.GetBody().GetRecipient()
 		if ns.MaybeTokenCreation(tx) {
 			// Based on heuristic, this might be a token creation. Let's check the receipt
-			receipt, err := ns.grpcClient.GetReceipt(context.Background(), &types.SingleBytes{Value: tx.GetHash()})
+			var receipt *types.Receipt
+			err := ns.withRetry(ns.ctx, func() (err error) {
+				receipt, err = ns.client().GetReceipt(ns.ctx, &types.SingleBytes{Value: tx.GetHash()})
+				return err
+			})
 			if err != nil {
 				ns.log.Warn().Str("tx", d.Id).Err(err).Msg("Failed to get tx receipt")
-				continue
-			}
-			if receipt.Status == "CREATED" {
+				convErr = err
+			} else if receipt.Status == "CREATED" {
 				createdToken = true
 				contractAddress = receipt.ContractAddress
 
@@ -634,19 +948,26 @@ func (ns *Indexer) IndexTxs(
 					}
 				}
 
-				tokenChannel <- token
+				docs.tokens = append(docs.tokens, token)
 			}
 		}
 
 		// Process token transfer events
 		if tx.GetBody().GetType() == types.TxType_CALL || createdToken {
-			events, err := ns.grpcClient.ListEvents(context.Background(), &types.FilterInfo{
-				ContractAddress: contractAddress,
-				EventName:       "transfer",
-				Blockfrom:       d.BlockNo,
-				Blockto:         d.BlockNo,
+			var events *types.EventList
+			err := ns.withRetry(ns.ctx, func() (err error) {
+				events, err = ns.client().ListEvents(ns.ctx, &types.FilterInfo{
+					ContractAddress: contractAddress,
+					EventName:       "transfer",
+					Blockfrom:       d.BlockNo,
+					Blockto:         d.BlockNo,
+				})
+				return err
 			})
-			if err == nil {
+			if err != nil {
+				ns.log.Warn().Str("tx", d.Id).Err(err).Msg("Failed to get tx events")
+				convErr = err
+			} else {
 				for idx, event := range events.Events {
 					var args []interface{}
 					json.Unmarshal([]byte(event.JsonArgs), &args)
@@ -654,14 +975,14 @@ func (ns *Indexer) IndexTxs(
 						continue
 					}
 					tokenTx := ns.ConvTokenTx(contractAddress, d, idx, args)
-					tokenTxChannel <- tokenTx
+					docs.tokenTransfers = append(docs.tokenTransfers, tokenTx)
 				}
 			}
 		}
 
-		// Add tx to channel
-		channel <- d
+		docs.txs = append(docs.txs, d)
 	}
+	return convErr
 }
 
 func (ns *Indexer) queryContract(address []byte, name string) (string, error) {
@@ -670,7 +991,7 @@ func (ns *Indexer) queryContract(address []byte, name string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	result, err := ns.grpcClient.QueryContract(context.Background(), &types.Query{
+	result, err := ns.client().QueryContract(context.Background(), &types.Query{
 		ContractAddress: address,
 		Queryinfo:       queryinfoJson,
 	})
@@ -698,10 +1019,15 @@ func (ns *Indexer) queryContract(address []byte, name string) (string, error) {
 	return string(result.Value), nil
 }
 
-func (ns *Indexer) deleteTypeByQuery(typeName string, rangeQuery db.IntegerRangeQuery) {
-	deleted, err := ns.db.Delete(db.QueryParams{
-		IndexName:    ns.indexNamePrefix + typeName,
-		IntegerRange: &rangeQuery,
+func (ns *Indexer) deleteTypeByQuery(dbController db.DbController, typeName string, rangeQuery db.IntegerRangeQuery) {
+	var deleted uint64
+	err := ns.withDbRetry(ns.writeCtx, func() (err error) {
+		deleted, err = dbController.Delete(ns.writeCtx, db.QueryParams{
+			IndexName:    ns.indexNamePrefix + typeName,
+			TypeName:     typeName,
+			IntegerRange: &rangeQuery,
+		})
+		return err
 	})
 	if err != nil {
 		ns.log.Warn().Err(err).Str("typeName", typeName).Msg("Failed to delete documents")
@@ -712,10 +1038,15 @@ func (ns *Indexer) deleteTypeByQuery(typeName string, rangeQuery db.IntegerRange
 
 // DeleteBlocksInRange deletes previously synced blocks and their txs and names in the range of [fromBlockheight, toBlockHeight]
 func (ns *Indexer) DeleteBlocksInRange(fromBlockHeight uint64, toBlockHeight uint64) {
+	ns.deleteBlocksInRangeFrom(ns.db, fromBlockHeight, toBlockHeight)
+}
+
+// deleteBlocksInRangeFrom deletes the blocks in the range of [fromBlockheight, toBlockHeight] and their documents from dbController
+func (ns *Indexer) deleteBlocksInRangeFrom(dbController db.DbController, fromBlockHeight uint64, toBlockHeight uint64) {
 	ns.log.Info().Msg(fmt.Sprintf("Rolling back %d blocks [%d..%d]", (1 + toBlockHeight - fromBlockHeight), fromBlockHeight, toBlockHeight))
-	ns.deleteTypeByQuery("block", db.IntegerRangeQuery{Field: "no", Min: fromBlockHeight, Max: toBlockHeight})
-	ns.deleteTypeByQuery("tx", db.IntegerRangeQuery{Field: "blockno", Min: fromBlockHeight, Max: toBlockHeight})
-	ns.deleteTypeByQuery("name", db.IntegerRangeQuery{Field: "blockno", Min: fromBlockHeight, Max: toBlockHeight})
-	ns.deleteTypeByQuery("token_transfer", db.IntegerRangeQuery{Field: "blockno", Min: fromBlockHeight, Max: toBlockHeight})
-	ns.deleteTypeByQuery("token", db.IntegerRangeQuery{Field: "blockno", Min: fromBlockHeight, Max: toBlockHeight})
+	ns.deleteTypeByQuery(dbController, "block", db.IntegerRangeQuery{Field: "no", Min: fromBlockHeight, Max: toBlockHeight})
+	ns.deleteTypeByQuery(dbController, "tx", db.IntegerRangeQuery{Field: "blockno", Min: fromBlockHeight, Max: toBlockHeight})
+	ns.deleteTypeByQuery(dbController, "name", db.IntegerRangeQuery{Field: "blockno", Min: fromBlockHeight, Max: toBlockHeight})
+	ns.deleteTypeByQuery(dbController, "token_transfer", db.IntegerRangeQuery{Field: "blockno", Min: fromBlockHeight, Max: toBlockHeight})
+	ns.deleteTypeByQuery(dbController, "token", db.IntegerRangeQuery{Field: "blockno", Min: fromBlockHeight, Max: toBlockHeight})
 }
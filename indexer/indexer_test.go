@@ -0,0 +1,304 @@
+package indexer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aergoio/aergo-indexer/indexer/db"
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+	"github.com/aergoio/aergo-indexer/types"
+	"github.com/aergoio/aergo-lib/log"
+	"github.com/mr-tron/base58/base58"
+	"google.golang.org/grpc"
+)
+
+var indexedTypes = []string{"tx", "block", "name", "token", "token_transfer"}
+
+// testChain serves the blocks of the canonical chain like an aergo server. Only the calls used for syncing blocks without transactions are implemented
+type testChain struct {
+	types.AergoRPCServiceClient
+	blocks []*types.Block
+	mutex  sync.Mutex
+}
+
+// extend replaces the chain from height fromBlockHeight on with new blocks of branch up to toBlockHeight
+func (chain *testChain) extend(branch string, fromBlockHeight uint64, toBlockHeight uint64) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	chain.blocks = chain.blocks[:fromBlockHeight]
+	for blockHeight := fromBlockHeight; blockHeight <= toBlockHeight; blockHeight++ {
+		var prevHash []byte
+		if blockHeight > 0 {
+			prevHash = chain.blocks[blockHeight-1].Hash
+		}
+		chain.blocks = append(chain.blocks, &types.Block{
+			Hash:   []byte(fmt.Sprintf("%s-%d", branch, blockHeight)),
+			Header: &types.BlockHeader{BlockNo: blockHeight, PrevBlockHash: prevHash, Timestamp: int64(blockHeight) * 1e9},
+			Body:   &types.BlockBody{},
+		})
+	}
+}
+
+// block returns the block at blockHeight
+func (chain *testChain) block(blockHeight uint64) *types.Block {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	return chain.blocks[blockHeight]
+}
+
+// hashes returns the base58 encoded hashes of all blocks
+func (chain *testChain) hashes() []string {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	hashes := make([]string, 0, len(chain.blocks))
+	for _, block := range chain.blocks {
+		hashes = append(hashes, base58.Encode(block.Hash))
+	}
+	return hashes
+}
+
+func (chain *testChain) GetBlock(ctx context.Context, in *types.SingleBytes, opts ...grpc.CallOption) (*types.Block, error) {
+	blockHeight := binary.LittleEndian.Uint64(in.Value)
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	if blockHeight >= uint64(len(chain.blocks)) {
+		return nil, fmt.Errorf("block %d not found", blockHeight)
+	}
+	return chain.blocks[blockHeight], nil
+}
+
+func (chain *testChain) GetBlockMetadata(ctx context.Context, in *types.SingleBytes, opts ...grpc.CallOption) (*types.BlockMetadata, error) {
+	block, err := chain.GetBlock(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return &types.BlockMetadata{Hash: block.Hash, Header: block.Header}, nil
+}
+
+func (chain *testChain) Blockchain(ctx context.Context, in *types.Empty, opts ...grpc.CallOption) (*types.BlockchainStatus, error) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	best := chain.blocks[len(chain.blocks)-1]
+	return &types.BlockchainStatus{BestBlockHash: best.Hash, BestHeight: best.Header.BlockNo}, nil
+}
+
+// newTestIndexer creates an indexer writing to database and syncing from chain, without starting it
+func newTestIndexer(t *testing.T, database db.DbController, chain *testChain, indexNamePrefix string) *Indexer {
+	ns, err := NewIndexer(log.NewLogger("indexer"), "memory", "", "chain_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.db = database
+	ns.indexNamePrefix = indexNamePrefix
+	ns.nodes, err = NewNodePool(ns.log, []*Node{{Address: "test", Client: chain}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ns
+}
+
+// createIndices creates the indices of the indexer's current generation like Start does
+func createIndices(t *testing.T, ns *Indexer) {
+	for _, documentType := range indexedTypes {
+		if err := ns.CreateIndexIfNotExists(documentType); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// syncBlocks syncs the blocks like received from the stream and waits until all backfills are done
+func syncBlocks(ns *Indexer, chain *testChain, blockHeights ...uint64) {
+	for _, blockHeight := range blockHeights {
+		ns.SyncBlock(chain.block(blockHeight))
+		ns.backfills.Wait()
+	}
+}
+
+// indexedHashes returns the hashes of all blocks in indexName, ordered by block number
+func indexedHashes(t *testing.T, database db.DbController, indexName string) []string {
+	scroll := database.Scroll(context.Background(), db.QueryParams{IndexName: indexName, TypeName: "block", SortField: "no", SortAsc: true}, func() doc.DocType {
+		block := new(doc.EsBlock)
+		block.BaseEsType = new(doc.BaseEsType)
+		return block
+	})
+	hashes := make([]string, 0)
+	for {
+		block, err := scroll.Next()
+		if err == io.EOF {
+			return hashes
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, block.GetID())
+	}
+}
+
+func checkIndexedChain(t *testing.T, ns *Indexer, chain *testChain, indexName string) {
+	expected, indexed := chain.hashes(), indexedHashes(t, ns.db, indexName)
+	if fmt.Sprint(indexed) != fmt.Sprint(expected) {
+		t.Fatalf("expected indexed blocks %v, got %v", expected, indexed)
+	}
+
+	bestHeight := uint64(len(expected) - 1)
+	if blockHeight, blockHash := ns.getLastBlock(); blockHeight != bestHeight || blockHash != expected[bestHeight] {
+		t.Fatalf("expected sync position %d %s, got %d %s", bestHeight, expected[bestHeight], blockHeight, blockHash)
+	}
+	checkpoint, err := ns.LoadCheckpoint()
+	if err != nil || checkpoint == nil {
+		t.Fatalf("failed to load checkpoint: %v", err)
+	}
+	if checkpoint.BlockNo != bestHeight || checkpoint.BlockHash != expected[bestHeight] || checkpoint.Completed != "" {
+		t.Fatalf("expected checkpoint at %d %s, got %+v", bestHeight, expected[bestHeight], checkpoint)
+	}
+}
+
+func TestSyncBlockRollsBackFork(t *testing.T) {
+	chain := new(testChain)
+	chain.extend("a", 0, 5)
+	ns := newTestIndexer(t, db.NewMemoryDbController(), chain, "chain_gen1_")
+	createIndices(t, ns)
+	syncBlocks(ns, chain, 3, 4, 5)
+	checkIndexedChain(t, ns, chain, ns.indexNamePrefix+"block")
+
+	// Blocks 3 to 5 are replaced by another branch, which is only noticed when its next block arrives
+	chain.extend("b", 3, 6)
+	syncBlocks(ns, chain, 6)
+	checkIndexedChain(t, ns, chain, ns.indexNamePrefix+"block")
+}
+
+func TestSyncBlockBackfillsGaps(t *testing.T) {
+	chain := new(testChain)
+	chain.extend("a", 0, 9)
+	ns := newTestIndexer(t, db.NewMemoryDbController(), chain, "chain_gen1_")
+	createIndices(t, ns)
+
+	// Initial sync fills all blocks below the first one received
+	syncBlocks(ns, chain, 5)
+	if indexed := indexedHashes(t, ns.db, ns.indexNamePrefix+"block"); len(indexed) != 6 {
+		t.Fatalf("expected blocks 0 to 5 to be indexed, got %v", indexed)
+	}
+
+	// Skipped blocks are filled as well
+	syncBlocks(ns, chain, 9)
+	checkIndexedChain(t, ns, chain, ns.indexNamePrefix+"block")
+}
+
+func TestReindexSwapsAliasesWhenCaughtUp(t *testing.T) {
+	database := db.NewMemoryDbController()
+	chain := new(testChain)
+	chain.extend("a", 0, 2)
+	previous := newTestIndexer(t, database, chain, "chain_gen1_")
+	createIndices(t, previous)
+	syncBlocks(previous, chain, 2)
+
+	chain.extend("a", 3, 4)
+	ns := newTestIndexer(t, database, chain, "chain_gen2_")
+	ns.reindexing = true
+	createIndices(t, ns)
+	if exists, indexNamePrefix, err := database.GetExistingIndexPrefix(context.Background(), "chain_block", "block"); err != nil || !exists || indexNamePrefix != "chain_gen1_" {
+		t.Fatalf("expected aliases to keep pointing to the previous indices while reindexing, got %v %s (%v)", exists, indexNamePrefix, err)
+	}
+
+	syncBlocks(ns, chain, 4)
+	if ns.reindexing {
+		t.Fatal("expected reindex to be complete")
+	}
+	for _, documentType := range indexedTypes {
+		exists, indexNamePrefix, err := database.GetExistingIndexPrefix(context.Background(), "chain_"+documentType, documentType)
+		if err != nil || !exists || indexNamePrefix != "chain_gen2_" {
+			t.Fatalf("expected alias of %s to point to the new indices, got %v %s (%v)", documentType, exists, indexNamePrefix, err)
+		}
+	}
+	checkIndexedChain(t, ns, chain, "chain_block")
+	if _, err := database.Count(context.Background(), db.QueryParams{IndexName: "chain_gen1_block"}); !db.IsNotFound(err) {
+		t.Fatalf("expected previous indices to be removed, got %v", err)
+	}
+	if checkpoint, _ := ns.LoadCheckpoint(); checkpoint == nil || checkpoint.Reindexing || checkpoint.IndexPrefix != "chain_gen2_" {
+		t.Fatalf("expected checkpoint of the completed reindex, got %+v", checkpoint)
+	}
+}
+
+func TestCatchUpBackendFromItsCheckpoint(t *testing.T) {
+	primary, secondary := db.NewMemoryDbController(), db.NewMemoryDbController()
+	fanOut, err := db.NewFanOutDbController([]*db.FanOutBackend{{Name: "primary", Controller: primary}, {Name: "secondary", Controller: secondary}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := new(testChain)
+	chain.extend("a", 0, 8)
+	ns := newTestIndexer(t, fanOut, chain, "chain_gen1_")
+	createIndices(t, ns)
+	syncBlocks(ns, chain, 3)
+
+	// Blocks 4 to 6 are only written to the primary, as well as a fork replacing block 3
+	backend := fanOut.Secondaries()[0]
+	fanOut.Fail(backend, errors.New("unavailable"))
+	syncBlocks(ns, chain, 4, 5, 6)
+	chain.extend("b", 3, 8)
+	syncBlocks(ns, chain, 7)
+	if checkpoint, err := ns.loadCheckpointFrom(secondary); err != nil || checkpoint == nil || checkpoint.BlockNo != 3 {
+		t.Fatalf("expected checkpoint of failed backend to stay at 3, got %+v (%v)", checkpoint, err)
+	}
+
+	ns.CatchUpBackends()
+	if state, err := fanOut.State(backend); state != db.BackendActive {
+		t.Fatalf("expected backend to be active after catching up, got %v (%v)", state, err)
+	}
+	syncBlocks(ns, chain, 8)
+	checkIndexedChain(t, ns, chain, ns.indexNamePrefix+"block")
+	primaryHashes, secondaryHashes := indexedHashes(t, primary, ns.indexNamePrefix+"block"), indexedHashes(t, secondary, ns.indexNamePrefix+"block")
+	if fmt.Sprint(secondaryHashes) != fmt.Sprint(primaryHashes) {
+		t.Fatalf("expected backend to have the blocks of the primary %v, got %v", primaryHashes, secondaryHashes)
+	}
+	if checkpoint, err := ns.loadCheckpointFrom(secondary); err != nil || checkpoint == nil || checkpoint.BlockNo != 8 {
+		t.Fatalf("expected checkpoint of caught up backend to advance, got %+v (%v)", checkpoint, err)
+	}
+}
+
+func TestFailedBlocksOfGeneration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indexer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sqlite, err := db.NewSQLiteDbController(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Client.Close()
+
+	for name, database := range map[string]db.DbController{"memory": db.NewMemoryDbController(), "sqlite": sqlite} {
+		ns := newTestIndexer(t, database, new(testChain), "chain_gen1_")
+		if _, err := ns.GetFailedBlocks(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		ns.recordFailedBlock(5, errors.New("failed"))
+		ns.indexNamePrefix = "chain_gen2_"
+		for _, blockHeight := range []uint64{2, 5, 9, 12} {
+			ns.recordFailedBlock(blockHeight, errors.New("failed"))
+		}
+
+		if heights, err := ns.getFailedBlocks(ns.failedBlocksFilter(3, 9)); err != nil || fmt.Sprint(heights) != "[5 9]" {
+			t.Errorf("%s: expected failed blocks [5 9] of the generation within the range, got %v (%v)", name, heights, err)
+		}
+		if err := ns.removeFailedBlock(5); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if heights, err := ns.GetFailedBlocks(); err != nil || fmt.Sprint(heights) != "[2 9 12]" {
+			t.Errorf("%s: expected failed blocks [2 9 12] after removing 5, got %v (%v)", name, heights, err)
+		}
+		ns.indexNamePrefix = "chain_gen1_"
+		if heights, err := ns.GetFailedBlocks(); err != nil || fmt.Sprint(heights) != "[5]" {
+			t.Errorf("%s: expected failed block 5 of the previous generation to be kept, got %v (%v)", name, heights, err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aergoio/aergo-indexer/types"
+	"github.com/aergoio/aergo-lib/log"
+)
+
+const (
+	// nodeCheckTimeout is the timeout for querying the status of one node
+	nodeCheckTimeout = 5 * time.Second
+	// nodeCheckInterval is the interval in which all nodes are checked while streaming
+	nodeCheckInterval = 30 * time.Second
+	// nodeSwitchLag is the number of blocks the current node has to fall behind before switching to another node
+	nodeSwitchLag = 5
+)
+
+// Node is a connection to one aergo server
+type Node struct {
+	Address string
+	Client  types.AergoRPCServiceClient
+}
+
+// NodePool holds connections to several aergo servers and keeps track of the one currently used
+type NodePool struct {
+	nodes   []*Node
+	current int
+	mutex   sync.RWMutex
+	log     *log.Logger
+}
+
+// NewNodePool creates a new NodePool. The first node is used until SelectBest is called
+func NewNodePool(logger *log.Logger, nodes []*Node) (*NodePool, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("no aergo server address given")
+	}
+	return &NodePool{
+		nodes: nodes,
+		log:   logger,
+	}, nil
+}
+
+// Current returns the node currently used
+func (pool *NodePool) Current() *Node {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+	return pool.nodes[pool.current]
+}
+
+// Len returns the number of nodes in the pool
+func (pool *NodePool) Len() int {
+	return len(pool.nodes)
+}
+
+// SelectBest queries the best block height of all nodes and switches to the node with the highest one.
+// The current node is kept if it is healthy and less than minLag blocks behind.
+// It returns whether the node was switched, or an error if no node is reachable.
+func (pool *NodePool) SelectBest(ctx context.Context, minLag uint64) (bool, error) {
+	heights := make([]uint64, len(pool.nodes))
+	errs := make([]error, len(pool.nodes))
+	var wg sync.WaitGroup
+	for i, node := range pool.nodes {
+		wg.Add(1)
+		go func(i int, node *Node) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, nodeCheckTimeout)
+			defer cancel()
+			blockchain, err := node.Client.Blockchain(ctx, &types.Empty{})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			heights[i] = blockchain.BestHeight
+		}(i, node)
+	}
+	wg.Wait()
+
+	pool.mutex.Lock()
+	current := pool.current
+	best := -1
+	if errs[current] == nil {
+		best = current
+	}
+	for i := range pool.nodes {
+		if errs[i] == nil && (best == -1 || heights[i] > heights[best]) {
+			best = i
+		}
+	}
+	if best == -1 {
+		pool.mutex.Unlock()
+		return false, errors.New("no aergo server is reachable")
+	}
+	if best == current || (errs[current] == nil && heights[best] < heights[current]+minLag) {
+		pool.mutex.Unlock()
+		return false, nil
+	}
+	pool.current = best
+	pool.mutex.Unlock()
+
+	for i, node := range pool.nodes {
+		if errs[i] != nil {
+			pool.log.Info().Str("serverAddr", node.Address).Err(errs[i]).Msg("Aergo server is unreachable")
+		} else {
+			pool.log.Info().Str("serverAddr", node.Address).Uint64("bestHeight", heights[i]).Uint64("lag", heights[best]-heights[i]).Msg("Aergo server status")
+		}
+	}
+	pool.log.Info().Str("from", pool.nodes[current].Address).Str("to", pool.nodes[best].Address).Msg("Switched aergo server")
+	return true, nil
+}
+
+// client returns the client of the node currently used
+func (ns *Indexer) client() types.AergoRPCServiceClient {
+	return ns.nodes.Current().Client
+}
+
+// monitorNodes periodically checks all nodes and moves the stream to another node if the current one falls behind
+func (ns *Indexer) monitorNodes() {
+	for {
+		select {
+		case <-time.After(nodeCheckInterval):
+		case <-ns.ctx.Done():
+			return
+		}
+		switched, err := ns.nodes.SelectBest(ns.ctx, nodeSwitchLag)
+		if err != nil {
+			ns.log.Warn().Err(err).Msg("Failed to check aergo servers")
+			continue
+		}
+		if switched && ns.GetState() == StateRunning {
+			ns.switchStream()
+		}
+	}
+}
+
+// switchStream reconnects the block stream to the current node, keeping the lock and sync position
+func (ns *Indexer) switchStream() {
+	if !ns.setState(StateRestarting) {
+		return
+	}
+	ns.closeStream()
+	if err := ns.StartStream(); err != nil {
+		ns.log.Error().Err(err).Msg("Failed to switch stream")
+		ns.RestartStream()
+	}
+}
@@ -0,0 +1,153 @@
+package indexer
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/aergoio/aergo-indexer/indexer/db"
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+	"github.com/aergoio/aergo-indexer/types"
+	"github.com/mr-tron/base58/base58"
+)
+
+// maxReorgDepth is the maximum number of blocks to walk back when looking for a common ancestor
+const maxReorgDepth = 1000
+
+// blockNumberQuery encodes a block number for RPC calls that accept either hash or number
+func blockNumberQuery(blockHeight uint64) *types.SingleBytes {
+	blockQuery := make([]byte, 8)
+	binary.LittleEndian.PutUint64(blockQuery, blockHeight)
+	return &types.SingleBytes{Value: blockQuery}
+}
+
+// GetBlockHashFromDb returns the hash of the indexed block at blockHeight, or an empty string if it is not indexed
+func (ns *Indexer) GetBlockHashFromDb(blockHeight uint64) (string, error) {
+	return ns.getBlockHashFrom(ns.db, blockHeight)
+}
+
+// getBlockHashFrom returns the hash of the block at blockHeight indexed in dbController, or an empty string if it is not indexed
+func (ns *Indexer) getBlockHashFrom(dbController db.DbController, blockHeight uint64) (string, error) {
+	block, err := dbController.SelectOne(ns.writeCtx, db.QueryParams{
+		IndexName:    ns.indexNamePrefix + "block",
+		SortField:    "no",
+		SortAsc:      false,
+		IntegerRange: &db.IntegerRangeQuery{Field: "no", Min: blockHeight, Max: blockHeight},
+	}, func() doc.DocType {
+		block := new(doc.EsBlock)
+		block.BaseEsType = new(doc.BaseEsType)
+		return block
+	})
+	if err != nil {
+		return "", err
+	}
+	if block == nil {
+		return "", nil
+	}
+	return block.GetID(), nil
+}
+
+// GetBlockHashFromNode returns the hash of the block at blockHeight on the node's canonical chain
+func (ns *Indexer) GetBlockHashFromNode(blockHeight uint64) (string, error) {
+	metadata, err := ns.client().GetBlockMetadata(context.Background(), blockNumberQuery(blockHeight))
+	if err != nil {
+		return "", err
+	}
+	return base58.Encode(metadata.Hash), nil
+}
+
+// findCommonAncestor walks back from blockHeight until the indexed block hash agrees with the canonical chain.
+// Heights that are not indexed are skipped, as they are re-indexed together with the diverged range anyway.
+// The returned bool is false if the whole indexed range down to the sync start diverged.
+func (ns *Indexer) findCommonAncestor(blockHeight uint64) (uint64, bool, error) {
+	return ns.findCommonAncestorIn(ns.db, blockHeight)
+}
+
+// findCommonAncestorIn is like findCommonAncestor for the blocks indexed in dbController
+func (ns *Indexer) findCommonAncestorIn(dbController db.DbController, blockHeight uint64) (uint64, bool, error) {
+	lowerBound := uint64(ns.startFrom)
+	for height, depth := blockHeight, 0; height >= lowerBound; height, depth = height-1, depth+1 {
+		if depth >= maxReorgDepth {
+			return 0, false, fmt.Errorf("no common ancestor within %d blocks of %d", maxReorgDepth, blockHeight)
+		}
+		storedHash, err := ns.getBlockHashFrom(dbController, height)
+		if err != nil {
+			return 0, false, err
+		}
+		if storedHash != "" {
+			canonicalHash, err := ns.GetBlockHashFromNode(height)
+			if err != nil {
+				return 0, false, err
+			}
+			if storedHash == canonicalHash {
+				return height, true, nil
+			}
+		}
+		if height == 0 {
+			break
+		}
+	}
+	return 0, false, nil
+}
+
+// handleReorg rolls back all indexed blocks that are no longer part of the canonical chain
+// and re-indexes the diverged range below newHeight from the node.
+// The block at newHeight itself is indexed by the caller.
+// The sync position is moved back to the common ancestor and advanced with every re-indexed block, so the checkpoint never
+// covers a deleted block. It returns false if it was interrupted by shutdown before all blocks were indexed again.
+func (ns *Indexer) handleReorg(newHeight uint64, lastBlockHeight uint64) bool {
+	// First height that is not shared by the indexed and the canonical chain
+	divergedFrom := uint64(ns.startFrom)
+	if newHeight > 0 {
+		ancestor, found, err := ns.findCommonAncestor(newHeight - 1)
+		if err != nil {
+			// At least the last indexed block is known not to be the parent of the new block
+			divergedFrom = newHeight
+			if lastBlockHeight < divergedFrom {
+				divergedFrom = lastBlockHeight
+			}
+			ns.log.Warn().Err(err).Uint64("blockNumber", newHeight).Uint64("divergedFrom", divergedFrom).Msg("Failed to find common ancestor, rolling back from last indexed block")
+		} else if found {
+			divergedFrom = ancestor + 1
+		}
+	}
+	ns.log.Info().Uint64("divergedFrom", divergedFrom).Uint64("newHeight", newHeight).Uint64("lastHeight", lastBlockHeight).Msg("Detected chain reorganization")
+
+	if divergedFrom <= lastBlockHeight {
+		ns.DeleteBlocksInRange(divergedFrom, lastBlockHeight)
+		ancestorHeight, ancestorHash := uint64(0), ""
+		if divergedFrom > 0 {
+			ancestorHeight = divergedFrom - 1
+			hash, err := ns.GetBlockHashFromDb(ancestorHeight)
+			if err != nil {
+				ns.log.Warn().Err(err).Uint64("blockNo", ancestorHeight).Msg("Failed to get hash of common ancestor")
+			}
+			ancestorHash = hash
+		}
+		ns.setLastBlock(ancestorHeight, ancestorHash)
+	}
+
+	// Blocks between the common ancestor and the new block were replaced as well
+	for blockHeight := divergedFrom; blockHeight < newHeight; blockHeight++ {
+		if ns.ctx.Err() != nil {
+			return false
+		}
+		block, err := ns.getBlock(ns.ctx, blockHeight)
+		if err != nil {
+			if ns.ctx.Err() != nil {
+				return false
+			}
+			ns.log.Warn().Uint64("blockHeight", blockHeight).Err(err).Msg("Failed to get block")
+			ns.recordFailedBlock(blockHeight, err)
+			continue
+		}
+		if writer, ok := ns.batchWriter(); ok {
+			// Committed together with the sync position, like new blocks
+			ns.syncBlockInTransaction(writer, block)
+			continue
+		}
+		ns.IndexBlock(block)
+		ns.setLastBlock(blockHeight, base58.Encode(block.Hash))
+	}
+	return ns.ctx.Err() == nil
+}
@@ -0,0 +1,212 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/aergoio/aergo-indexer/indexer/db"
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+	"github.com/aergoio/aergo-indexer/types"
+)
+
+const (
+	// retryDelay is the delay before the first retry. It doubles with every further retry
+	retryDelay = 500 * time.Millisecond
+	// maxRetryDelay is the maximum delay between two retries
+	maxRetryDelay = 30 * time.Second
+	// failedBlockRetryInterval is the interval in which failed blocks are retried in the background
+	failedBlockRetryInterval = 10 * time.Minute
+)
+
+// withRetry calls fn until it succeeds, ns.retries retries have been made, or ctx is cancelled
+// It returns the last error of fn
+func (ns *Indexer) withRetry(ctx context.Context, fn func() error) error {
+	return ns.retryWhile(ctx, func(error) bool { return true }, fn)
+}
+
+// withDbRetry calls fn like withRetry, but only retries transient database errors like timeouts and deadlocks
+func (ns *Indexer) withDbRetry(ctx context.Context, fn func() error) error {
+	return ns.retryWhile(ctx, db.IsTransient, fn)
+}
+
+// retryWhile calls fn until it succeeds, fails with an error that is not retryable, ns.retries retries have been made, or ctx is cancelled
+// It returns the last error of fn
+func (ns *Indexer) retryWhile(ctx context.Context, retryable func(error) bool, fn func() error) error {
+	delay := retryDelay
+	for retry := 0; ; retry++ {
+		err := fn()
+		if err == nil || retry >= ns.retries || !retryable(err) {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// getBlock fetches a block by height, retrying on errors
+func (ns *Indexer) getBlock(ctx context.Context, blockHeight uint64) (*types.Block, error) {
+	var block *types.Block
+	err := ns.withRetry(ctx, func() (err error) {
+		block, err = ns.client().GetBlock(ctx, blockNumberQuery(blockHeight))
+		return err
+	})
+	return block, err
+}
+
+// failedBlockIndexName returns the name of the index holding blocks that could not be indexed completely
+func (ns *Indexer) failedBlockIndexName() string {
+	return ns.aliasNamePrefix + "failed_block"
+}
+
+// recordFailedBlock persists a block height that could not be indexed completely, so it can be retried later
+func (ns *Indexer) recordFailedBlock(blockHeight uint64, cause error) {
+	failedBlock := doc.EsFailedBlock{
+		BaseEsType:  &doc.BaseEsType{fmt.Sprintf("%s%d", ns.indexNamePrefix, blockHeight)},
+		Timestamp:   time.Now().UTC(),
+		BlockNo:     blockHeight,
+		IndexPrefix: ns.indexNamePrefix,
+		Error:       cause.Error(),
+	}
+	err := ns.withDbRetry(ns.writeCtx, func() error {
+		_, err := ns.db.Insert(ns.writeCtx, failedBlock, db.UpdateParams{IndexName: ns.failedBlockIndexName(), TypeName: "failed_block", Upsert: true})
+		return err
+	})
+	if err != nil {
+		ns.log.Error().Err(err).Uint64("blockHeight", blockHeight).Msg("Failed to record failed block")
+		return
+	}
+	ns.log.Warn().Err(cause).Uint64("blockHeight", blockHeight).Msg("Recorded failed block")
+}
+
+// failedBlocksFilter matches the failed blocks of the current index generation from fromBlockHeight to toBlockHeight
+func (ns *Indexer) failedBlocksFilter(fromBlockHeight uint64, toBlockHeight uint64) db.Filter {
+	return db.And(db.Term("index_prefix", ns.indexNamePrefix), db.Range("blockno", fromBlockHeight, toBlockHeight))
+}
+
+// removeFailedBlock removes a block height from the failed blocks of the current index generation
+func (ns *Indexer) removeFailedBlock(blockHeight uint64) error {
+	_, err := ns.db.Delete(ns.writeCtx, db.QueryParams{
+		IndexName: ns.failedBlockIndexName(),
+		Filter:    ns.failedBlocksFilter(blockHeight, blockHeight),
+	})
+	return err
+}
+
+// GetFailedBlocks returns the heights of all blocks of the current index generation that could not be indexed completely, in ascending order
+func (ns *Indexer) GetFailedBlocks() ([]uint64, error) {
+	return ns.getFailedBlocks(db.Term("index_prefix", ns.indexNamePrefix))
+}
+
+// getFailedBlocks returns the heights of the failed blocks matching filter, in ascending order
+func (ns *Indexer) getFailedBlocks(filter db.Filter) ([]uint64, error) {
+	scroll := ns.db.Scroll(ns.writeCtx, db.QueryParams{
+		IndexName: ns.failedBlockIndexName(),
+		TypeName:  "failed_block",
+		Size:      1000,
+		SortField: "blockno",
+		SortAsc:   true,
+		Filter:    filter,
+	}, func() doc.DocType {
+		failedBlock := new(doc.EsFailedBlock)
+		failedBlock.BaseEsType = new(doc.BaseEsType)
+		return failedBlock
+	})
+
+	seen := make(map[uint64]bool)
+	heights := make([]uint64, 0)
+	for {
+		document, err := scroll.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if len(seen) == 0 && db.IsNotFound(err) {
+				if createErr := ns.db.CreateIndex(ns.writeCtx, ns.failedBlockIndexName(), "failed_block"); createErr == nil {
+					ns.log.Info().Str("indexName", ns.failedBlockIndexName()).Msg("Created index")
+					return heights, nil
+				}
+			}
+			return nil, err
+		}
+		failedBlock := document.(*doc.EsFailedBlock)
+		if seen[failedBlock.BlockNo] {
+			continue
+		}
+		seen[failedBlock.BlockNo] = true
+		heights = append(heights, failedBlock.BlockNo)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	return heights, nil
+}
+
+// RetryFailedBlocks indexes all failed blocks up to the last synced block again, replacing any documents that were indexed before.
+// A failed block is only removed once it has been indexed completely, otherwise it is kept or recorded again.
+// Blocks are retried one at a time under chainMutex, so they are never changed concurrently by the sequencer rolling back a fork.
+func (ns *Indexer) RetryFailedBlocks() {
+	ns.backfills.Add(1)
+	defer ns.backfills.Done()
+	if ns.GetState() == StateIdle || ns.ctx.Err() != nil {
+		return
+	}
+	lastBlockHeight, _ := ns.getLastBlock()
+	heights, err := ns.getFailedBlocks(ns.failedBlocksFilter(0, lastBlockHeight))
+	if err != nil {
+		ns.log.Warn().Err(err).Msg("Failed to query failed blocks")
+		return
+	}
+	if len(heights) == 0 {
+		return
+	}
+	ns.log.Info().Int("failedBlocks", len(heights)).Msg("Retrying failed blocks")
+
+	for _, blockHeight := range heights {
+		if ns.ctx.Err() != nil {
+			return
+		}
+		ns.retryFailedBlock(blockHeight)
+	}
+}
+
+// retryFailedBlock indexes the block at blockHeight of the canonical chain again
+func (ns *Indexer) retryFailedBlock(blockHeight uint64) {
+	ns.chainMutex.Lock()
+	defer ns.chainMutex.Unlock()
+	if lastBlockHeight, _ := ns.getLastBlock(); blockHeight > lastBlockHeight {
+		// Rolled back since it failed. It is indexed again when the chain reaches it
+		return
+	}
+	block, err := ns.getBlock(ns.ctx, blockHeight)
+	if err != nil {
+		ns.log.Warn().Uint64("blockHeight", blockHeight).Err(err).Msg("Failed to get block")
+		return
+	}
+	ns.DeleteBlocksInRange(blockHeight, blockHeight)
+	if err := ns.IndexBlock(block); err != nil {
+		return
+	}
+	if err := ns.removeFailedBlock(blockHeight); err != nil {
+		ns.log.Warn().Uint64("blockHeight", blockHeight).Err(err).Msg("Failed to remove failed block")
+	}
+}
+
+// RetryFailedBlocksPeriodically calls RetryFailedBlocks in the background until the indexer is shut down
+func (ns *Indexer) RetryFailedBlocksPeriodically() {
+	for {
+		select {
+		case <-time.After(failedBlockRetryInterval):
+		case <-ns.ctx.Done():
+			return
+		}
+		ns.RetryFailedBlocks()
+	}
+}
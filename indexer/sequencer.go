@@ -0,0 +1,66 @@
+package indexer
+
+import (
+	"github.com/aergoio/aergo-indexer/types"
+)
+
+// blockQueueSize is the number of streamed blocks that can wait for processing
+// before the stream stops receiving new blocks
+const blockQueueSize = 100
+
+// startSequencer creates the block queue and starts the goroutine consuming it.
+// It is only called once; the queue outlives stream restarts.
+func (ns *Indexer) startSequencer() {
+	if ns.blockQueue != nil {
+		return
+	}
+	ns.blockQueue = make(chan *types.Block, blockQueueSize)
+	ns.sequencerDone = make(chan struct{})
+	go ns.runSequencer()
+}
+
+// runSequencer applies queued blocks strictly one after another, in the order they were received.
+// Because blocks are never synced concurrently, SyncBlock always sees the state left by the previous block,
+// which is what the skip and reorg detection depends on.
+// On shutdown, the block being processed is finished and queued blocks are dropped.
+// Every block is processed under chainMutex, which retries of failed blocks take as well.
+func (ns *Indexer) runSequencer() {
+	defer close(ns.sequencerDone)
+	for {
+		select {
+		case <-ns.ctx.Done():
+			return
+		case block := <-ns.blockQueue:
+			if ns.ctx.Err() != nil {
+				return
+			}
+			ns.chainMutex.Lock()
+			ns.processBlock(block)
+			ns.chainMutex.Unlock()
+		}
+	}
+}
+
+// enqueueBlock adds a block to the sequencer queue.
+// It blocks while the queue is full, so the stream is not read faster than blocks can be indexed.
+func (ns *Indexer) enqueueBlock(block *types.Block) {
+	select {
+	case ns.blockQueue <- block:
+	case <-ns.ctx.Done():
+	}
+}
+
+// getLastBlock returns the height and hash of the last synced block
+func (ns *Indexer) getLastBlock() (uint64, string) {
+	ns.lastBlockMutex.RLock()
+	defer ns.lastBlockMutex.RUnlock()
+	return ns.lastBlockHeight, ns.lastBlockHash
+}
+
+// setLastBlock updates the height and hash of the last synced block
+func (ns *Indexer) setLastBlock(height uint64, hash string) {
+	ns.lastBlockMutex.Lock()
+	defer ns.lastBlockMutex.Unlock()
+	ns.lastBlockHeight = height
+	ns.lastBlockHash = hash
+}
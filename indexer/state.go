@@ -0,0 +1,135 @@
+package indexer
+
+// State is the state of the indexer's block stream
+type State string
+
+// Stream states
+const (
+	StateBooting    State = "booting"
+	StateRunning    State = "running"
+	StateIdle       State = "idle"
+	StateRestarting State = "restarting"
+	StateStopped    State = "stopped"
+)
+
+// BulkState is the state of bulk indexing missing blocks
+type BulkState string
+
+// Bulk states
+const (
+	BulkStateRunning  BulkState = "running"
+	BulkStateFinished BulkState = "finished"
+)
+
+// stateTransitions lists the states that can be entered from each state. Stopped is final.
+var stateTransitions = map[State][]State{
+	StateBooting:    {StateRunning, StateIdle, StateRestarting, StateStopped},
+	StateRunning:    {StateIdle, StateRestarting, StateStopped},
+	StateIdle:       {StateRunning, StateRestarting, StateStopped},
+	StateRestarting: {StateRunning, StateIdle, StateRestarting, StateStopped},
+	StateStopped:    {},
+}
+
+// StateChange is sent to subscribers whenever the stream state or bulk state changes
+type StateChange struct {
+	From      State
+	To        State
+	BulkState BulkState
+}
+
+// stateSubscriberBuffer is the number of state changes buffered for each subscriber
+const stateSubscriberBuffer = 16
+
+// GetState returns the current stream state
+func (ns *Indexer) GetState() State {
+	ns.stateMutex.Lock()
+	defer ns.stateMutex.Unlock()
+	return ns.state
+}
+
+// GetBulkState returns whether any missing blocks are currently being bulk indexed
+func (ns *Indexer) GetBulkState() BulkState {
+	ns.stateMutex.Lock()
+	defer ns.stateMutex.Unlock()
+	return ns.bulkStateLocked()
+}
+
+func (ns *Indexer) bulkStateLocked() BulkState {
+	if ns.runningBulks > 0 {
+		return BulkStateRunning
+	}
+	return BulkStateFinished
+}
+
+// setState transitions to a new stream state.
+// It returns false without changing the state if the transition is not allowed, e.g. because the indexer was stopped.
+func (ns *Indexer) setState(to State) bool {
+	ns.stateMutex.Lock()
+	defer ns.stateMutex.Unlock()
+	from := ns.state
+	allowed := false
+	for _, state := range stateTransitions[from] {
+		if state == to {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		ns.log.Debug().Str("from", string(from)).Str("to", string(to)).Msg("Ignoring state transition")
+		return false
+	}
+	ns.state = to
+	ns.notifyStateChangeLocked(from)
+	return true
+}
+
+// beginBulk marks the start of bulk indexing a range of blocks
+func (ns *Indexer) beginBulk() {
+	ns.stateMutex.Lock()
+	defer ns.stateMutex.Unlock()
+	ns.runningBulks++
+	if ns.runningBulks == 1 {
+		ns.notifyStateChangeLocked(ns.state)
+	}
+}
+
+// endBulk marks the end of bulk indexing a range of blocks
+func (ns *Indexer) endBulk() {
+	ns.stateMutex.Lock()
+	defer ns.stateMutex.Unlock()
+	ns.runningBulks--
+	if ns.runningBulks == 0 {
+		ns.notifyStateChangeLocked(ns.state)
+	}
+}
+
+// notifyStateChangeLocked sends the current state to all subscribers and closes the finished channel once the indexer is done.
+// Subscribers that don't keep up miss changes instead of blocking the indexer.
+func (ns *Indexer) notifyStateChangeLocked(from State) {
+	change := StateChange{From: from, To: ns.state, BulkState: ns.bulkStateLocked()}
+	for _, subscriber := range ns.stateSubscribers {
+		select {
+		case subscriber <- change:
+		default:
+			ns.log.Warn().Str("state", string(change.To)).Msg("State subscriber is not keeping up, dropping state change")
+		}
+	}
+	if ns.state == StateStopped && ns.runningBulks == 0 && !ns.isFinished {
+		ns.isFinished = true
+		close(ns.finished)
+	}
+}
+
+// Subscribe returns a channel receiving all subsequent state changes
+func (ns *Indexer) Subscribe() <-chan StateChange {
+	ns.stateMutex.Lock()
+	defer ns.stateMutex.Unlock()
+	subscriber := make(chan StateChange, stateSubscriberBuffer)
+	ns.stateSubscribers = append(ns.stateSubscribers, subscriber)
+	return subscriber
+}
+
+// Finished returns a channel that is closed once the indexer is stopped and no bulk indexing is running anymore
+func (ns *Indexer) Finished() <-chan struct{} {
+	return ns.finished
+}
@@ -0,0 +1,30 @@
+package indexer
+
+import (
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+)
+
+// Status is the sync status of an alias prefix as stored in the database
+type Status struct {
+	Checkpoint   *doc.EsCheckpoint
+	FailedBlocks []uint64
+}
+
+// GetStatus reads the sync status of the current index generation from the database
+func (ns *Indexer) GetStatus() (*Status, error) {
+	checkpoint, err := ns.LoadCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint != nil {
+		ns.indexNamePrefix = checkpoint.IndexPrefix
+	}
+	failedBlocks, err := ns.GetFailedBlocks()
+	if err != nil {
+		return nil, err
+	}
+	return &Status{
+		Checkpoint:   checkpoint,
+		FailedBlocks: failedBlocks,
+	}, nil
+}
@@ -0,0 +1,144 @@
+package indexer
+
+import (
+	"fmt"
+
+	"github.com/aergoio/aergo-indexer/indexer/db"
+	doc "github.com/aergoio/aergo-indexer/indexer/documents"
+	"github.com/aergoio/aergo-indexer/types"
+	"github.com/mr-tron/base58/base58"
+)
+
+// batchWriter returns the database as a db.BatchWriter if it can commit the documents of several indices in one transaction
+func (ns *Indexer) batchWriter() (db.BatchWriter, bool) {
+	writer, ok := ns.db.(db.BatchWriter)
+	return writer, ok
+}
+
+// convBlockDocuments converts a block and its transactions into documents
+func (ns *Indexer) convBlockDocuments(block *types.Block) *blockDocuments {
+	docs := &blockDocuments{block: ns.ConvBlock(block)}
+	if len(block.Body.Txs) > 0 {
+		if err := ns.convTxs(block, block.Body.Txs, docs); err != nil {
+			ns.recordFailedBlock(block.Header.BlockNo, err)
+			docs.err = err
+		}
+	}
+	return docs
+}
+
+// blockBatchItems returns the documents of blocks grouped by index
+func (ns *Indexer) blockBatchItems(blocks []*blockDocuments, failOnConflict bool) []db.BatchItem {
+	items := []db.BatchItem{
+		{Params: db.UpdateParams{IndexName: ns.indexNamePrefix + "block", TypeName: "block"}, FailOnConflict: failOnConflict},
+		{Params: db.UpdateParams{IndexName: ns.indexNamePrefix + "tx", TypeName: "tx"}},
+		{Params: db.UpdateParams{IndexName: ns.indexNamePrefix + "name", TypeName: "name", Upsert: true}},
+		{Params: db.UpdateParams{IndexName: ns.indexNamePrefix + "token", TypeName: "token", Upsert: true}},
+		{Params: db.UpdateParams{IndexName: ns.indexNamePrefix + "token_transfer", TypeName: "token_transfer", Upsert: true}},
+	}
+	for _, docs := range blocks {
+		items[0].Documents = append(items[0].Documents, docs.block)
+		items[1].Documents = append(items[1].Documents, docs.txs...)
+		items[2].Documents = append(items[2].Documents, docs.names...)
+		items[3].Documents = append(items[3].Documents, docs.tokens...)
+		items[4].Documents = append(items[4].Documents, docs.tokenTransfers...)
+	}
+	for i := range items {
+		items[i].Params.DeadLetterIndex = ns.deadLetterIndexName()
+	}
+	return items
+}
+
+// commitBlocks writes the documents of blocks together with the checkpoint of blockNo in one transaction,
+// so SQL consumers never observe a partially indexed block. The checkpoint does not advance past pending backfills.
+// If failOnConflict is set, the transaction fails if a block already exists, i.e. it was indexed by another instance.
+func (ns *Indexer) commitBlocks(writer db.BatchWriter, blocks []*blockDocuments, blockNo uint64, blockHash string, failOnConflict bool) error {
+	checkpoint := ns.checkpointDocument(blockNo, blockHash)
+	items := append(ns.blockBatchItems(blocks, failOnConflict), db.BatchItem{
+		Params:    db.UpdateParams{IndexName: ns.checkpointIndexName(), TypeName: "checkpoint", Upsert: true},
+		Documents: []doc.DocType{checkpoint},
+	})
+	return writer.WriteBatch(ns.writeCtx, items)
+}
+
+// handleIndexBlockError idles if the block was indexed by another instance, otherwise records the block for retrying
+func (ns *Indexer) handleIndexBlockError(blockNo uint64, err error) {
+	if db.IsConflict(err) {
+		ns.log.Warn().Err(err).Msg("Detected conflict")
+		if ns.idleOnConflict > 0 {
+			ns.IdleFor(ns.idleOnConflict)
+		}
+		return
+	}
+	ns.log.Warn().Err(err).Msg("Failed to index block")
+	ns.recordFailedBlock(blockNo, err)
+}
+
+// indexBlockInTransaction indexes one block in a single transaction with the checkpoint of the last synced block.
+// It returns an error if the block could not be indexed completely.
+func (ns *Indexer) indexBlockInTransaction(writer db.BatchWriter, block *types.Block) error {
+	docs := ns.convBlockDocuments(block)
+	ns.checkpointMutex.Lock()
+	lastBlockHeight, lastBlockHash := ns.getLastBlock()
+	err := ns.commitBlocks(writer, []*blockDocuments{docs}, lastBlockHeight, lastBlockHash, true)
+	ns.checkpointMutex.Unlock()
+	if err != nil {
+		ns.handleIndexBlockError(block.Header.BlockNo, err)
+		return err
+	}
+	ns.log.Info().Uint64("no", block.Header.BlockNo).Int("txs", len(block.Body.Txs)).Str("hash", docs.block.GetID()).Msg("Indexed block")
+	return docs.err
+}
+
+// syncBlockInTransaction indexes a new block and advances the checkpoint to it in a single transaction.
+// If the block cannot be written, the sync position still advances and the checkpoint is written on its own, like in SyncBlock.
+func (ns *Indexer) syncBlockInTransaction(writer db.BatchWriter, block *types.Block) {
+	newHeight, newHash := block.Header.BlockNo, base58.Encode(block.Hash)
+	if ns.GetState() != StateIdle {
+		docs := ns.convBlockDocuments(block)
+		ns.checkpointMutex.Lock()
+		err := ns.commitBlocks(writer, []*blockDocuments{docs}, newHeight, newHash, true)
+		if err == nil {
+			ns.setLastBlock(newHeight, newHash)
+		}
+		ns.checkpointMutex.Unlock()
+		if err == nil {
+			ns.log.Info().Uint64("no", newHeight).Int("txs", len(block.Body.Txs)).Str("hash", newHash).Msg("Indexed block")
+			return
+		}
+		ns.handleIndexBlockError(newHeight, err)
+	}
+	ns.setLastBlock(newHeight, newHash)
+	ns.WriteCheckpoint()
+}
+
+// indexBlocksInRangeInTransactions indexes blocks in the range of [fromBlockHeight, toBlockHeight], committing every chunk of
+// backfillChunkSize blocks in a single transaction. Blocks of chunks that fail to commit are recorded for retrying.
+// progress, if set, is called with the last block of every chunk that was committed or recorded.
+func (ns *Indexer) indexBlocksInRangeInTransactions(writer db.BatchWriter, fromBlockHeight uint64, toBlockHeight uint64, progress func(uint64)) {
+	ns.log.Info().Msg(fmt.Sprintf("Indexing %d missing blocks [%d..%d]", (1 + toBlockHeight - fromBlockHeight), fromBlockHeight, toBlockHeight))
+	// Also commits what has been fetched so far when stopped by shutdown
+	err := ns.fetchChunksInRange(ns.ctx, fromBlockHeight, toBlockHeight, func(chunk []*blockDocuments) error {
+		ns.checkpointMutex.Lock()
+		lastBlockHeight, lastBlockHash := ns.getLastBlock()
+		err := ns.commitBlocks(writer, chunk, lastBlockHeight, lastBlockHash, false)
+		ns.checkpointMutex.Unlock()
+		if err != nil {
+			ns.log.Warn().Err(err).Int("blocks", len(chunk)).Msg("Failed to commit blocks")
+			if ns.writeCtx.Err() != nil {
+				// Aborted by shutdown, the blocks stay pending
+				return nil
+			}
+			for _, docs := range chunk {
+				ns.recordFailedBlock(docs.block.(doc.EsBlock).BlockNo, err)
+			}
+		}
+		if progress != nil {
+			progress(chunk[len(chunk)-1].block.(doc.EsBlock).BlockNo)
+		}
+		return nil
+	})
+	if err != nil && ns.ctx.Err() == nil {
+		ns.log.Warn().Err(err).Uint64("from", fromBlockHeight).Uint64("to", toBlockHeight).Msg("Failed to index missing blocks")
+	}
+}
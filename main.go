@@ -2,9 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -13,6 +19,7 @@ import (
 	"github.com/aergoio/aergo-lib/log"
 	"github.com/spf13/cobra"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 var (
@@ -22,6 +29,12 @@ var (
 		Long:  "Aergo Metadata Indexer",
 		Run:   rootRun,
 	}
+	statusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show sync status",
+		Long:  "Show the sync checkpoint and blocks that could not be indexed completely",
+		Run:   statusRun,
+	}
 	reindexingMode  bool
 	exitOnComplete  bool
 	host            string
@@ -33,10 +46,26 @@ var (
 	startFrom       int32
 	stopAt          int32
 	idleOnConflict  int32
+	workers         int32
+	finalityMode    string
+	confirmations   int32
+	shutdownTimeout int32
+	retries         int32
+	useTLS          bool
+	tlsCA           string
+	tlsCert         string
+	tlsKey          string
+	tlsServerName   string
+	maxMsgSize      int32
+	dialTimeout     int32
+	lockFile        string
+	lockTTL         int32
+	lockKeepAlive   int32
+	partition       string
 
 	logger *log.Logger
 
-	client  types.AergoRPCServiceClient
+	nodes   *indx.NodePool
 	indexer *indx.Indexer
 )
 
@@ -46,13 +75,33 @@ func init() {
 	fs.BoolVar(&exitOnComplete, "exit-on-complete", false, "exit when reindexing sync completes for the first time")
 	fs.StringVarP(&host, "host", "H", "localhost", "host address of aergo server")
 	fs.Int32VarP(&port, "port", "p", 7845, "port number of aergo server")
-	fs.StringVarP(&aergoAddress, "aergo", "A", "", "host and port of aergo server. Alternative to setting host and port separately.")
-	fs.StringVarP(&dbURL, "dburl", "E", "http://localhost:9200", "Database URL")
-	fs.StringVarP(&dbType, "dbtype", "T", "elastic", "Type of database used (elastic, mariadb)")
+	fs.StringVarP(&aergoAddress, "aergo", "A", "", "host and port of aergo server, or a comma-separated list of several servers to fail over between. Alternative to setting host and port separately.")
+	fs.StringVarP(&dbURL, "dburl", "E", "http://localhost:9200", "Database URL, file path for sqlite, output directory for file, or type=url list for fanout")
+	fs.StringVarP(&dbType, "dbtype", "T", "elastic", "Type of database used (elastic, mariadb, postgres, sqlite, memory, file, fanout)")
 	fs.StringVarP(&indexNamePrefix, "prefix", "X", "chain_", "prefix used for index names")
 	fs.Int32VarP(&startFrom, "from", "", 0, "start syncing from this block number")
 	fs.Int32VarP(&stopAt, "to", "", -1, "stop syncing at this block number")
-	fs.Int32VarP(&idleOnConflict, "conflict", "", 0, "time to idle when a conflict occurs (in seconds). Use this for optimistic concurrency. Elasticsearch only")
+	fs.Int32VarP(&idleOnConflict, "conflict", "", 0, "time to idle when a conflict occurs (in seconds). Use this for optimistic concurrency. Elasticsearch and MariaDB only")
+	fs.StringVarP(&finalityMode, "finality", "", "", "only index final blocks (delay) or mark blocks as confirmed once final (mark)")
+	fs.Int32VarP(&confirmations, "confirmations", "", 0, "number of blocks after which a block is final. Uses the consensus' last irreversible block if 0")
+	fs.Int32VarP(&shutdownTimeout, "shutdown-timeout", "", 30, "time to wait for pending writes when shutting down (in seconds)")
+	fs.Int32VarP(&retries, "retries", "", 5, "number of retries with exponential backoff when fetching data from the aergo server or a transient database error occurs")
+	fs.Int32VarP(&workers, "workers", "", 1, "number of parallel workers fetching blocks when indexing missing blocks")
+	fs.BoolVar(&useTLS, "tls", false, "connect to aergo server using TLS. Implied by the other tls flags")
+	fs.StringVar(&tlsCA, "tls-ca", "", "CA bundle for verifying the aergo server's certificate. Uses the system's CAs if empty")
+	fs.StringVar(&tlsCert, "tls-cert", "", "client certificate for connecting to aergo server")
+	fs.StringVar(&tlsKey, "tls-key", "", "private key of the client certificate")
+	fs.StringVar(&tlsServerName, "tls-server-name", "", "server name used to verify the aergo server's certificate, if it differs from the host")
+	fs.Int32VarP(&maxMsgSize, "max-msg-size", "", 10, "maximum size of messages sent to and received from aergo server (in MB)")
+	fs.Int32VarP(&dialTimeout, "dial-timeout", "", 5, "timeout for connecting to aergo server (in seconds)")
+	fs.StringVar(&lockFile, "lock-file", "", "use a lock file instead of the database's lock, for instances on the same host")
+	fs.Int32VarP(&lockTTL, "lock-ttl", "", 20, "time after which the lock expires unless kept alive (in seconds)")
+	fs.Int32VarP(&lockKeepAlive, "lock-keepalive", "", 2, "interval in which the lock is kept alive (in seconds)")
+	fs.StringVar(&partition, "partition", "", "split tx and token_transfer indices by month or into ranges of this many blocks. Elasticsearch and MariaDB (block ranges) only")
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
 }
 
 func main() {
@@ -71,68 +120,168 @@ func rootRun(cmd *cobra.Command, args []string) {
 		logger.Warn().Err(err).Str("dbURL", dbURL).Msg("Could not start indexer")
 		return
 	}
-	client = waitForClient(getServerAddress())
+	indexer.ConfigureLock(lockFile, time.Duration(lockTTL)*time.Second, time.Duration(lockKeepAlive)*time.Second)
+	if err := indexer.ConfigurePartitioning(partition); err != nil {
+		logger.Warn().Err(err).Str("partition", partition).Msg("Could not start indexer")
+		return
+	}
+
+	dialOptions, err := getDialOptions()
+	if err != nil {
+		logger.Warn().Err(err).Msg("Invalid connection options")
+		return
+	}
+	nodes, err = waitForNodes(getServerAddresses(), dialOptions)
+	if err != nil {
+		logger.Warn().Err(err).Str("aergoAddress", aergoAddress).Msg("Could not start indexer")
+		return
+	}
 
-	err = indexer.Start(client, reindexingMode, exitOnComplete, int64(startFrom), int64(stopAt), idleOnConflict)
+	err = indexer.Start(nodes, reindexingMode, exitOnComplete, int64(startFrom), int64(stopAt), idleOnConflict, int(workers), finalityMode, uint64(confirmations), int(retries))
 	if err != nil {
 		logger.Warn().Err(err).Str("dbURL", dbURL).Msg("Could not start indexer")
 		return
 	}
 
-	handleKillSig(func() {
-		indexer.Stop()
-	}, logger)
+	// Called on a kill signal or once the indexer finished, whichever comes first. Both exit with the result of the same shutdown
+	shutdown := func() int {
+		err := indexer.Shutdown(time.Duration(shutdownTimeout) * time.Second)
+		if err != nil {
+			logger.Warn().Err(err).Msg("Failed to shut down gracefully")
+			return 1
+		}
+		return 0
+	}
+	handleKillSig(shutdown, logger)
 
-	for {
-		if exitOnComplete {
-			if indexer.State == "stopped" && indexer.BulkState == "finished" {
-				break
-			}
-			time.Sleep(time.Second)
-		} else {
-			time.Sleep(time.Minute)
+	<-indexer.Finished()
+	os.Exit(shutdown())
+}
+
+func statusRun(cmd *cobra.Command, args []string) {
+	logger = log.NewLogger("indexer")
+
+	indexer, err := indx.NewIndexer(logger, dbType, dbURL, indexNamePrefix)
+	if err != nil {
+		logger.Warn().Err(err).Str("dbURL", dbURL).Msg("Could not connect to database")
+		os.Exit(1)
+	}
+	status, err := indexer.GetStatus()
+	if err != nil {
+		logger.Warn().Err(err).Str("dbURL", dbURL).Msg("Could not read status")
+		os.Exit(1)
+	}
+
+	if status.Checkpoint == nil {
+		fmt.Println("No checkpoint found")
+	} else {
+		fmt.Printf("Index prefix:   %s\n", status.Checkpoint.IndexPrefix)
+		fmt.Printf("Synced up to:   %d (%s)\n", status.Checkpoint.BlockNo, status.Checkpoint.BlockHash)
+		fmt.Printf("Updated at:     %s\n", status.Checkpoint.Timestamp.Format(time.RFC3339))
+		if status.Checkpoint.Reindexing {
+			fmt.Printf("Reindexing:     yes (target %d)\n", status.Checkpoint.ReindexTarget)
 		}
 	}
+	fmt.Printf("Failed blocks:  %d\n", len(status.FailedBlocks))
+	for _, blockNo := range status.FailedBlocks {
+		fmt.Printf("  %d\n", blockNo)
+	}
+	if len(status.FailedBlocks) > 0 {
+		os.Exit(2)
+	}
 }
 
-func getServerAddress() string {
+func getServerAddresses() []string {
 	if len(aergoAddress) > 0 {
-		return aergoAddress
+		addresses := make([]string, 0)
+		for _, address := range strings.Split(aergoAddress, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+		return addresses
 	}
-	return fmt.Sprintf("%s:%d", host, port)
+	return []string{fmt.Sprintf("%s:%d", host, port)}
 }
 
-func waitForClient(serverAddr string) types.AergoRPCServiceClient {
-	var conn *grpc.ClientConn
-	var err error
+// waitForNodes connects to all aergo servers and waits until at least one of them is reachable
+func waitForNodes(serverAddrs []string, dialOptions []grpc.DialOption) (*indx.NodePool, error) {
+	nodeList := make([]*indx.Node, 0, len(serverAddrs))
+	for _, serverAddr := range serverAddrs {
+		nodeList = append(nodeList, &indx.Node{Address: serverAddr, Client: dialClient(serverAddr, dialOptions)})
+	}
+	pool, err := indx.NewNodePool(logger, nodeList)
+	if err != nil {
+		return nil, err
+	}
 	for {
-		ctx := context.Background()
-		maxMsgSize := 1024 * 1024 * 10 // 10mb
-		conn, err = grpc.DialContext(ctx, serverAddr,
-			grpc.WithInsecure(),
-			grpc.WithBlock(),
-			grpc.WithTimeout(5*time.Second),
-			grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxMsgSize), grpc.MaxCallSendMsgSize(maxMsgSize)),
-		)
-		if err == nil && conn != nil {
+		_, err := pool.SelectBest(context.Background(), 0)
+		if err == nil {
 			break
 		}
-		logger.Info().Str("serverAddr", serverAddr).Err(err).Msg("Could not connect to aergo server, retrying")
+		logger.Info().Strs("serverAddrs", serverAddrs).Err(err).Msg("Could not connect to aergo server, retrying")
 		time.Sleep(time.Second)
 	}
-	logger.Info().Str("serverAddr", serverAddr).Msg("Connected to aergo server")
+	logger.Info().Str("serverAddr", pool.Current().Address).Msg("Connected to aergo server")
+	return pool, nil
+}
+
+// getDialOptions returns the options used for all connections to aergo servers
+func getDialOptions() ([]grpc.DialOption, error) {
+	maxMsgBytes := int(maxMsgSize) * 1024 * 1024
+	timeout := time.Duration(dialTimeout) * time.Second
+	options := []grpc.DialOption{
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxMsgBytes), grpc.MaxCallSendMsgSize(maxMsgBytes)),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			dialer := net.Dialer{Timeout: timeout}
+			return dialer.DialContext(ctx, "tcp", addr)
+		}),
+	}
+
+	if !useTLS && tlsCA == "" && tlsCert == "" && tlsKey == "" && tlsServerName == "" {
+		return append(options, grpc.WithInsecure()), nil
+	}
+	tlsConfig := &tls.Config{ServerName: tlsServerName}
+	if tlsCA != "" {
+		caBundle, err := ioutil.ReadFile(tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %s", tlsCA)
+		}
+	}
+	if tlsCert != "" || tlsKey != "" {
+		if tlsCert == "" || tlsKey == "" {
+			return nil, errors.New("Client certificate and key have to be set together")
+		}
+		certificate, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return append(options, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))), nil
+}
+
+// dialClient creates a client for an aergo server. The connection is established in the background and re-established when lost
+func dialClient(serverAddr string, dialOptions []grpc.DialOption) types.AergoRPCServiceClient {
+	conn, err := grpc.Dial(serverAddr, dialOptions...)
+	if err != nil {
+		logger.Fatal().Str("serverAddr", serverAddr).Err(err).Msg("Invalid aergo server address")
+	}
 	return types.NewAergoRPCServiceClient(conn)
 }
 
-func handleKillSig(handler func(), logger *log.Logger) {
+func handleKillSig(handler func() int, logger *log.Logger) {
 	sigChannel := make(chan os.Signal, 1)
 
 	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
 	go func() {
 		for signal := range sigChannel {
 			logger.Info().Msgf("Receive signal %s, Shutting down...", signal)
-			handler()
-			os.Exit(1)
+			os.Exit(handler())
 		}
 	}()
 }